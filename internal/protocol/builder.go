@@ -2,98 +2,181 @@ package protocol
 
 import (
 	"encoding/binary"
+	"fmt"
 	"strings"
 )
 
 type Builder struct {
-	data []byte
+	data     []byte
+	compress bool
+	names    map[string]int
 }
 
 func NewBuilder() *Builder {
 	return &Builder{
-		data: make([]byte, 0, 512),
+		data:     make([]byte, 0, 512),
+		compress: true,
+		names:    make(map[string]int),
 	}
 }
 
+// SetCompression enables or disables RFC 1035 name compression. It is
+// enabled by default; canonical (DNSSEC) wire form requires it off.
+func (b *Builder) SetCompression(enabled bool) {
+	b.compress = enabled
+}
+
 func (b *Builder) BuildMessage(msg *Message) ([]byte, error) {
 	b.data = make([]byte, 0, 512)
-	
+	b.names = make(map[string]int)
+
 	b.buildHeader(msg.Header)
-	
+
 	for _, q := range msg.Questions {
 		b.buildQuestion(q)
 	}
-	
-	for _, rr := range msg.Answers {
-		b.buildResourceRecord(rr)
+
+	for i, rr := range msg.Answers {
+		if err := b.buildResourceRecord(rr); err != nil {
+			return nil, fmt.Errorf("build answer %d: %w", i, err)
+		}
 	}
-	
-	for _, rr := range msg.Authorities {
-		b.buildResourceRecord(rr)
+
+	for i, rr := range msg.Authorities {
+		if err := b.buildResourceRecord(rr); err != nil {
+			return nil, fmt.Errorf("build authority %d: %w", i, err)
+		}
 	}
-	
-	for _, rr := range msg.Additional {
-		b.buildResourceRecord(rr)
+
+	for i, rr := range msg.Additional {
+		if err := b.buildResourceRecord(rr); err != nil {
+			return nil, fmt.Errorf("build additional %d: %w", i, err)
+		}
 	}
-	
+
 	return b.data, nil
 }
 
 func (b *Builder) buildHeader(h Header) {
 	header := make([]byte, 12)
-	
+
 	binary.BigEndian.PutUint16(header[0:2], h.ID)
 	binary.BigEndian.PutUint16(header[2:4], h.Flags)
 	binary.BigEndian.PutUint16(header[4:6], h.QuestionCount)
 	binary.BigEndian.PutUint16(header[6:8], h.AnswerCount)
 	binary.BigEndian.PutUint16(header[8:10], h.AuthorityCount)
 	binary.BigEndian.PutUint16(header[10:12], h.AdditionalCount)
-	
+
 	b.data = append(b.data, header...)
 }
 
+// buildName writes name in full. Its suffixes are still remembered so
+// that later compressible names can point into it.
 func (b *Builder) buildName(name string) {
+	b.writeName(name, false)
+}
+
+// buildCompressedName writes name, replacing the longest suffix already
+// present in the message with a compression pointer.
+func (b *Builder) buildCompressedName(name string) {
+	b.writeName(name, true)
+}
+
+func (b *Builder) writeName(name string, compressible bool) {
 	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		b.data = append(b.data, 0)
+		return
+	}
+
 	labels := strings.Split(name, ".")
-	
-	for _, label := range labels {
+
+	for i, label := range labels {
+		if b.compress {
+			suffix := strings.Join(labels[i:], ".")
+
+			if offset, found := b.names[suffix]; found && compressible {
+				b.writeUint16(0xC000 | uint16(offset))
+				return
+			}
+
+			// Pointers only have 14 bits of offset
+			if _, found := b.names[suffix]; !found && len(b.data) <= 0x3FFF {
+				b.names[suffix] = len(b.data)
+			}
+		}
+
 		b.data = append(b.data, byte(len(label)))
 		b.data = append(b.data, []byte(label)...)
 	}
-	
+
 	b.data = append(b.data, 0)
 }
 
 func (b *Builder) buildQuestion(q Question) {
-	b.buildName(q.Name)
-	
+	b.buildCompressedName(q.Name)
+
 	qtype := make([]byte, 2)
 	qclass := make([]byte, 2)
-	
+
 	binary.BigEndian.PutUint16(qtype, q.Type)
 	binary.BigEndian.PutUint16(qclass, q.Class)
-	
+
 	b.data = append(b.data, qtype...)
 	b.data = append(b.data, qclass...)
 }
 
-func (b *Builder) buildResourceRecord(rr ResourceRecord) {
-	b.buildName(rr.Name)
-	
-	rrType := make([]byte, 2)
-	rrClass := make([]byte, 2)
-	rrTTL := make([]byte, 4)
-	rrLength := make([]byte, 2)
-	
-	binary.BigEndian.PutUint16(rrType, rr.Type)
-	binary.BigEndian.PutUint16(rrClass, rr.Class)
-	binary.BigEndian.PutUint32(rrTTL, rr.TTL)
-	binary.BigEndian.PutUint16(rrLength, rr.RDLength)
-	
-	b.data = append(b.data, rrType...)
-	b.data = append(b.data, rrClass...)
-	b.data = append(b.data, rrTTL...)
-	b.data = append(b.data, rrLength...)
-	
-	b.data = append(b.data, rr.RData...)
-}
\ No newline at end of file
+func (b *Builder) buildResourceRecord(rr ResourceRecord) error {
+	b.buildCompressedName(rr.Name)
+
+	b.writeUint16(rr.Type)
+	b.writeUint16(rr.Class)
+	b.writeUint32(rr.TTL)
+
+	if rr.Data == nil {
+		b.writeUint16(uint16(len(rr.RData)))
+		b.writeBytes(rr.RData)
+		return nil
+	}
+
+	// RDLENGTH is only known once the typed data has been packed
+	lengthOffset := len(b.data)
+	b.writeUint16(0)
+
+	if err := rr.Data.Pack(b); err != nil {
+		return fmt.Errorf("pack %s rdata: %w", TypeToString(rr.Type), err)
+	}
+
+	length := len(b.data) - lengthOffset - 2
+	if length > 0xFFFF {
+		return fmt.Errorf("rdata too long: %d bytes", length)
+	}
+	binary.BigEndian.PutUint16(b.data[lengthOffset:], uint16(length))
+
+	return nil
+}
+
+func (b *Builder) writeUint8(v uint8) {
+	b.data = append(b.data, v)
+}
+
+func (b *Builder) writeUint16(v uint16) {
+	b.data = binary.BigEndian.AppendUint16(b.data, v)
+}
+
+func (b *Builder) writeUint32(v uint32) {
+	b.data = binary.BigEndian.AppendUint32(b.data, v)
+}
+
+func (b *Builder) writeBytes(v []byte) {
+	b.data = append(b.data, v...)
+}
+
+func (b *Builder) writeCharString(s string) error {
+	if len(s) > 255 {
+		return fmt.Errorf("character string too long: %d bytes", len(s))
+	}
+	b.data = append(b.data, byte(len(s)))
+	b.data = append(b.data, s...)
+	return nil
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import "fmt"
+
+const (
+	// DefaultEDNSPayloadSize is the UDP payload size recommended by DNS
+	// Flag Day 2020, small enough to avoid IP fragmentation on most paths.
+	DefaultEDNSPayloadSize = 1232
+
+	// MinUDPPayloadSize is the plain DNS UDP limit from RFC 1035.
+	MinUDPPayloadSize = 512
+
+	ednsFlagDO = 1 << 15
+)
+
+// EDNS holds the fields of an EDNS(0) OPT pseudo-record (RFC 6891).
+type EDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	DO            bool
+	Options       []EDNSOption
+}
+
+// NewEDNS returns an EDNS version 0 record advertising udpSize.
+func NewEDNS(udpSize uint16) *EDNS {
+	return &EDNS{UDPSize: udpSize}
+}
+
+// Record encodes e as an OPT resource record for the additional section.
+func (e *EDNS) Record() ResourceRecord {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= ednsFlagDO
+	}
+
+	options := append([]EDNSOption(nil), e.Options...)
+	return ResourceRecord{
+		Name:  "",
+		Type:  TypeOPT,
+		Class: e.UDPSize,
+		TTL:   ttl,
+		Data:  &OPTRecord{Options: options},
+	}
+}
+
+// EDNSFromRecord decodes an OPT resource record.
+func EDNSFromRecord(rr ResourceRecord) (*EDNS, error) {
+	if rr.Type != TypeOPT {
+		return nil, fmt.Errorf("not an OPT record: %s", TypeToString(rr.Type))
+	}
+
+	data, err := rr.TypedData()
+	if err != nil {
+		return nil, err
+	}
+
+	return &EDNS{
+		UDPSize:       rr.Class,
+		ExtendedRCode: uint8(rr.TTL >> 24),
+		Version:       uint8(rr.TTL >> 16),
+		DO:            rr.TTL&ednsFlagDO != 0,
+		Options:       data.(*OPTRecord).Options,
+	}, nil
+}
+
+// EDNS returns the message's OPT record, or nil if it has none.
+func (m *Message) EDNS() (*EDNS, error) {
+	var found *EDNS
+
+	for _, rr := range m.Additional {
+		if rr.Type != TypeOPT {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("multiple OPT records")
+		}
+		if rr.Name != "" {
+			return nil, fmt.Errorf("OPT record owner must be the root")
+		}
+
+		e, err := EDNSFromRecord(rr)
+		if err != nil {
+			return nil, err
+		}
+		found = e
+	}
+
+	return found, nil
+}
+
+// SetEDNS replaces any OPT record in the message with e. A nil e removes
+// EDNS from the message.
+func (m *Message) SetEDNS(e *EDNS) {
+	additional := m.Additional[:0:0]
+	for _, rr := range m.Additional {
+		if rr.Type != TypeOPT {
+			additional = append(additional, rr)
+		}
+	}
+
+	if e != nil {
+		additional = append(additional, e.Record())
+	}
+	m.Additional = additional
+}
+
+// MaxUDPSize returns the largest UDP response the sender of m accepts.
+func (m *Message) MaxUDPSize() int {
+	e, err := m.EDNS()
+	if err != nil || e == nil || e.UDPSize < MinUDPPayloadSize {
+		return MinUDPPayloadSize
+	}
+	return int(e.UDPSize)
+}
+
+// RCode returns the full response code, including the upper bits carried
+// in the OPT record.
+func (m *Message) RCode() uint16 {
+	rcode := m.Header.Flags & 0x0F
+
+	e, err := m.EDNS()
+	if err == nil && e != nil {
+		rcode |= uint16(e.ExtendedRCode) << 4
+	}
+	return rcode
+}
@@ -12,6 +12,14 @@ func ParseMessage(data []byte) (*Message, error) {
 	return parser.ParseMessage()
 }
 
+// ParseHeader decodes only the fixed 12-byte header, which is enough to
+// answer a message whose body is malformed.
+func ParseHeader(data []byte) (Header, error) {
+	var header Header
+	err := NewParser(data).parseHeader(&header)
+	return header, err
+}
+
 func BuildMessage(msg *Message) ([]byte, error) {
 	msg.Header.QuestionCount = uint16(len(msg.Questions))
 	msg.Header.AnswerCount = uint16(len(msg.Answers))
@@ -22,61 +30,82 @@ func BuildMessage(msg *Message) ([]byte, error) {
 	return builder.BuildMessage(msg)
 }
 
-func ParseTTL(ttl int) time.Duration {
-	return time.Duration(ttl) * time.Second
-}
+// BuildTruncatedMessage builds msg so that it fits in limit bytes. Optional
+// additional records are dropped first; if that is not enough, authority
+// and answer records are removed and the TC flag is set so the client
+// retries over TCP.
+func BuildTruncatedMessage(msg *Message, limit int) ([]byte, error) {
+	data, err := BuildMessage(msg)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
 
-func (rr *ResourceRecord) GetStringData() (string, error) {
-	switch rr.Type {
-	case TypeA:
-		if len(rr.RData) != 4 {
-			return "", fmt.Errorf("invalid A record data length: %d", len(rr.RData))
+	truncated := *msg
+	truncated.Additional = nil
+	for _, rr := range msg.Additional {
+		if rr.Type == TypeOPT {
+			truncated.Additional = append(truncated.Additional, rr)
 		}
-		return net.IP(rr.RData).String(), nil
+	}
 
-	case TypeAAAA:
-		if len(rr.RData) != 16 {
-			return "", fmt.Errorf("invalid AAAA record data length: %d", len(rr.RData))
-		}
-		return net.IP(rr.RData).String(), nil
-
-	case TypeNS, TypeCNAME, TypePTR:
-		parser := NewParser(rr.RData)
-		name, err := parser.parseName()
-		
-		if err != nil {
-			return "", fmt.Errorf("failed to parse domain name: %w", err)
-		}
-		return name, nil
+	data, err = BuildMessage(&truncated)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
 
-	case TypeMX:
-		if len(rr.RData) < 3 {
-			return "", fmt.Errorf("invalid MX record data length: %d", len(rr.RData))
-		}
-		parser := NewParser(rr.RData[2:])
-		name, err := parser.parseName()
-		
-		if err != nil {
-			return "", fmt.Errorf("failed to parse MX domain: %w", err)
-		}
-		return name, nil
+	truncated.Header.Flags |= FlagTC
+	truncated.Authorities = nil
+	truncated.Answers = append([]ResourceRecord(nil), msg.Answers...)
 
-	case TypeTXT:
-		if len(rr.RData) == 0 {
-			return "", nil
-		}
-		length := int(rr.RData[0])
-		
-		if len(rr.RData) < length+1 {
-			return "", fmt.Errorf("invalid TXT record data")
+	for {
+		data, err = BuildMessage(&truncated)
+		if err != nil || len(data) <= limit || len(truncated.Answers) == 0 {
+			return data, err
 		}
-		return string(rr.RData[1 : length+1]), nil
+		truncated.Answers = truncated.Answers[:len(truncated.Answers)-1]
+	}
+}
+
+func ParseTTL(ttl int) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
+
+func (rr *ResourceRecord) GetStringData() (string, error) {
+	data, err := rr.TypedData()
+	if err != nil {
+		return "", err
+	}
 
+	switch d := data.(type) {
+	case *MXRecord:
+		return d.Exchange, nil
+	case *TXTRecord:
+		return strings.Join(d.Strings, ""), nil
+	case *NSRecord:
+		return d.Host, nil
+	case *CNAMERecord:
+		return d.Target, nil
+	case *PTRRecord:
+		return d.Target, nil
 	default:
-		return "", fmt.Errorf("unsupported record type: %d", rr.Type)
+		return data.String(), nil
 	}
 }
 
+// TypedData returns the record's typed RDATA, decoding RData if the
+// record was not produced by the parser.
+func (rr *ResourceRecord) TypedData() (RecordData, error) {
+	if rr.Data != nil {
+		return rr.Data, nil
+	}
+
+	data, err := UnpackRecordData(rr.Type, rr.RData)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s record: %w", TypeToString(rr.Type), err)
+	}
+	return data, nil
+}
+
 func CreateARecord(name string, ip string, ttl uint32) (ResourceRecord, error) {
 	parsedIP := net.ParseIP(ip)
 	if parsedIP == nil {
@@ -95,6 +124,25 @@ func CreateARecord(name string, ip string, ttl uint32) (ResourceRecord, error) {
 		TTL:      ttl,
 		RDLength: 4,
 		RData:    []byte(ipv4),
+		Data:     &ARecord{IP: ipv4},
+	}, nil
+}
+
+// NewRecord builds a resource record from typed RDATA.
+func NewRecord(name string, rrType uint16, ttl uint32, data RecordData) (ResourceRecord, error) {
+	rdata, err := PackRecordData(data)
+	if err != nil {
+		return ResourceRecord{}, fmt.Errorf("pack %s rdata: %w", TypeToString(rrType), err)
+	}
+
+	return ResourceRecord{
+		Name:     name,
+		Type:     rrType,
+		Class:    ClassIN,
+		TTL:      ttl,
+		RDLength: uint16(len(rdata)),
+		RData:    rdata,
+		Data:     data,
 	}, nil
 }
 
@@ -102,30 +150,32 @@ func CreateResponse(query *Message, answers []ResourceRecord) *Message {
 	response := &Message{
 		Header: Header{
 			ID:    query.Header.ID,
-			Flags: FlagQR | FlagRD | FlagRA,
+			Flags: FlagQR | FlagRD | FlagRA | RCodeNoError,
 		},
 		Questions: query.Questions,
 		Answers:   answers,
 	}
 
-	if len(answers) > 0 {
-		response.Header.Flags |= RCodeNoError
-	} else {
-		response.Header.Flags |= RCodeNXDomain
-	}
-
 	return response
 }
 
-
 func CreateErrorResponse(query *Message, rcode uint16) *Message {
-	return &Message{
+	response := &Message{
 		Header: Header{
 			ID:    query.Header.ID,
 			Flags: FlagQR | (rcode & 0x0F),
 		},
 		Questions: query.Questions,
 	}
+
+	// Extended response codes only fit in an OPT record
+	if rcode > 0x0F {
+		e := NewEDNS(MinUDPPayloadSize)
+		e.ExtendedRCode = uint8(rcode >> 4)
+		response.SetEDNS(e)
+	}
+
+	return response
 }
 
 func DomainToLabels(domain string) []string {
@@ -137,6 +187,49 @@ func LabelsToDomain(labels []string) string {
 	return strings.Join(labels, ".")
 }
 
+// CanonicalName returns name lower-cased and without its trailing dot, the
+// form used to compare names and key maps by them. Only ASCII letters are
+// folded: DNS names compare case-insensitively octet by octet (RFC 4343),
+// not by Unicode rules.
+func CanonicalName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	var lowered []byte
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c >= 'A' && c <= 'Z' {
+			if lowered == nil {
+				lowered = []byte(name)
+			}
+			lowered[i] = lowerASCII(c)
+		}
+	}
+	if lowered == nil {
+		return name
+	}
+	return string(lowered)
+}
+
+// EqualNames reports whether a and b are the same domain name, ignoring
+// ASCII case and a trailing dot.
+func EqualNames(a, b string) bool {
+	a, b = strings.TrimSuffix(a, "."), strings.TrimSuffix(b, ".")
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if lowerASCII(a[i]) != lowerASCII(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
 func EncodeIPv4(ip string) ([]byte, error) {
 	parsed := net.ParseIP(ip)
 	if parsed == nil {
@@ -2,9 +2,42 @@ package protocol
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
 )
 
+const (
+	maxLabelLength   = 63
+	maxNameLength    = 255
+	maxPointerChases = 127
+)
+
+var (
+	ErrTruncatedMessage = errors.New("unexpected end of data")
+	ErrCompressionLoop  = errors.New("compression pointer loop")
+	ErrForwardPointer   = errors.New("forward compression pointer")
+	ErrLabelTooLong     = errors.New("label exceeds 63 bytes")
+	ErrNameTooLong      = errors.New("name exceeds 255 bytes")
+	ErrInvalidRData     = errors.New("invalid record data")
+	ErrTrailingData     = errors.New("trailing data after message")
+)
+
+// ParseError reports malformed wire data and the offset it was found at.
+// Its Err is one of the sentinel errors above.
+type ParseError struct {
+	Offset int
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("malformed message at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 type Parser struct {
 	data   []byte
 	offset int
@@ -31,7 +64,7 @@ func (p *Parser) ParseMessage() (*Message, error) {
 		}
 		msg.Questions = append(msg.Questions, q)
 	}
-	
+
 	for i := 0; i < int(msg.Header.AnswerCount); i++ {
 		rr, err := p.parseResourceRecord()
 		if err != nil {
@@ -39,7 +72,7 @@ func (p *Parser) ParseMessage() (*Message, error) {
 		}
 		msg.Answers = append(msg.Answers, rr)
 	}
-	
+
 	for i := 0; i < int(msg.Header.AuthorityCount); i++ {
 		rr, err := p.parseResourceRecord()
 		if err != nil {
@@ -47,7 +80,7 @@ func (p *Parser) ParseMessage() (*Message, error) {
 		}
 		msg.Authorities = append(msg.Authorities, rr)
 	}
-	
+
 	for i := 0; i < int(msg.Header.AdditionalCount); i++ {
 		rr, err := p.parseResourceRecord()
 		if err != nil {
@@ -55,124 +88,230 @@ func (p *Parser) ParseMessage() (*Message, error) {
 		}
 		msg.Additional = append(msg.Additional, rr)
 	}
-	
+
+	if p.offset != len(p.data) {
+		return nil, p.fail(ErrTrailingData)
+	}
+
 	return msg, nil
 }
 
+func (p *Parser) fail(err error) error {
+	return &ParseError{Offset: p.offset, Err: err}
+}
+
 func (p *Parser) parseHeader(h *Header) error {
 	if len(p.data) < 12 {
-		return fmt.Errorf("message too short: %d bytes", len(p.data))
+		return p.fail(ErrTruncatedMessage)
 	}
-	
+
 	h.ID = binary.BigEndian.Uint16(p.data[0:2])
 	h.Flags = binary.BigEndian.Uint16(p.data[2:4])
 	h.QuestionCount = binary.BigEndian.Uint16(p.data[4:6])
 	h.AnswerCount = binary.BigEndian.Uint16(p.data[6:8])
 	h.AuthorityCount = binary.BigEndian.Uint16(p.data[8:10])
 	h.AdditionalCount = binary.BigEndian.Uint16(p.data[10:12])
-	
+
 	p.offset = 12
 	return nil
 }
 
+// parseName reads a possibly compressed domain name. Compression pointers
+// must point strictly before the start of the labels that led to them, so
+// every jump moves backwards and a chain of pointers always terminates.
+// Labels keep the case they had on the wire; callers compare names with
+// EqualNames rather than relying on them being lower case.
 func (p *Parser) parseName() (string, error) {
-	var name string
-	jumped := false
-	jumpOffset := 0
-	
+	var name strings.Builder
+	wireLength := 1
+	segmentStart := p.offset
+	returnOffset := -1
+	chases := 0
+
 	for {
 		if p.offset >= len(p.data) {
-			return "", fmt.Errorf("unexpected end of data")
+			return "", p.fail(ErrTruncatedMessage)
 		}
-		
-		length := p.data[p.offset]
-		
+
+		length := int(p.data[p.offset])
+
 		if length&0xC0 == 0xC0 {
 			if p.offset+1 >= len(p.data) {
-				return "", fmt.Errorf("invalid compression pointer")
+				return "", p.fail(ErrTruncatedMessage)
+			}
+
+			pointer := int(binary.BigEndian.Uint16(p.data[p.offset:p.offset+2]) & 0x3FFF)
+
+			if pointer >= p.offset {
+				return "", p.fail(ErrForwardPointer)
+			}
+			chases++
+			if pointer >= segmentStart || chases > maxPointerChases {
+				return "", p.fail(ErrCompressionLoop)
 			}
-			
-			pointer := binary.BigEndian.Uint16(p.data[p.offset:p.offset+2]) & 0x3FFF
-			
-			if !jumped {
-				jumpOffset = p.offset + 2
+
+			if returnOffset < 0 {
+				returnOffset = p.offset + 2
 			}
-			
-			p.offset = int(pointer)
-			jumped = true
+
+			p.offset = pointer
+			segmentStart = pointer
 			continue
 		}
-		
+
+		if length > maxLabelLength {
+			return "", p.fail(ErrLabelTooLong)
+		}
+
 		if length == 0 {
 			p.offset++
 			break
 		}
-		
+
+		wireLength += length + 1
+		if wireLength > maxNameLength {
+			return "", p.fail(ErrNameTooLong)
+		}
+
 		p.offset++
-		if p.offset+int(length) > len(p.data) {
-			return "", fmt.Errorf("label length exceeds data")
+		if p.offset+length > len(p.data) {
+			return "", p.fail(ErrTruncatedMessage)
 		}
-		
-		if name != "" {
-			name += "."
+
+		if name.Len() > 0 {
+			name.WriteByte('.')
 		}
-		name += string(p.data[p.offset : p.offset+int(length)])
-		p.offset += int(length)
+		name.Write(p.data[p.offset : p.offset+length])
+		p.offset += length
 	}
-	
-	if jumped {
-		p.offset = jumpOffset
+
+	if returnOffset >= 0 {
+		p.offset = returnOffset
 	}
-	
-	return name, nil
+
+	return name.String(), nil
 }
 
 func (p *Parser) parseQuestion() (Question, error) {
 	var q Question
-	
+
 	name, err := p.parseName()
 	if err != nil {
 		return q, fmt.Errorf("parse name: %w", err)
 	}
 	q.Name = name
-	
+
 	if p.offset+4 > len(p.data) {
-		return q, fmt.Errorf("question too short")
+		return q, p.fail(ErrTruncatedMessage)
 	}
-	
+
 	q.Type = binary.BigEndian.Uint16(p.data[p.offset : p.offset+2])
 	q.Class = binary.BigEndian.Uint16(p.data[p.offset+2 : p.offset+4])
 	p.offset += 4
-	
+
 	return q, nil
 }
 
 func (p *Parser) parseResourceRecord() (ResourceRecord, error) {
 	var rr ResourceRecord
-	
+
 	name, err := p.parseName()
 	if err != nil {
 		return rr, fmt.Errorf("parse name: %w", err)
 	}
 	rr.Name = name
-	
+
 	if p.offset+10 > len(p.data) {
-		return rr, fmt.Errorf("resource record too short")
+		return rr, p.fail(ErrTruncatedMessage)
 	}
-	
+
 	rr.Type = binary.BigEndian.Uint16(p.data[p.offset : p.offset+2])
 	rr.Class = binary.BigEndian.Uint16(p.data[p.offset+2 : p.offset+4])
 	rr.TTL = binary.BigEndian.Uint32(p.data[p.offset+4 : p.offset+8])
 	rr.RDLength = binary.BigEndian.Uint16(p.data[p.offset+8 : p.offset+10])
 	p.offset += 10
-	
+
 	if p.offset+int(rr.RDLength) > len(p.data) {
-		return rr, fmt.Errorf("rdata length exceeds data")
+		return rr, p.fail(ErrTruncatedMessage)
 	}
-	
-	rr.RData = make([]byte, rr.RDLength)
-	copy(rr.RData, p.data[p.offset:p.offset+int(rr.RDLength)])
-	p.offset += int(rr.RDLength)
-	
+
+	rr.Data = NewRecordData(rr.Type)
+	if rr.Data == nil {
+		rr.RData = make([]byte, rr.RDLength)
+		copy(rr.RData, p.data[p.offset:p.offset+int(rr.RDLength)])
+		p.offset += int(rr.RDLength)
+		return rr, nil
+	}
+
+	end := p.offset + int(rr.RDLength)
+	if err := rr.Data.Unpack(p, int(rr.RDLength)); err != nil {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			return rr, fmt.Errorf("unpack %s rdata: %w", TypeToString(rr.Type), err)
+		}
+		return rr, p.fail(fmt.Errorf("%w: %s: %v", ErrInvalidRData, TypeToString(rr.Type), err))
+	}
+	if p.offset != end {
+		return rr, p.fail(fmt.Errorf("%w: %s length mismatch", ErrInvalidRData, TypeToString(rr.Type)))
+	}
+
+	// Keep the uncompressed wire form so RData stays meaningful outside
+	// the message it was parsed from
+	rdata, err := PackRecordData(rr.Data)
+	if err != nil {
+		return rr, p.fail(fmt.Errorf("%w: %s: %v", ErrInvalidRData, TypeToString(rr.Type), err))
+	}
+	rr.RData = rdata
+	rr.RDLength = uint16(len(rdata))
+
 	return rr, nil
-}
\ No newline at end of file
+}
+
+func (p *Parser) readUint8() (uint8, error) {
+	if p.offset+1 > len(p.data) {
+		return 0, p.fail(ErrTruncatedMessage)
+	}
+	v := p.data[p.offset]
+	p.offset++
+	return v, nil
+}
+
+func (p *Parser) readUint16() (uint16, error) {
+	if p.offset+2 > len(p.data) {
+		return 0, p.fail(ErrTruncatedMessage)
+	}
+	v := binary.BigEndian.Uint16(p.data[p.offset : p.offset+2])
+	p.offset += 2
+	return v, nil
+}
+
+func (p *Parser) readUint32() (uint32, error) {
+	if p.offset+4 > len(p.data) {
+		return 0, p.fail(ErrTruncatedMessage)
+	}
+	v := binary.BigEndian.Uint32(p.data[p.offset : p.offset+4])
+	p.offset += 4
+	return v, nil
+}
+
+func (p *Parser) readBytes(n int) ([]byte, error) {
+	if n < 0 || p.offset+n > len(p.data) {
+		return nil, p.fail(ErrTruncatedMessage)
+	}
+	v := make([]byte, n)
+	copy(v, p.data[p.offset:p.offset+n])
+	p.offset += n
+	return v, nil
+}
+
+func (p *Parser) readCharString() (string, error) {
+	length, err := p.readUint8()
+	if err != nil {
+		return "", err
+	}
+	v, err := p.readBytes(int(length))
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
@@ -0,0 +1,818 @@
+package protocol
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var base32HexNoPad = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// RecordData is the typed form of a resource record's RDATA. Pack writes
+// the data into a message being built and Unpack reads length bytes of it
+// from the parser's current offset, so embedded names are resolved
+// against the whole message.
+type RecordData interface {
+	Pack(b *Builder) error
+	Unpack(p *Parser, length int) error
+	String() string
+}
+
+// NewRecordData returns an empty typed RDATA value for rrType, or nil if
+// the type has no typed representation.
+func NewRecordData(rrType uint16) RecordData {
+	switch rrType {
+	case TypeA:
+		return &ARecord{}
+	case TypeAAAA:
+		return &AAAARecord{}
+	case TypeNS:
+		return &NSRecord{}
+	case TypeCNAME:
+		return &CNAMERecord{}
+	case TypePTR:
+		return &PTRRecord{}
+	case TypeMX:
+		return &MXRecord{}
+	case TypeTXT:
+		return &TXTRecord{}
+	case TypeSOA:
+		return &SOARecord{}
+	case TypeSRV:
+		return &SRVRecord{}
+	case TypeCAA:
+		return &CAARecord{}
+	case TypeNAPTR:
+		return &NAPTRRecord{}
+	case TypeDS:
+		return &DSRecord{}
+	case TypeDNSKEY:
+		return &DNSKEYRecord{}
+	case TypeRRSIG:
+		return &RRSIGRecord{}
+	case TypeNSEC:
+		return &NSECRecord{}
+	case TypeNSEC3:
+		return &NSEC3Record{}
+	case TypeSVCB, TypeHTTPS:
+		return &SVCBRecord{}
+	case TypeOPT:
+		return &OPTRecord{}
+	default:
+		return nil
+	}
+}
+
+// PackRecordData returns the uncompressed wire form of data.
+func PackRecordData(data RecordData) ([]byte, error) {
+	builder := NewBuilder()
+	builder.SetCompression(false)
+	if err := data.Pack(builder); err != nil {
+		return nil, err
+	}
+	return builder.data, nil
+}
+
+// UnpackRecordData decodes standalone, uncompressed RDATA of type rrType.
+func UnpackRecordData(rrType uint16, rdata []byte) (RecordData, error) {
+	data := NewRecordData(rrType)
+	if data == nil {
+		return nil, fmt.Errorf("unsupported record type: %d", rrType)
+	}
+
+	parser := NewParser(rdata)
+	if err := data.Unpack(parser, len(rdata)); err != nil {
+		return nil, err
+	}
+	if parser.offset != len(rdata) {
+		return nil, fmt.Errorf("%s rdata length mismatch", TypeToString(rrType))
+	}
+
+	return data, nil
+}
+
+type ARecord struct {
+	IP net.IP
+}
+
+func (r *ARecord) Pack(b *Builder) error {
+	ip := r.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("not an IPv4 address: %v", r.IP)
+	}
+	b.writeBytes(ip)
+	return nil
+}
+
+func (r *ARecord) Unpack(p *Parser, length int) error {
+	if length != 4 {
+		return fmt.Errorf("invalid A record data length: %d", length)
+	}
+	ip, err := p.readBytes(4)
+	if err != nil {
+		return err
+	}
+	r.IP = net.IP(ip)
+	return nil
+}
+
+func (r *ARecord) String() string {
+	return r.IP.String()
+}
+
+type AAAARecord struct {
+	IP net.IP
+}
+
+func (r *AAAARecord) Pack(b *Builder) error {
+	ip := r.IP.To16()
+	if ip == nil {
+		return fmt.Errorf("invalid IPv6 address: %v", r.IP)
+	}
+	b.writeBytes(ip)
+	return nil
+}
+
+func (r *AAAARecord) Unpack(p *Parser, length int) error {
+	if length != 16 {
+		return fmt.Errorf("invalid AAAA record data length: %d", length)
+	}
+	ip, err := p.readBytes(16)
+	if err != nil {
+		return err
+	}
+	r.IP = net.IP(ip)
+	return nil
+}
+
+func (r *AAAARecord) String() string {
+	return r.IP.String()
+}
+
+type NSRecord struct {
+	Host string
+}
+
+func (r *NSRecord) Pack(b *Builder) error {
+	b.buildCompressedName(r.Host)
+	return nil
+}
+
+func (r *NSRecord) Unpack(p *Parser, length int) (err error) {
+	r.Host, err = p.parseName()
+	return err
+}
+
+func (r *NSRecord) String() string {
+	return fqdn(r.Host)
+}
+
+type CNAMERecord struct {
+	Target string
+}
+
+func (r *CNAMERecord) Pack(b *Builder) error {
+	b.buildCompressedName(r.Target)
+	return nil
+}
+
+func (r *CNAMERecord) Unpack(p *Parser, length int) (err error) {
+	r.Target, err = p.parseName()
+	return err
+}
+
+func (r *CNAMERecord) String() string {
+	return fqdn(r.Target)
+}
+
+type PTRRecord struct {
+	Target string
+}
+
+func (r *PTRRecord) Pack(b *Builder) error {
+	b.buildCompressedName(r.Target)
+	return nil
+}
+
+func (r *PTRRecord) Unpack(p *Parser, length int) (err error) {
+	r.Target, err = p.parseName()
+	return err
+}
+
+func (r *PTRRecord) String() string {
+	return fqdn(r.Target)
+}
+
+type MXRecord struct {
+	Preference uint16
+	Exchange   string
+}
+
+func (r *MXRecord) Pack(b *Builder) error {
+	b.writeUint16(r.Preference)
+	b.buildCompressedName(r.Exchange)
+	return nil
+}
+
+func (r *MXRecord) Unpack(p *Parser, length int) (err error) {
+	if r.Preference, err = p.readUint16(); err != nil {
+		return err
+	}
+	r.Exchange, err = p.parseName()
+	return err
+}
+
+func (r *MXRecord) String() string {
+	return fmt.Sprintf("%d %s", r.Preference, fqdn(r.Exchange))
+}
+
+type TXTRecord struct {
+	Strings []string
+}
+
+func (r *TXTRecord) Pack(b *Builder) error {
+	if len(r.Strings) == 0 {
+		return b.writeCharString("")
+	}
+	for _, s := range r.Strings {
+		if err := b.writeCharString(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *TXTRecord) Unpack(p *Parser, length int) error {
+	end := p.offset + length
+	r.Strings = nil
+	for p.offset < end {
+		s, err := p.readCharString()
+		if err != nil {
+			return err
+		}
+		r.Strings = append(r.Strings, s)
+	}
+	return nil
+}
+
+func (r *TXTRecord) String() string {
+	quoted := make([]string, len(r.Strings))
+	for i, s := range r.Strings {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+type SOARecord struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func (r *SOARecord) Pack(b *Builder) error {
+	b.buildCompressedName(r.MName)
+	b.buildCompressedName(r.RName)
+	b.writeUint32(r.Serial)
+	b.writeUint32(r.Refresh)
+	b.writeUint32(r.Retry)
+	b.writeUint32(r.Expire)
+	b.writeUint32(r.Minimum)
+	return nil
+}
+
+func (r *SOARecord) Unpack(p *Parser, length int) (err error) {
+	if r.MName, err = p.parseName(); err != nil {
+		return err
+	}
+	if r.RName, err = p.parseName(); err != nil {
+		return err
+	}
+	for _, field := range []*uint32{&r.Serial, &r.Refresh, &r.Retry, &r.Expire, &r.Minimum} {
+		if *field, err = p.readUint32(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SOARecord) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(r.MName), fqdn(r.RName),
+		r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+}
+
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func (r *SRVRecord) Pack(b *Builder) error {
+	b.writeUint16(r.Priority)
+	b.writeUint16(r.Weight)
+	b.writeUint16(r.Port)
+	b.buildName(r.Target)
+	return nil
+}
+
+func (r *SRVRecord) Unpack(p *Parser, length int) (err error) {
+	for _, field := range []*uint16{&r.Priority, &r.Weight, &r.Port} {
+		if *field, err = p.readUint16(); err != nil {
+			return err
+		}
+	}
+	r.Target, err = p.parseName()
+	return err
+}
+
+func (r *SRVRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, fqdn(r.Target))
+}
+
+type CAARecord struct {
+	Flags uint8
+	Tag   string
+	Value string
+}
+
+func (r *CAARecord) Pack(b *Builder) error {
+	if r.Tag == "" {
+		return fmt.Errorf("empty CAA tag")
+	}
+	b.writeUint8(r.Flags)
+	if err := b.writeCharString(r.Tag); err != nil {
+		return err
+	}
+	b.writeBytes([]byte(r.Value))
+	return nil
+}
+
+func (r *CAARecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.Flags, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.Tag, err = p.readCharString(); err != nil {
+		return err
+	}
+	value, err := p.readBytes(end - p.offset)
+	if err != nil {
+		return err
+	}
+	r.Value = string(value)
+	return nil
+}
+
+func (r *CAARecord) String() string {
+	return fmt.Sprintf("%d %s %s", r.Flags, r.Tag, strconv.Quote(r.Value))
+}
+
+type NAPTRRecord struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+func (r *NAPTRRecord) Pack(b *Builder) error {
+	b.writeUint16(r.Order)
+	b.writeUint16(r.Preference)
+	for _, s := range []string{r.Flags, r.Services, r.Regexp} {
+		if err := b.writeCharString(s); err != nil {
+			return err
+		}
+	}
+	b.buildName(r.Replacement)
+	return nil
+}
+
+func (r *NAPTRRecord) Unpack(p *Parser, length int) (err error) {
+	if r.Order, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.Preference, err = p.readUint16(); err != nil {
+		return err
+	}
+	for _, field := range []*string{&r.Flags, &r.Services, &r.Regexp} {
+		if *field, err = p.readCharString(); err != nil {
+			return err
+		}
+	}
+	r.Replacement, err = p.parseName()
+	return err
+}
+
+func (r *NAPTRRecord) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", r.Order, r.Preference,
+		strconv.Quote(r.Flags), strconv.Quote(r.Services), strconv.Quote(r.Regexp), fqdn(r.Replacement))
+}
+
+type DSRecord struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+func (r *DSRecord) Pack(b *Builder) error {
+	b.writeUint16(r.KeyTag)
+	b.writeUint8(r.Algorithm)
+	b.writeUint8(r.DigestType)
+	b.writeBytes(r.Digest)
+	return nil
+}
+
+func (r *DSRecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.KeyTag, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.Algorithm, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.DigestType, err = p.readUint8(); err != nil {
+		return err
+	}
+	r.Digest, err = p.readBytes(end - p.offset)
+	return err
+}
+
+func (r *DSRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.KeyTag, r.Algorithm, r.DigestType,
+		strings.ToUpper(hex.EncodeToString(r.Digest)))
+}
+
+type DNSKEYRecord struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+func (r *DNSKEYRecord) Pack(b *Builder) error {
+	b.writeUint16(r.Flags)
+	b.writeUint8(r.Protocol)
+	b.writeUint8(r.Algorithm)
+	b.writeBytes(r.PublicKey)
+	return nil
+}
+
+func (r *DNSKEYRecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.Flags, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.Protocol, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.Algorithm, err = p.readUint8(); err != nil {
+		return err
+	}
+	r.PublicKey, err = p.readBytes(end - p.offset)
+	return err
+}
+
+func (r *DNSKEYRecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", r.Flags, r.Protocol, r.Algorithm,
+		base64.StdEncoding.EncodeToString(r.PublicKey))
+}
+
+type RRSIGRecord struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+func (r *RRSIGRecord) Pack(b *Builder) error {
+	b.writeUint16(r.TypeCovered)
+	b.writeUint8(r.Algorithm)
+	b.writeUint8(r.Labels)
+	b.writeUint32(r.OriginalTTL)
+	b.writeUint32(r.Expiration)
+	b.writeUint32(r.Inception)
+	b.writeUint16(r.KeyTag)
+	b.buildName(r.SignerName)
+	b.writeBytes(r.Signature)
+	return nil
+}
+
+func (r *RRSIGRecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.TypeCovered, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.Algorithm, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.Labels, err = p.readUint8(); err != nil {
+		return err
+	}
+	for _, field := range []*uint32{&r.OriginalTTL, &r.Expiration, &r.Inception} {
+		if *field, err = p.readUint32(); err != nil {
+			return err
+		}
+	}
+	if r.KeyTag, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.SignerName, err = p.parseName(); err != nil {
+		return err
+	}
+	r.Signature, err = p.readBytes(end - p.offset)
+	return err
+}
+
+func (r *RRSIGRecord) String() string {
+	return fmt.Sprintf("%s %d %d %d %d %d %d %s %s", TypeToString(r.TypeCovered),
+		r.Algorithm, r.Labels, r.OriginalTTL, r.Expiration, r.Inception, r.KeyTag,
+		fqdn(r.SignerName), base64.StdEncoding.EncodeToString(r.Signature))
+}
+
+type NSECRecord struct {
+	NextDomain string
+	Types      []uint16
+}
+
+func (r *NSECRecord) Pack(b *Builder) error {
+	b.buildName(r.NextDomain)
+	b.writeTypeBitMap(r.Types)
+	return nil
+}
+
+func (r *NSECRecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.NextDomain, err = p.parseName(); err != nil {
+		return err
+	}
+	r.Types, err = p.readTypeBitMap(end)
+	return err
+}
+
+func (r *NSECRecord) String() string {
+	return fqdn(r.NextDomain) + typeListString(r.Types)
+}
+
+type NSEC3Record struct {
+	HashAlgorithm uint8
+	Flags         uint8
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	Types         []uint16
+}
+
+func (r *NSEC3Record) Pack(b *Builder) error {
+	if len(r.Salt) > 255 || len(r.NextHashed) > 255 {
+		return fmt.Errorf("NSEC3 salt or hash too long")
+	}
+	b.writeUint8(r.HashAlgorithm)
+	b.writeUint8(r.Flags)
+	b.writeUint16(r.Iterations)
+	b.writeUint8(uint8(len(r.Salt)))
+	b.writeBytes(r.Salt)
+	b.writeUint8(uint8(len(r.NextHashed)))
+	b.writeBytes(r.NextHashed)
+	b.writeTypeBitMap(r.Types)
+	return nil
+}
+
+func (r *NSEC3Record) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.HashAlgorithm, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.Flags, err = p.readUint8(); err != nil {
+		return err
+	}
+	if r.Iterations, err = p.readUint16(); err != nil {
+		return err
+	}
+	saltLength, err := p.readUint8()
+	if err != nil {
+		return err
+	}
+	if r.Salt, err = p.readBytes(int(saltLength)); err != nil {
+		return err
+	}
+	hashLength, err := p.readUint8()
+	if err != nil {
+		return err
+	}
+	if r.NextHashed, err = p.readBytes(int(hashLength)); err != nil {
+		return err
+	}
+	r.Types, err = p.readTypeBitMap(end)
+	return err
+}
+
+func (r *NSEC3Record) String() string {
+	salt := "-"
+	if len(r.Salt) > 0 {
+		salt = strings.ToUpper(hex.EncodeToString(r.Salt))
+	}
+	return fmt.Sprintf("%d %d %d %s %s%s", r.HashAlgorithm, r.Flags, r.Iterations, salt,
+		base32HexNoPad.EncodeToString(r.NextHashed), typeListString(r.Types))
+}
+
+// SVCParam is a single key=value service parameter of an SVCB or HTTPS
+// record. Values are kept in wire form.
+type SVCParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// SVCBRecord is the RDATA of both SVCB and HTTPS records.
+type SVCBRecord struct {
+	Priority uint16
+	Target   string
+	Params   []SVCParam
+}
+
+func (r *SVCBRecord) Pack(b *Builder) error {
+	b.writeUint16(r.Priority)
+	b.buildName(r.Target)
+	for _, param := range r.Params {
+		if len(param.Value) > 0xFFFF {
+			return fmt.Errorf("SVCB parameter %d too long", param.Key)
+		}
+		b.writeUint16(param.Key)
+		b.writeUint16(uint16(len(param.Value)))
+		b.writeBytes(param.Value)
+	}
+	return nil
+}
+
+func (r *SVCBRecord) Unpack(p *Parser, length int) (err error) {
+	end := p.offset + length
+	if r.Priority, err = p.readUint16(); err != nil {
+		return err
+	}
+	if r.Target, err = p.parseName(); err != nil {
+		return err
+	}
+	r.Params = nil
+	for p.offset < end {
+		var param SVCParam
+		if param.Key, err = p.readUint16(); err != nil {
+			return err
+		}
+		valueLength, err := p.readUint16()
+		if err != nil {
+			return err
+		}
+		if param.Value, err = p.readBytes(int(valueLength)); err != nil {
+			return err
+		}
+		r.Params = append(r.Params, param)
+	}
+	return nil
+}
+
+func (r *SVCBRecord) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d %s", r.Priority, fqdn(r.Target))
+	for _, param := range r.Params {
+		fmt.Fprintf(&sb, " key%d=%s", param.Key, hex.EncodeToString(param.Value))
+	}
+	return sb.String()
+}
+
+// EDNSOption is a single option carried in the RDATA of an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+type OPTRecord struct {
+	Options []EDNSOption
+}
+
+func (r *OPTRecord) Pack(b *Builder) error {
+	for _, option := range r.Options {
+		if len(option.Data) > 0xFFFF {
+			return fmt.Errorf("EDNS option %d too long", option.Code)
+		}
+		b.writeUint16(option.Code)
+		b.writeUint16(uint16(len(option.Data)))
+		b.writeBytes(option.Data)
+	}
+	return nil
+}
+
+func (r *OPTRecord) Unpack(p *Parser, length int) error {
+	end := p.offset + length
+	r.Options = nil
+	for p.offset < end {
+		code, err := p.readUint16()
+		if err != nil {
+			return err
+		}
+		optionLength, err := p.readUint16()
+		if err != nil {
+			return err
+		}
+		data, err := p.readBytes(int(optionLength))
+		if err != nil {
+			return err
+		}
+		r.Options = append(r.Options, EDNSOption{Code: code, Data: data})
+	}
+	return nil
+}
+
+func (r *OPTRecord) String() string {
+	parts := make([]string, len(r.Options))
+	for i, option := range r.Options {
+		parts[i] = fmt.Sprintf("%d:%s", option.Code, hex.EncodeToString(option.Data))
+	}
+	return strings.Join(parts, " ")
+}
+
+// writeTypeBitMap encodes types in the windowed bitmap format shared by
+// NSEC and NSEC3 (RFC 4034 section 4.1.2).
+func (b *Builder) writeTypeBitMap(types []uint16) {
+	sorted := append([]uint16(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bitmap [32]byte
+		length := 0
+
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := sorted[i] & 0xFF
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+
+		b.writeUint8(uint8(window))
+		b.writeUint8(uint8(length))
+		b.writeBytes(bitmap[:length])
+	}
+}
+
+func (p *Parser) readTypeBitMap(end int) ([]uint16, error) {
+	var types []uint16
+	for p.offset < end {
+		window, err := p.readUint8()
+		if err != nil {
+			return nil, err
+		}
+		length, err := p.readUint8()
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 || length > 32 {
+			return nil, fmt.Errorf("invalid type bitmap length: %d", length)
+		}
+		bitmap, err := p.readBytes(int(length))
+		if err != nil {
+			return nil, err
+		}
+		for i, octet := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, uint16(window)<<8|uint16(i*8+bit))
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+func typeListString(types []uint16) string {
+	var sb strings.Builder
+	for _, t := range types {
+		name := TypeToString(t)
+		if name == "UNKNOWN" {
+			name = fmt.Sprintf("TYPE%d", t)
+		}
+		sb.WriteString(" ")
+		sb.WriteString(name)
+	}
+	return sb.String()
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -1,31 +1,48 @@
 package protocol
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
 	// Query Types
-	TypeA     = 1   // IPv4 address
-	TypeNS    = 2   // Name server
-	TypeCNAME = 5   // Canonical name
-	TypeSOA   = 6   // Start of authority
-	TypePTR   = 12  // Domain name pointer
-	TypeMX    = 15  // Mail exchange
-	TypeTXT   = 16  // Text strings
-	TypeAAAA  = 28  // IPv6 address
-	TypeSRV   = 33  // Service locator
-	
+	TypeA      = 1   // IPv4 address
+	TypeNS     = 2   // Name server
+	TypeCNAME  = 5   // Canonical name
+	TypeSOA    = 6   // Start of authority
+	TypePTR    = 12  // Domain name pointer
+	TypeMX     = 15  // Mail exchange
+	TypeTXT    = 16  // Text strings
+	TypeAAAA   = 28  // IPv6 address
+	TypeSRV    = 33  // Service locator
+	TypeNAPTR  = 35  // Naming authority pointer
+	TypeOPT    = 41  // EDNS(0) pseudo-record
+	TypeDS     = 43  // Delegation signer
+	TypeRRSIG  = 46  // DNSSEC signature
+	TypeNSEC   = 47  // Next secure
+	TypeDNSKEY = 48  // DNSSEC public key
+	TypeNSEC3  = 50  // Hashed next secure
+	TypeSVCB   = 64  // Service binding
+	TypeHTTPS  = 65  // HTTPS service binding
+	TypeANY    = 255 // Any type (queries only)
+	TypeCAA    = 257 // Certification authority authorization
+
 	// Classes
-	ClassIN = 1  // Internet
-	ClassCS = 2  // CSNET (obsolete)
-	ClassCH = 3  // CHAOS
-	ClassHS = 4  // Hesiod
-	
+	ClassIN = 1 // Internet
+	ClassCS = 2 // CSNET (obsolete)
+	ClassCH = 3 // CHAOS
+	ClassHS = 4 // Hesiod
+
 	// Response Codes (RCODE)
-	RCodeNoError  = 0 // No error
-	RCodeFormErr  = 1 // Format error
-	RCodeServFail = 2 // Server failure
-	RCodeNXDomain = 3 // Non-existent domain
-	RCodeNotImpl  = 4 // Not implemented
-	RCodeRefused  = 5 // Query refused
-	
+	RCodeNoError  = 0  // No error
+	RCodeFormErr  = 1  // Format error
+	RCodeServFail = 2  // Server failure
+	RCodeNXDomain = 3  // Non-existent domain
+	RCodeNotImpl  = 4  // Not implemented
+	RCodeRefused  = 5  // Query refused
+	RCodeBadVers  = 16 // Bad EDNS version (extended RCODE)
+
 	// Header Flags
 	FlagQR = 1 << 15 // Query (0) / Response (1)
 	FlagAA = 1 << 10 // Authoritative Answer
@@ -36,7 +53,7 @@ const (
 	FlagAD = 1 << 5  // Authenticated Data
 	FlagCD = 1 << 4  // Checking Disabled
 
-    // OpCode values (bits 11-14 of flags)
+	// OpCode values (bits 11-14 of flags)
 	OpCodeQuery  = 0 // Standard query
 	OpCodeIQuery = 1 // Inverse query (obsolete)
 	OpCodeStatus = 2 // Server status request
@@ -63,11 +80,65 @@ func TypeToString(t uint16) string {
 		return "AAAA"
 	case TypeSRV:
 		return "SRV"
+	case TypeNAPTR:
+		return "NAPTR"
+	case TypeOPT:
+		return "OPT"
+	case TypeDS:
+		return "DS"
+	case TypeRRSIG:
+		return "RRSIG"
+	case TypeNSEC:
+		return "NSEC"
+	case TypeDNSKEY:
+		return "DNSKEY"
+	case TypeNSEC3:
+		return "NSEC3"
+	case TypeSVCB:
+		return "SVCB"
+	case TypeHTTPS:
+		return "HTTPS"
+	case TypeANY:
+		return "ANY"
+	case TypeCAA:
+		return "CAA"
 	default:
 		return "UNKNOWN"
 	}
 }
 
+// String -> type, accepting the RFC 3597 TYPEnnn form
+func StringToType(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for _, t := range []uint16{
+		TypeA, TypeNS, TypeCNAME, TypeSOA, TypePTR, TypeMX, TypeTXT, TypeAAAA, TypeSRV,
+		TypeNAPTR, TypeOPT, TypeDS, TypeRRSIG, TypeNSEC, TypeDNSKEY, TypeNSEC3,
+		TypeSVCB, TypeHTTPS, TypeCAA,
+	} {
+		if TypeToString(t) == s {
+			return t, true
+		}
+	}
+
+	if n, found := strings.CutPrefix(s, "TYPE"); found {
+		if t, err := strconv.ParseUint(n, 10, 16); err == nil {
+			return uint16(t), true
+		}
+	}
+	return 0, false
+}
+
+// String -> class
+func StringToClass(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	for _, c := range []uint16{ClassIN, ClassCS, ClassCH, ClassHS} {
+		if ClassToString(c) == s {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
 // Class -> string
 func ClassToString(c uint16) string {
 	switch c {
@@ -99,7 +170,9 @@ func RCodeToString(rcode uint16) string {
 		return "NOTIMPL"
 	case RCodeRefused:
 		return "REFUSED"
+	case RCodeBadVers:
+		return "BADVERS"
 	default:
 		return "UNKNOWN"
 	}
-}
\ No newline at end of file
+}
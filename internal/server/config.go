@@ -1,21 +1,38 @@
 package server
 
 import (
+	"DNS-server/data"
+	"DNS-server/internal/protocol"
+	"DNS-server/pkg/dnssec"
+	"DNS-server/pkg/resolver"
 	"fmt"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	// Server settings
-	UDPPort int
-	TCPPort int
-	Host    string
+	UDPPort   int
+	TCPPort   int
+	TLSPort   int
+	HTTPSPort int
+	Host      string
+
+	// Certificate for DNS over TLS and HTTPS, reloaded when either file
+	// changes
+	TLSCertFile string
+	TLSKeyFile  string
 
 	// Timeouts
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
 
+	// Resolution budget: QueryTimeout bounds everything one query may
+	// cost upstream, HopTimeout each exchange with a single server
+	QueryTimeout time.Duration
+	HopTimeout   time.Duration
+
 	// Limits
 	MaxConnections int
 	MaxUDPSize     int
@@ -23,30 +40,101 @@ type Config struct {
 	// Features
 	EnableUDP       bool
 	EnableTCP       bool
+	EnableTLS       bool
+	EnableHTTPS     bool
 	EnableRecursion bool
 	EnableCaching   bool
 
 	// Cache settings
-	CacheMaxEntries     int
-	CacheTTL            time.Duration
+	CacheMaxEntries      int
+	CacheTTL             time.Duration
 	CacheCleanupInterval time.Duration
+	NegativeCacheMaxTTL  time.Duration
+
+	// Serve-stale (RFC 8767): keep expired answers for ServeStaleWindow and
+	// serve them with ServeStaleTTL when resolution fails or takes longer
+	// than ServeStaleClientTimeout. Once resolution has failed, stale
+	// answers are served without trying again for ServeStaleRecheckInterval.
+	// A zero window disables it.
+	ServeStaleWindow          time.Duration
+	ServeStaleTTL             time.Duration
+	ServeStaleClientTimeout   time.Duration
+	ServeStaleRecheckInterval time.Duration
+
+	// Prefetch: entries hit at least PrefetchMinHits times are refreshed in
+	// the background once a hit lands in the last PrefetchPercent of their
+	// TTL, with at most MaxConcurrentPrefetches running. Zero disables it.
+	PrefetchPercent         int
+	PrefetchMinHits         int64
+	MaxConcurrentPrefetches int
+
+	// Queries allowed to wait on one identical in-flight resolution before
+	// further ones get SERVFAIL; zero is no limit
+	MaxCoalescedWaiters int
+
+	// QNAME minimisation for iterative resolution: "off", "relaxed" or
+	// "strict"
+	QNAMEMinimisation string
+
+	// Protocol for iterative queries to authoritative servers: "udp",
+	// "tcp", or "tls" to use DNS over TLS with servers that offer it
+	IterativeProtocol string
+
+	// DNSSEC validation of iteratively resolved answers, starting from
+	// TrustAnchors: DS records for the root zone in presentation format
+	DNSSEC       bool
+	TrustAnchors []string
+
+	// Forwarding: when set, recursive queries go to these upstream
+	// resolvers instead of being resolved iteratively. Each is "ip",
+	// "ip:port" or a URL picking its protocol: udp://, tcp://, tls:// or
+	// https:// (see resolver.ParseEndpoint).
+	Forwarders          []string
+	ForwardStrategy     string
+	HealthCheckInterval time.Duration
+
+	// Conditional forwarding: queries under a rule's suffix go to its
+	// servers, the longest matching suffix winning
+	ForwardRules []ForwardRule
+
+	// Authoritative zones
+	Zones []ZoneConfig
+}
+
+// ZoneConfig points at an RFC 1035 master file served authoritatively.
+// Use "." as the origin of a root zone.
+type ZoneConfig struct {
+	Origin string
+	File   string
+}
+
+// ForwardRule sends queries for Suffix and its subdomains to Servers. A
+// zero Timeout uses HopTimeout.
+type ForwardRule struct {
+	Suffix  string
+	Servers []string
+	Timeout time.Duration
 }
 
 func DefaultConfig() *Config {
 	return &Config{
 		// Server settings
-		UDPPort: 53,
-		TCPPort: 53,
-		Host:    "0.0.0.0",
+		UDPPort:   53,
+		TCPPort:   53,
+		TLSPort:   853,
+		HTTPSPort: 443,
+		Host:      "0.0.0.0",
 
 		// Timeouts
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		IdleTimeout:  30 * time.Second,
+		QueryTimeout: 10 * time.Second,
+		HopTimeout:   5 * time.Second,
 
 		// Limits
 		MaxConnections: 100,
-		MaxUDPSize:     512,
+		MaxUDPSize:     protocol.DefaultEDNSPayloadSize,
 
 		// Features
 		EnableUDP:       true,
@@ -58,6 +146,32 @@ func DefaultConfig() *Config {
 		CacheMaxEntries:      1000,
 		CacheTTL:             5 * time.Minute,
 		CacheCleanupInterval: 1 * time.Minute,
+		NegativeCacheMaxTTL:  3 * time.Hour,
+
+		// Serve-stale
+		ServeStaleWindow:          24 * time.Hour,
+		ServeStaleTTL:             30 * time.Second,
+		ServeStaleClientTimeout:   1800 * time.Millisecond,
+		ServeStaleRecheckInterval: 30 * time.Second,
+
+		// Prefetch
+		PrefetchPercent:         10,
+		PrefetchMinHits:         3,
+		MaxConcurrentPrefetches: 10,
+
+		// Coalescing
+		MaxCoalescedWaiters: 100,
+
+		QNAMEMinimisation: resolver.MinimiseRelaxed,
+		IterativeProtocol: resolver.ProtocolUDP,
+
+		// DNSSEC
+		DNSSEC:       true,
+		TrustAnchors: data.RootTrustAnchors,
+
+		// Forwarding
+		ForwardStrategy:     resolver.StrategyRoundRobin,
+		HealthCheckInterval: 30 * time.Second,
 	}
 }
 
@@ -70,18 +184,115 @@ func (c *Config) Validate() error {
 		return &ConfigError{"invalid TCP port"}
 	}
 
-	if !c.EnableUDP && !c.EnableTCP {
-		return &ConfigError{"at least one transport (UDP or TCP) must be enabled"}
+	if c.TLSPort < 0 || c.TLSPort > 65535 {
+		return &ConfigError{"invalid TLS port"}
+	}
+
+	if c.HTTPSPort < 0 || c.HTTPSPort > 65535 {
+		return &ConfigError{"invalid HTTPS port"}
+	}
+
+	if !c.EnableUDP && !c.EnableTCP && !c.EnableTLS && !c.EnableHTTPS {
+		return &ConfigError{"at least one transport (UDP, TCP, TLS or HTTPS) must be enabled"}
 	}
 
-	if c.MaxUDPSize < 512 {
-		return &ConfigError{"max UDP size must be at least 512 bytes"}
+	if (c.EnableTLS || c.EnableHTTPS) && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return &ConfigError{"TLS and HTTPS need both a certificate and a key file"}
+	}
+
+	if c.MaxUDPSize < protocol.MinUDPPayloadSize || c.MaxUDPSize > 65535 {
+		return &ConfigError{"max UDP size must be between 512 and 65535 bytes"}
 	}
 
 	if c.MaxConnections < 1 {
 		return &ConfigError{"max connections must be at least 1"}
 	}
 
+	if c.QueryTimeout <= 0 || c.HopTimeout <= 0 {
+		return &ConfigError{"query and hop timeouts must be positive"}
+	}
+
+	if c.NegativeCacheMaxTTL < 0 {
+		return &ConfigError{"negative cache TTL cannot be negative"}
+	}
+
+	if c.ServeStaleWindow < 0 || c.ServeStaleTTL < 0 || c.ServeStaleClientTimeout < 0 || c.ServeStaleRecheckInterval < 0 {
+		return &ConfigError{"serve-stale durations cannot be negative"}
+	}
+
+	if c.PrefetchPercent < 0 || c.PrefetchPercent > 100 {
+		return &ConfigError{"prefetch percent must be between 0 and 100"}
+	}
+
+	if c.PrefetchPercent > 0 && c.MaxConcurrentPrefetches < 1 {
+		return &ConfigError{"max concurrent prefetches must be at least 1"}
+	}
+
+	if c.MaxCoalescedWaiters < 0 {
+		return &ConfigError{"max coalesced waiters cannot be negative"}
+	}
+
+	switch c.QNAMEMinimisation {
+	case resolver.MinimiseOff, resolver.MinimiseRelaxed, resolver.MinimiseStrict:
+	default:
+		return &ConfigError{"QNAME minimisation must be off, relaxed or strict"}
+	}
+
+	switch c.IterativeProtocol {
+	case resolver.ProtocolUDP, resolver.ProtocolTCP, resolver.ProtocolTLS:
+	default:
+		return &ConfigError{"iterative protocol must be udp, tcp or tls"}
+	}
+
+	if c.DNSSEC {
+		if len(c.TrustAnchors) == 0 {
+			return &ConfigError{"DNSSEC validation needs at least one trust anchor"}
+		}
+		for _, anchor := range c.TrustAnchors {
+			if _, err := dnssec.ParseDS(anchor); err != nil {
+				return &ConfigError{fmt.Sprintf("invalid trust anchor %q: %v", anchor, err)}
+			}
+		}
+	}
+
+	switch c.ForwardStrategy {
+	case resolver.StrategyRoundRobin, resolver.StrategyRandom, resolver.StrategyFastest:
+	default:
+		return &ConfigError{"forward strategy must be round-robin, random or fastest"}
+	}
+
+	for _, addr := range c.Forwarders {
+		if _, err := resolver.ParseEndpoint(addr); err != nil {
+			return &ConfigError{fmt.Sprintf("forwarder %q: %v", addr, err)}
+		}
+	}
+
+	suffixes := make(map[string]bool)
+	for _, rule := range c.ForwardRules {
+		if rule.Suffix == "" || len(rule.Servers) == 0 {
+			return &ConfigError{"forward rules need a suffix and at least one server"}
+		}
+		if rule.Timeout < 0 {
+			return &ConfigError{"forward rule timeout cannot be negative"}
+		}
+		for _, addr := range rule.Servers {
+			if _, err := resolver.ParseEndpoint(addr); err != nil {
+				return &ConfigError{fmt.Sprintf("forward rule server %q: %v", addr, err)}
+			}
+		}
+		suffix := strings.ToLower(strings.TrimSuffix(rule.Suffix, "."))
+		if suffixes[suffix] {
+			return &ConfigError{"duplicate forward rule for " + rule.Suffix}
+		}
+		suffixes[suffix] = true
+	}
+
+	for _, z := range c.Zones {
+		if z.Origin == "" || z.File == "" {
+			return &ConfigError{"zones need both an origin and a file"}
+		}
+	}
+
 	return nil
 }
 
@@ -101,6 +312,14 @@ func (c *Config) GetTCPAddress() string {
 	return formatAddress(c.Host, c.TCPPort)
 }
 
+func (c *Config) GetTLSAddress() string {
+	return formatAddress(c.Host, c.TLSPort)
+}
+
+func (c *Config) GetHTTPSAddress() string {
+	return formatAddress(c.Host, c.HTTPSPort)
+}
+
 func formatAddress(host string, port int) string {
 	if host == "" {
 		host = "0.0.0.0"
@@ -4,27 +4,53 @@ import (
 	"DNS-server/internal/protocol"
 	"DNS-server/models"
 	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/zone"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 )
 
 type Handler struct {
 	resolver *resolver.Resolver
+	zones    *zone.Store
 	config   *Config
 }
 
-func NewHandler(config *Config) *Handler {
+func NewHandler(config *Config, zones *zone.Store, res *resolver.Resolver) *Handler {
+	if zones == nil {
+		zones = zone.NewStore()
+	}
+	if res == nil {
+		res = resolver.GetInstance()
+	}
+
 	return &Handler{
-		resolver: resolver.GetInstance(),
+		resolver: res,
+		zones:    zones,
 		config:   config,
 	}
 }
 
-func (h *Handler) HandleRequest(data []byte) ([]byte, error) {
+// HandleRequest answers a query received over a stream transport, where
+// the response size is only bounded by the 16-bit length prefix. Any
+// resolution is abandoned when ctx ends: the client has gone away or the
+// server is shutting down.
+func (h *Handler) HandleRequest(ctx context.Context, data []byte) ([]byte, error) {
+	return h.handle(ctx, data, false)
+}
+
+// HandleUDPRequest answers a query received over UDP, truncating the
+// response to the payload size negotiated with the client.
+func (h *Handler) HandleUDPRequest(ctx context.Context, data []byte) ([]byte, error) {
+	return h.handle(ctx, data, true)
+}
+
+func (h *Handler) handle(ctx context.Context, data []byte, udp bool) ([]byte, error) {
 	request, err := protocol.ParseMessage(data)
 	if err != nil {
 		log.Printf("Failed to parse DNS request: %v", err)
-		return nil, fmt.Errorf("parse request: %w", err)
+		return h.handleMalformedRequest(data, err)
 	}
 
 	if len(request.Questions) > 0 {
@@ -35,14 +61,33 @@ func (h *Handler) HandleRequest(data []byte) ([]byte, error) {
 			protocol.ClassToString(q.Class))
 	}
 
+	clientEDNS, ednsErr := request.EDNS()
+	authZone := h.authoritativeZone(request)
+
 	var response *protocol.Message
-	if h.config.EnableRecursion {
-		response = h.handleRecursiveRequest(request)
-	} else {
-		response = h.handleIterativeRequest(request)
+	switch {
+	case ednsErr != nil:
+		response = protocol.CreateErrorResponse(request, protocol.RCodeFormErr)
+	case clientEDNS != nil && clientEDNS.Version > 0:
+		response = protocol.CreateErrorResponse(request, protocol.RCodeBadVers)
+	case authZone != nil:
+		response = h.handleAuthoritativeRequest(request, authZone)
+	case h.config.EnableRecursion && request.Header.Flags&protocol.FlagRD != 0:
+		response = h.handleRecursiveRequest(ctx, request)
+	default:
+		response = h.handleNonRecursiveRequest(request)
+	}
+
+	if clientEDNS != nil {
+		response.SetEDNS(h.responseEDNS(clientEDNS, response))
 	}
 
-	responseData, err := protocol.BuildMessage(response)
+	limit := 65535
+	if udp {
+		limit = min(request.MaxUDPSize(), h.config.MaxUDPSize)
+	}
+
+	responseData, err := protocol.BuildTruncatedMessage(response, limit)
 	if err != nil {
 		log.Printf("Failed to build DNS response: %v", err)
 		return nil, fmt.Errorf("build response: %w", err)
@@ -50,42 +95,176 @@ func (h *Handler) HandleRequest(data []byte) ([]byte, error) {
 
 	log.Printf("DNS Response: %d answers, RCODE: %s",
 		len(response.Answers),
-		protocol.RCodeToString(response.Header.Flags&0x0F))
+		protocol.RCodeToString(response.RCode()))
 
 	return responseData, nil
 }
 
-func (h *Handler) handleRecursiveRequest(request *protocol.Message) *protocol.Message {
+// handleMalformedRequest answers FORMERR to a query whose header is intact
+// but whose body could not be parsed. Anything else is dropped.
+func (h *Handler) handleMalformedRequest(data []byte, parseErr error) ([]byte, error) {
+	var malformed *protocol.ParseError
+	if !errors.As(parseErr, &malformed) {
+		return nil, fmt.Errorf("parse request: %w", parseErr)
+	}
+
+	header, err := protocol.ParseHeader(data)
+	if err != nil || header.Flags&protocol.FlagQR != 0 {
+		return nil, fmt.Errorf("parse request: %w", parseErr)
+	}
+
+	request := &protocol.Message{Header: header}
+	return h.HandleError(request, protocol.RCodeFormErr)
+}
+
+func (h *Handler) authoritativeZone(request *protocol.Message) *zone.Zone {
+	if len(request.Questions) == 0 || request.Questions[0].Class != protocol.ClassIN {
+		return nil
+	}
+	return h.zones.Find(request.Questions[0].Name)
+}
+
+func (h *Handler) handleAuthoritativeRequest(request *protocol.Message, z *zone.Zone) *protocol.Message {
+	question := request.Questions[0]
+	result := z.Lookup(question.Name, question.Type)
+
+	response := &protocol.Message{
+		Header: protocol.Header{
+			ID:    request.Header.ID,
+			Flags: protocol.FlagQR | (request.Header.Flags & protocol.FlagRD) | (result.RCode & 0x0F),
+		},
+		Questions:   request.Questions,
+		Answers:     result.Answers,
+		Authorities: result.Authorities,
+		Additional:  result.Additional,
+	}
+
+	if result.Authoritative {
+		response.Header.Flags |= protocol.FlagAA
+	}
+	if h.config.EnableRecursion {
+		response.Header.Flags |= protocol.FlagRA
+	}
+
+	return response
+}
+
+func (h *Handler) handleRecursiveRequest(ctx context.Context, request *protocol.Message) *protocol.Message {
 	if len(request.Questions) == 0 {
 		return protocol.CreateErrorResponse(request, protocol.RCodeFormErr)
 	}
 
 	question := request.Questions[0]
+	checkingDisabled := request.Header.Flags&protocol.FlagCD != 0
 
-	if question.Type != protocol.TypeA {
-		return protocol.CreateErrorResponse(request, protocol.RCodeNotImpl)
+	// Clients setting DO get the signatures and denial proofs along with
+	// the answer, so they can validate it themselves
+	resolve := h.resolver.ResolveSecure
+	if clientEDNS, _ := request.EDNS(); clientEDNS != nil && clientEDNS.DO {
+		resolve = h.resolver.ResolveSigned
 	}
 
-	ip, err := h.resolver.ResolveA(question.Name)
-	if err != nil {
-		log.Printf("Resolution failed for %s: %v", question.Name, err)
+	answers, security, err := resolve(ctx, question.Name, question.Type, checkingDisabled)
+	var negative *resolver.NegativeResponse
+	if errors.As(err, &negative) {
+		rcode := uint16(protocol.RCodeNoError)
+		if negative.NXDomain {
+			rcode = protocol.RCodeNXDomain
+		}
+		response := protocol.CreateErrorResponse(request, rcode)
+		response.Answers = negative.Answers
+		// The SOA tells downstream caches how long to remember the answer
+		if negative.SOA != nil {
+			response.Authorities = []protocol.ResourceRecord{*negative.SOA}
+		}
+		response.Authorities = append(response.Authorities, negative.Proof...)
+		response.Header.Flags |= protocol.FlagRA | h.securityFlags(request, security)
+		return response
+	}
+	if errors.Is(err, resolver.ErrBogus) {
+		log.Printf("DNSSEC validation failed for %s: %v", question.Name, err)
 		return protocol.CreateErrorResponse(request, protocol.RCodeServFail)
 	}
-
-	aRecord, err := protocol.CreateARecord(question.Name, ip, 300)
 	if err != nil {
-		log.Printf("Failed to create A record: %v", err)
+		log.Printf("Resolution failed for %s: %v", question.Name, err)
 		return protocol.CreateErrorResponse(request, protocol.RCodeServFail)
 	}
 
-	response := protocol.CreateResponse(request, []protocol.ResourceRecord{aRecord})
-	response.Header.Flags |= protocol.FlagRA
+	response := protocol.CreateResponse(request, answers)
+	response.Header.Flags |= protocol.FlagRA | h.securityFlags(request, security)
 
 	return response
 }
 
-func (h *Handler) handleIterativeRequest(request *protocol.Message) *protocol.Message {
-	return protocol.CreateErrorResponse(request, protocol.RCodeNotImpl)
+// securityFlags echoes the client's CD bit and sets AD on validated
+// answers, but only for clients that asked for it with DO or AD (RFC 6840
+// section 5.8).
+func (h *Handler) securityFlags(request *protocol.Message, security models.Security) uint16 {
+	flags := request.Header.Flags & protocol.FlagCD
+
+	clientEDNS, _ := request.EDNS()
+	wantsAD := request.Header.Flags&protocol.FlagAD != 0 || (clientEDNS != nil && clientEDNS.DO)
+	if security == models.SecuritySecure && wantsAD {
+		flags |= protocol.FlagAD
+	}
+	return flags
+}
+
+// responseEDNS advertises our own UDP payload size back to an EDNS
+// client, carrying the upper bits of the response code and echoing the
+// client's DO bit (RFC 3225 section 3).
+func (h *Handler) responseEDNS(clientEDNS *protocol.EDNS, response *protocol.Message) *protocol.EDNS {
+	e := protocol.NewEDNS(uint16(h.config.MaxUDPSize))
+	e.ExtendedRCode = uint8(response.RCode() >> 4)
+	e.DO = clientEDNS.DO
+	return e
+}
+
+// handleNonRecursiveRequest answers a query that did not set RD, or any
+// query when recursion is off, from the cache without going upstream. A
+// miss is answered with a referral to the closest zone cut we know of.
+// RA still tells the client whether it could have asked for recursion.
+func (h *Handler) handleNonRecursiveRequest(request *protocol.Message) *protocol.Message {
+	if len(request.Questions) == 0 {
+		return protocol.CreateErrorResponse(request, protocol.RCodeFormErr)
+	}
+
+	question := request.Questions[0]
+	response := &protocol.Message{
+		Header: protocol.Header{
+			ID:    request.Header.ID,
+			Flags: protocol.FlagQR | (request.Header.Flags & protocol.FlagRD),
+		},
+		Questions: request.Questions,
+	}
+	if h.config.EnableRecursion {
+		response.Header.Flags |= protocol.FlagRA
+	}
+
+	if question.Class != protocol.ClassIN {
+		response.Header.Flags |= protocol.RCodeRefused
+		return response
+	}
+
+	answers, referral, err := h.resolver.ResolveCached(question.Name, question.Type)
+	var negative *resolver.NegativeResponse
+	switch {
+	case errors.As(err, &negative):
+		if negative.NXDomain {
+			response.Header.Flags |= protocol.RCodeNXDomain
+		}
+		response.Answers = negative.Answers
+		if negative.SOA != nil {
+			response.Authorities = []protocol.ResourceRecord{*negative.SOA}
+		}
+	case err != nil:
+		response.Header.Flags |= protocol.RCodeServFail
+	default:
+		response.Answers = answers
+		response.Authorities = referral
+	}
+
+	return response
 }
 
 func (h *Handler) HandleError(request *protocol.Message, rcode uint16) ([]byte, error) {
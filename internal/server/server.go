@@ -1,9 +1,12 @@
 package server
 
 import (
+	"DNS-server/internal/protocol"
 	"DNS-server/internal/transport"
 	"DNS-server/models"
+	"DNS-server/pkg/dnssec"
 	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/zone"
 	"context"
 	"fmt"
 	"log"
@@ -16,6 +19,8 @@ type Server struct {
 	handler  *Handler
 	udp      *transport.UDPTransport
 	tcp      *transport.TCPTransport
+	tls      *transport.TLSTransport
+	https    *transport.HTTPSTransport
 	ctx      context.Context
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
@@ -36,11 +41,56 @@ func NewServer(config *Config) (*Server, error) {
 		DefaultTTL:      config.CacheTTL,
 		CleanupInterval: config.CacheCleanupInterval,
 		EnableStats:     true,
+		MaxNegativeTTL:  config.NegativeCacheMaxTTL,
+
+		StaleWindow:          config.ServeStaleWindow,
+		StaleTTL:             config.ServeStaleTTL,
+		StaleClientTimeout:   config.ServeStaleClientTimeout,
+		StaleRecheckInterval: config.ServeStaleRecheckInterval,
+
+		PrefetchPercent:         config.PrefetchPercent,
+		PrefetchMinHits:         config.PrefetchMinHits,
+		MaxConcurrentPrefetches: config.MaxConcurrentPrefetches,
+
+		MaxCoalescedWaiters: config.MaxCoalescedWaiters,
+	}
+
+	var res *resolver.Resolver
+	if len(config.Forwarders) > 0 {
+		forwarder := resolver.NewForwarder(config.Forwarders, config.ForwardStrategy, config.HopTimeout, config.HealthCheckInterval)
+		res = resolver.NewForwardingResolver(cacheConfig, forwarder)
+		log.Printf("Forwarding queries to %v (%s)", config.Forwarders, config.ForwardStrategy)
+	} else {
+		res = resolver.NewResolver(cacheConfig)
+		res.SetQNAMEMinimisation(config.QNAMEMinimisation)
+		res.SetIterativeProtocol(config.IterativeProtocol)
+		if config.DNSSEC {
+			res.EnableDNSSEC(trustAnchors(config.TrustAnchors))
+			log.Printf("DNSSEC validation enabled with %d trust anchors", len(config.TrustAnchors))
+		}
 	}
 
-	res := resolver.NewResolver(cacheConfig)
+	res.SetTimeouts(config.QueryTimeout, config.HopTimeout)
+
+	if len(config.ForwardRules) > 0 {
+		conditional := resolver.NewConditionalForwarder(config.HopTimeout)
+		for _, rule := range config.ForwardRules {
+			conditional.AddRule(rule.Suffix, rule.Servers, config.ForwardStrategy, rule.Timeout, config.HealthCheckInterval)
+			log.Printf("Forwarding %s to %v", rule.Suffix, rule.Servers)
+		}
+		res.SetConditionalForwarder(conditional)
+	}
 
-	handler := NewHandler(config)
+	zones := zone.NewStore()
+	for _, z := range config.Zones {
+		if err := zones.LoadFile(z.File, z.Origin); err != nil {
+			res.Close()
+			return nil, err
+		}
+		log.Printf("Loaded zone %s from %s", z.Origin, z.File)
+	}
+
+	handler := NewHandler(config, zones, res)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -59,7 +109,7 @@ func (s *Server) Start() error {
 	log.Println("Starting DNS server...")
 
 	if s.config.EnableUDP {
-		udp := transport.NewUDPTransport(s.config.GetUDPAddress(), s.handler.HandleRequest)
+		udp := transport.NewUDPTransport(s.config.GetUDPAddress(), s.config.MaxUDPSize, s.handler.HandleUDPRequest)
 		s.udp = udp
 
 		s.wg.Add(1)
@@ -88,6 +138,38 @@ func (s *Server) Start() error {
 		log.Printf("TCP server listening on %s", s.config.GetTCPAddress())
 	}
 
+	if s.config.EnableTLS {
+		tls := transport.NewTLSTransport(s.config.GetTLSAddress(), s.config.TLSCertFile, s.config.TLSKeyFile,
+			s.config.IdleTimeout, s.handler.HandleRequest)
+		s.tls = tls
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.tls.Start(s.ctx); err != nil {
+				log.Printf("TLS transport error: %v", err)
+			}
+		}()
+
+		log.Printf("TLS server listening on %s", s.config.GetTLSAddress())
+	}
+
+	if s.config.EnableHTTPS {
+		https := transport.NewHTTPSTransport(s.config.GetHTTPSAddress(), s.config.TLSCertFile, s.config.TLSKeyFile,
+			s.config.IdleTimeout, s.handler.HandleRequest)
+		s.https = https
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.https.Start(s.ctx); err != nil {
+				log.Printf("HTTPS transport error: %v", err)
+			}
+		}()
+
+		log.Printf("HTTPS server listening on %s", s.config.GetHTTPSAddress())
+	}
+
 	log.Println("DNS server started successfully")
 	return nil
 }
@@ -139,3 +221,14 @@ func (s *Server) IsRunning() bool {
 		return true
 	}
 }
+
+// trustAnchors parses the configured anchors, which Validate has checked.
+func trustAnchors(anchors []string) []*protocol.DSRecord {
+	records := make([]*protocol.DSRecord, 0, len(anchors))
+	for _, anchor := range anchors {
+		if ds, err := dnssec.ParseDS(anchor); err == nil {
+			records = append(records, ds)
+		}
+	}
+	return records
+}
@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"DNS-server/internal/protocol"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dohPath          = "/dns-query"
+	dnsMessageType   = "application/dns-message"
+	maxDNSMessageLen = 65535
+)
+
+// HTTPSTransport serves DNS over HTTPS (RFC 8484) at /dns-query, over
+// HTTP/2 where the client supports it.
+type HTTPSTransport struct {
+	addr        string
+	certs       *certificateLoader
+	idleTimeout time.Duration
+	handler     func(context.Context, []byte) ([]byte, error)
+}
+
+func NewHTTPSTransport(addr, certFile, keyFile string, idleTimeout time.Duration, handler func(context.Context, []byte) ([]byte, error)) *HTTPSTransport {
+	return &HTTPSTransport{
+		addr:        addr,
+		certs:       &certificateLoader{certFile: certFile, keyFile: keyFile},
+		idleTimeout: idleTimeout,
+		handler:     handler,
+	}
+}
+
+func (s *HTTPSTransport) Start(ctx context.Context) error {
+	if err := s.certs.load(); err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, s)
+
+	server := &http.Server{
+		Handler: mux,
+		// ServeTLS adds h2 to the protocols offered
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.certs.getCertificate,
+		},
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       s.idleTimeout,
+		// Request contexts end on shutdown as well as when the client
+		// goes away
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("HTTPS DNS server listening on %s", s.addr)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ServeTLS(listener, "", ""); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP answers one DoH request: a GET carrying the query base64url
+// encoded in the dns parameter, or a POST carrying it as the body.
+func (s *HTTPSTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		// Padding is not sent (RFC 8484 section 4.1) but costs nothing to
+		// accept
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+		query = decoded
+
+	case http.MethodPost:
+		if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) != dnsMessageType {
+			http.Error(w, "content type must be "+dnsMessageType, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDNSMessageLen))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "failed to read query", http.StatusBadRequest)
+			}
+			return
+		}
+		query = body
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(query) == 0 || len(query) > maxDNSMessageLen {
+		http.Error(w, "invalid query length", http.StatusBadRequest)
+		return
+	}
+
+	response, err := s.handler(r.Context(), query)
+	if err != nil {
+		log.Printf("HTTPS handler error: %v", err)
+		http.Error(w, "malformed DNS query", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(responseMaxAge(response)), 10))
+	w.Write(response)
+}
+
+// responseMaxAge is how long HTTP caches may keep a DNS response: the
+// smallest answer TTL, or for a denial the negative caching TTL from the
+// SOA (RFC 8484 section 5.1). Anything else is not cached.
+func responseMaxAge(response []byte) uint32 {
+	msg, err := protocol.ParseMessage(response)
+	if err != nil {
+		return 0
+	}
+
+	if len(msg.Answers) > 0 {
+		maxAge := msg.Answers[0].TTL
+		for _, rr := range msg.Answers[1:] {
+			maxAge = min(maxAge, rr.TTL)
+		}
+		return maxAge
+	}
+
+	rcode := msg.RCode()
+	if rcode != protocol.RCodeNoError && rcode != protocol.RCodeNXDomain {
+		return 0
+	}
+	for _, rr := range msg.Authorities {
+		if rr.Type != protocol.TypeSOA {
+			continue
+		}
+		if data, err := rr.TypedData(); err == nil {
+			if soa, ok := data.(*protocol.SOARecord); ok {
+				return min(rr.TTL, soa.Minimum)
+			}
+		}
+	}
+	return 0
+}
@@ -9,10 +9,10 @@ import (
 
 type TCPTransport struct {
 	addr    string
-	handler func([]byte) ([]byte, error)
+	handler func(context.Context, []byte) ([]byte, error)
 }
 
-func NewTCPTransport(addr string, handler func([]byte) ([]byte, error)) *TCPTransport {
+func NewTCPTransport(addr string, handler func(context.Context, []byte) ([]byte, error)) *TCPTransport {
 	return &TCPTransport{
 		addr:    addr,
 		handler: handler,
@@ -52,38 +52,60 @@ func (s *TCPTransport) Start(ctx context.Context) error {
 				}
 			}
 
-			go s.handleConnection(conn)
+			go s.handleConnection(ctx, conn)
 		}
 	}
 }
 
-func (s *TCPTransport) handleConnection(conn net.Conn) {
+func (s *TCPTransport) handleConnection(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
-	lengthBuf := make([]byte, 2)
+	// Queries are answered one at a time, but the next one is read while
+	// the current one is worked on. That way a client hanging up is seen
+	// straight away and cancels the query it was waiting for, rather than
+	// leaving it to run on until the server shuts down.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	for {
-		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-			if err != io.EOF {
-				log.Printf("TCP read length error: %v", err)
+	queries := make(chan []byte)
+	go func() {
+		defer close(queries)
+		defer cancel()
+
+		lengthBuf := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					log.Printf("TCP read length error: %v", err)
+				}
+				return
 			}
-			return
-		}
 
-		msgLen := int(lengthBuf[0])<<8 | int(lengthBuf[1])
+			msgLen := int(lengthBuf[0])<<8 | int(lengthBuf[1])
 
-		if msgLen == 0 || msgLen > 65535 {
-			log.Printf("Invalid message length: %d", msgLen)
-			return
-		}
+			if msgLen == 0 || msgLen > 65535 {
+				log.Printf("Invalid message length: %d", msgLen)
+				return
+			}
 
-		msgBuf := make([]byte, msgLen)
-		if _, err := io.ReadFull(conn, msgBuf); err != nil {
-			log.Printf("TCP read message error: %v", err)
-			return
+			msgBuf := make([]byte, msgLen)
+			if _, err := io.ReadFull(conn, msgBuf); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("TCP read message error: %v", err)
+				}
+				return
+			}
+
+			select {
+			case queries <- msgBuf:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		response, err := s.handler(msgBuf)
+	for msgBuf := range queries {
+		response, err := s.handler(ctx, msgBuf)
 		if err != nil {
 			log.Printf("TCP handler error: %v", err)
 			return
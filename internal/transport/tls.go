@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Queries a single DoT connection may have in flight before reading from
+// it pauses
+const maxPipelinedQueries = 100
+
+// TLSTransport serves DNS over TLS (RFC 7858). Queries on a connection are
+// handled concurrently and answered as they complete, so a slow lookup
+// does not hold up the ones pipelined behind it.
+type TLSTransport struct {
+	addr        string
+	certs       *certificateLoader
+	idleTimeout time.Duration
+	handler     func(context.Context, []byte) ([]byte, error)
+}
+
+func NewTLSTransport(addr, certFile, keyFile string, idleTimeout time.Duration, handler func(context.Context, []byte) ([]byte, error)) *TLSTransport {
+	return &TLSTransport{
+		addr:        addr,
+		certs:       &certificateLoader{certFile: certFile, keyFile: keyFile},
+		idleTimeout: idleTimeout,
+		handler:     handler,
+	}
+}
+
+func (s *TLSTransport) Start(ctx context.Context) error {
+	if err := s.certs.load(); err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.certs.getCertificate,
+	}
+
+	listener, err := tls.Listen("tcp", s.addr, config)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	log.Printf("TLS DNS server listening on %s", s.addr)
+
+	done := make(chan struct{})
+
+	// done is closed first so that the accept error caused by closing the
+	// listener is recognised as shutdown
+	go func() {
+		<-ctx.Done()
+		close(done)
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+				log.Printf("TLS accept error: %v", err)
+				continue
+			}
+		}
+
+		go s.handleConnection(ctx, conn)
+	}
+}
+
+func (s *TLSTransport) handleConnection(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		writeMu  sync.Mutex
+		inflight sync.WaitGroup
+
+		// pending counts the queries being worked on. The idle timeout only
+		// runs while it is zero, so a slow lookup does not end the
+		// connection and cancel itself along with the rest.
+		idleMu  sync.Mutex
+		pending int
+	)
+	slots := make(chan struct{}, maxPipelinedQueries)
+	defer inflight.Wait()
+
+	// armIdleTimeout is called with idleMu held
+	armIdleTimeout := func() {
+		if s.idleTimeout <= 0 {
+			return
+		}
+		if pending == 0 {
+			conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	// Once the read loop ends the client has gone or is being dropped, so
+	// queries still being worked on are cancelled before the connection
+	// closes
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lengthBuf := make([]byte, 2)
+
+	for {
+		idleMu.Lock()
+		armIdleTimeout()
+		idleMu.Unlock()
+
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			var netErr net.Error
+			if err != io.EOF && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				log.Printf("TLS read length error: %v", err)
+			}
+			return
+		}
+
+		msgLen := int(lengthBuf[0])<<8 | int(lengthBuf[1])
+		if msgLen == 0 {
+			log.Printf("Invalid message length: %d", msgLen)
+			return
+		}
+
+		msgBuf := make([]byte, msgLen)
+		if _, err := io.ReadFull(conn, msgBuf); err != nil {
+			log.Printf("TLS read message error: %v", err)
+			return
+		}
+
+		slots <- struct{}{}
+		inflight.Add(1)
+		idleMu.Lock()
+		pending++
+		idleMu.Unlock()
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			defer func() {
+				idleMu.Lock()
+				pending--
+				armIdleTimeout()
+				idleMu.Unlock()
+			}()
+
+			response, err := s.handler(ctx, msgBuf)
+			if err != nil {
+				log.Printf("TLS handler error: %v", err)
+				return
+			}
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if s.idleTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(s.idleTimeout))
+			}
+			if err := writeLengthPrefixed(conn, response); err != nil {
+				log.Printf("TLS write error: %v", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// writeLengthPrefixed sends a DNS message with its two-byte length in one
+// write, so that it goes out as a single TLS record.
+func writeLengthPrefixed(conn net.Conn, data []byte) error {
+	buf := make([]byte, 2+len(data))
+	buf[0] = byte(len(data) >> 8)
+	buf[1] = byte(len(data))
+	copy(buf[2:], data)
+
+	_, err := conn.Write(buf)
+	return err
+}
+
+// certificateLoader serves a certificate from disk and picks up a renewed
+// one on the next handshake after either file changes. A reload that fails
+// keeps the previous certificate.
+type certificateLoader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func (c *certificateLoader) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reload()
+}
+
+func (c *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.changed() {
+		if err := c.reload(); err != nil {
+			log.Printf("Keeping previous TLS certificate: %v", err)
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certificateLoader) changed() bool {
+	certTime, keyTime, err := c.modTimes()
+	return err == nil && (!certTime.Equal(c.certTime) || !keyTime.Equal(c.keyTime))
+}
+
+func (c *certificateLoader) reload() error {
+	certTime, keyTime, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		// Remember the broken files so they are not retried on every
+		// handshake; the next change gets another attempt
+		c.certTime, c.keyTime = certTime, keyTime
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+
+	if c.cert != nil {
+		log.Printf("Reloaded TLS certificate from %s", c.certFile)
+	}
+	c.cert = &cert
+	c.certTime, c.keyTime = certTime, keyTime
+	return nil
+}
+
+func (c *certificateLoader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
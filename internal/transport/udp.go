@@ -7,12 +7,14 @@ import (
 
 type UDPTransport struct {
 	addr    string
-	handler func([]byte) ([]byte, error)
+	maxSize int
+	handler func(context.Context, []byte) ([]byte, error)
 }
 
-func NewUDPTransport(addr string, handler func([]byte) ([]byte, error)) *UDPTransport {
+func NewUDPTransport(addr string, maxSize int, handler func(context.Context, []byte) ([]byte, error)) *UDPTransport {
 	return &UDPTransport{
 		addr:    addr,
+		maxSize: maxSize,
 		handler: handler,
 	}
 }
@@ -23,14 +25,14 @@ func (s *UDPTransport) Start(ctx context.Context) error {
 		return err
 	}
 	defer conn.Close()
-	
+
 	go func() {
 		<-ctx.Done()
 		conn.Close()
 	}()
-	
-	buffer := make([]byte, 512)
-	
+
+	buffer := make([]byte, s.maxSize)
+
 	for {
 		n, addr, err := conn.ReadFrom(buffer)
 		if err != nil {
@@ -41,9 +43,11 @@ func (s *UDPTransport) Start(ctx context.Context) error {
 				continue
 			}
 		}
-		
+
+		// UDP gives no sign of a client giving up, so queries only end
+		// early on shutdown
 		go func(data []byte, clientAddr net.Addr) {
-			response, err := s.handler(data)
+			response, err := s.handler(ctx, data)
 			if err != nil {
 				return
 			}
@@ -42,7 +42,16 @@ func main() {
 	fmt.Printf("  Cache Misses: %d\n", stats.Misses)
 	fmt.Printf("  Cache Hit Rate: %.2f%%\n", stats.HitRate()*100)
 	fmt.Printf("  Cache Evictions: %d\n", stats.Evictions)
+	fmt.Printf("  Prefetches: %d (%d dropped)\n", stats.Prefetches, stats.PrefetchesDropped)
+	fmt.Printf("  Coalesced Queries: %d (%d rejected)\n", stats.CoalescedQueries, stats.CoalesceRejected)
 	fmt.Printf("  Total Entries: %d/%d\n", stats.TotalEntries, stats.TotalCapacity)
+	fmt.Printf("  Stale Answers Served: %d\n", stats.StaleServed)
+	fmt.Printf("  Negative Hits: %d\n", stats.NegativeHits)
+	fmt.Printf("  Negative Misses: %d\n", stats.NegativeMisses)
+	fmt.Printf("  Negative Entries: %d\n", stats.NegativeEntries)
+	for suffix, hits := range stats.ForwardRuleHits {
+		fmt.Printf("  Forwarded %s: %d\n", suffix, hits)
+	}
 
 	log.Println("Server stopped successfully")
 }
@@ -1,10 +1,61 @@
 package models
 
-import "time"
+import (
+	"DNS-server/internal/protocol"
+	"time"
+)
 
+// TrustLevel ranks where cached data came from (RFC 2181 section 5.4.1)
+// so that less trustworthy data never replaces better data.
+type TrustLevel int
+
+const (
+	TrustGlue      TrustLevel = iota // Additional section of a referral
+	TrustAuthority                   // Authority section
+	TrustAnswer                      // Answer section
+)
+
+// Security is the DNSSEC status of an answer (RFC 4033 section 5).
+type Security int
+
+const (
+	SecurityIndeterminate Security = iota // Not validated, e.g. forwarded
+	SecurityInsecure                      // Provably outside any signed zone
+	SecuritySecure                        // Chain of trust verified
+	SecurityBogus                         // Validation failed
+)
+
+// Combine returns the status of an answer made of parts with statuses s
+// and other: bogus if either is, otherwise the weaker of the two.
+func (s Security) Combine(other Security) Security {
+	if s == SecurityBogus || other == SecurityBogus {
+		return SecurityBogus
+	}
+	return min(s, other)
+}
+
+func (s Security) String() string {
+	switch s {
+	case SecurityInsecure:
+		return "insecure"
+	case SecuritySecure:
+		return "secure"
+	case SecurityBogus:
+		return "bogus"
+	}
+	return "indeterminate"
+}
+
+// CacheEntry is one cached RRset, identified by owner name, type and
+// class. Records keep the TTLs they were received with.
 type CacheEntry struct {
-	Domain    string
-	IPAddress string
+	Name      string
+	Type      uint16
+	Class     uint16
+	Records   []protocol.ResourceRecord
+	Trust     TrustLevel
+	Security  Security
+	Hits      int64
 	TTL       time.Duration
 	ExpiresAt time.Time
 	CreatedAt time.Time
@@ -20,6 +71,27 @@ type CacheStatistics struct {
 	Evictions     int64
 	TotalEntries  int
 	TotalCapacity int
+
+	// Popular entries re-resolved before expiry, and prefetches skipped
+	// because too many were already running
+	Prefetches        int64
+	PrefetchesDropped int64
+
+	// Queries that waited on an identical in-flight resolution, and those
+	// refused because too many were already waiting
+	CoalescedQueries int64
+	CoalesceRejected int64
+
+	// Expired answers served because fresh resolution failed or was slow
+	StaleServed int64
+
+	// Cached NXDOMAIN and NODATA answers
+	NegativeHits    int64
+	NegativeMisses  int64
+	NegativeEntries int
+
+	// Queries handled by each conditional forwarding rule, keyed by suffix
+	ForwardRuleHits map[string]int64
 }
 
 func (s *CacheStatistics) HitRate() float64 {
@@ -30,11 +102,41 @@ func (s *CacheStatistics) HitRate() float64 {
 	return float64(s.Hits) / float64(total)
 }
 
+func (s *CacheStatistics) NegativeHitRate() float64 {
+	total := s.NegativeHits + s.NegativeMisses
+	if total == 0 {
+		return 0.0
+	}
+	return float64(s.NegativeHits) / float64(total)
+}
+
 type CacheConfig struct {
 	MaxEntries     int
 	DefaultTTL     time.Duration
 	CleanupInterval time.Duration
 	EnableStats    bool
+	// Upper bound on how long NXDOMAIN and NODATA answers are cached
+	MaxNegativeTTL time.Duration
+
+	// Serve-stale (RFC 8767): expired answers are kept for StaleWindow and
+	// served with StaleTTL when resolution fails or takes longer than
+	// StaleClientTimeout. After a failure the stale answer is served
+	// straight away for StaleRecheckInterval before upstreams are tried
+	// again. A zero StaleWindow disables it.
+	StaleWindow          time.Duration
+	StaleTTL             time.Duration
+	StaleClientTimeout   time.Duration
+	StaleRecheckInterval time.Duration
+
+	// Prefetch: an entry hit at least PrefetchMinHits times is re-resolved
+	// in the background once a hit lands in the last PrefetchPercent of its
+	// TTL. A zero PrefetchPercent disables it.
+	PrefetchPercent         int
+	PrefetchMinHits         int64
+	MaxConcurrentPrefetches int
+
+	// Queries allowed to wait on one in-flight resolution; zero is no limit
+	MaxCoalescedWaiters int
 }
 
 func DefaultCacheConfig() *CacheConfig {
@@ -43,5 +145,17 @@ func DefaultCacheConfig() *CacheConfig {
 		DefaultTTL:      5 * time.Minute,
 		CleanupInterval: 1 * time.Minute,
 		EnableStats:     true,
+		MaxNegativeTTL:  3 * time.Hour,
+
+		StaleWindow:          24 * time.Hour,
+		StaleTTL:             30 * time.Second,
+		StaleClientTimeout:   1800 * time.Millisecond,
+		StaleRecheckInterval: 30 * time.Second,
+
+		PrefetchPercent:         10,
+		PrefetchMinHits:         3,
+		MaxConcurrentPrefetches: 10,
+
+		MaxCoalescedWaiters: 100,
 	}
 }
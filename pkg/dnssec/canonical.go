@@ -0,0 +1,118 @@
+package dnssec
+
+import (
+	"DNS-server/internal/protocol"
+	"strings"
+)
+
+// CanonicalRData returns the RDATA of rr in canonical form: uncompressed,
+// with the domain names of the RFC 1035 era types lower-cased (RFC 4034
+// section 6.2, as amended by RFC 6840 section 5.1).
+func CanonicalRData(rr protocol.ResourceRecord) ([]byte, error) {
+	data, err := rr.TypedData()
+	if err != nil {
+		if rr.RData != nil {
+			return rr.RData, nil
+		}
+		return nil, err
+	}
+
+	switch d := data.(type) {
+	case *protocol.NSRecord:
+		c := *d
+		c.Host = protocol.CanonicalName(c.Host)
+		data = &c
+	case *protocol.CNAMERecord:
+		c := *d
+		c.Target = protocol.CanonicalName(c.Target)
+		data = &c
+	case *protocol.PTRRecord:
+		c := *d
+		c.Target = protocol.CanonicalName(c.Target)
+		data = &c
+	case *protocol.MXRecord:
+		c := *d
+		c.Exchange = protocol.CanonicalName(c.Exchange)
+		data = &c
+	case *protocol.SOARecord:
+		c := *d
+		c.MName = protocol.CanonicalName(c.MName)
+		c.RName = protocol.CanonicalName(c.RName)
+		data = &c
+	case *protocol.SRVRecord:
+		c := *d
+		c.Target = protocol.CanonicalName(c.Target)
+		data = &c
+	case *protocol.NAPTRRecord:
+		c := *d
+		c.Replacement = protocol.CanonicalName(c.Replacement)
+		data = &c
+	case *protocol.RRSIGRecord:
+		c := *d
+		c.SignerName = protocol.CanonicalName(c.SignerName)
+		data = &c
+	}
+
+	return protocol.PackRecordData(data)
+}
+
+// canonicalName returns name in lower-case, uncompressed wire form.
+func canonicalName(name string) []byte {
+	return protocol.EncodeDomainName(protocol.CanonicalName(name))
+}
+
+// CountLabels returns the number of labels in name as the RRSIG labels
+// field counts them: the root and a leading wildcard label do not count.
+func CountLabels(name string) int {
+	name = protocol.CanonicalName(name)
+	if name == "" {
+		return 0
+	}
+	name = strings.TrimPrefix(name, "*.")
+	if name == "*" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// lastLabels returns the rightmost n labels of name.
+func lastLabels(name string, n int) string {
+	labels := labelsOf(name)
+	if n >= len(labels) {
+		return protocol.CanonicalName(name)
+	}
+	return strings.Join(labels[len(labels)-n:], ".")
+}
+
+func labelsOf(name string) []string {
+	name = protocol.CanonicalName(name)
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// Compare orders names canonically (RFC 4034 section 6.1): label by label
+// from the root, each label compared as a lower-case octet string. It
+// returns -1, 0 or 1.
+func Compare(a, b string) int {
+	la, lb := labelsOf(a), labelsOf(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+// IsSubdomain reports whether name is zone or lies below it.
+func IsSubdomain(name, zone string) bool {
+	name, zone = protocol.CanonicalName(name), protocol.CanonicalName(zone)
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
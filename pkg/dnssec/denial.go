@@ -0,0 +1,421 @@
+package dnssec
+
+import (
+	"DNS-server/internal/protocol"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NSEC3 chains with more iterations than this are treated as insecure
+// (RFC 9276 section 3.2)
+const MaxNSEC3Iterations = 150
+
+const (
+	nsec3HashSHA1 = 1
+	nsec3OptOut   = 1
+)
+
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+var (
+	ErrNoProof             = errors.New("no valid proof of nonexistence")
+	ErrNSEC3Iterations     = errors.New("NSEC3 iteration count too high")
+	ErrUnsupportedNSEC3    = errors.New("unsupported NSEC3 hash algorithm")
+	ErrInconsistentNSEC3   = errors.New("NSEC3 records use different parameters")
+	ErrTypeExists          = errors.New("proof shows the type exists")
+	ErrWrongSideOfCut      = errors.New("proof comes from the wrong side of a zone cut")
+	ErrProofRecordsInvalid = errors.New("malformed NSEC or NSEC3 record")
+)
+
+// The proofs below take the NSEC or NSEC3 records of a response, whose
+// signatures the caller has already verified, and check what they say
+// about a name.
+
+// ProveNXDomain checks that proof shows name does not exist and that no
+// wildcard could have matched it.
+func ProveNXDomain(proof []protocol.ResourceRecord, name string) error {
+	if hasType(proof, protocol.TypeNSEC3) {
+		chain, err := newNSEC3Chain(proof)
+		if err != nil {
+			return err
+		}
+		if chain.match(name) != nil {
+			return fmt.Errorf("%w: %s exists", ErrNoProof, fqdn(name))
+		}
+		ce, _, err := chain.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if chain.cover(wildcardOf(ce)) == nil {
+			return fmt.Errorf("%w: wildcard at %s not denied", ErrNoProof, fqdn(ce))
+		}
+		return nil
+	}
+
+	chain := newNSECChain(proof)
+	covering := chain.cover(name)
+	if covering == nil {
+		return fmt.Errorf("%w: nothing covers %s", ErrNoProof, fqdn(name))
+	}
+	if chain.cover(wildcardOf(covering.closestEncloser(name))) == nil {
+		return fmt.Errorf("%w: wildcard for %s not denied", ErrNoProof, fqdn(name))
+	}
+	return nil
+}
+
+// ProveNoData checks that proof shows name exists but has no records of
+// qtype, either directly or through a wildcard.
+func ProveNoData(proof []protocol.ResourceRecord, name string, qtype uint16) error {
+	if qtype == protocol.TypeDS {
+		_, err := ProveNoDS(proof, name)
+		return err
+	}
+
+	if hasType(proof, protocol.TypeNSEC3) {
+		chain, err := newNSEC3Chain(proof)
+		if err != nil {
+			return err
+		}
+		if match := chain.match(name); match != nil {
+			return checkNoData(match.types(), qtype)
+		}
+		ce, _, err := chain.closestEncloser(name)
+		if err != nil {
+			return err
+		}
+		if wildcard := chain.match(wildcardOf(ce)); wildcard != nil {
+			return checkNoData(wildcard.types(), qtype)
+		}
+		return fmt.Errorf("%w: no NODATA proof for %s", ErrNoProof, fqdn(name))
+	}
+
+	chain := newNSECChain(proof)
+	if match := chain.match(name); match != nil {
+		return checkNoData(match.types, qtype)
+	}
+	if covering := chain.cover(name); covering != nil {
+		if wildcard := chain.match(wildcardOf(covering.closestEncloser(name))); wildcard != nil {
+			return checkNoData(wildcard.types, qtype)
+		}
+	}
+	return fmt.Errorf("%w: no NODATA proof for %s", ErrNoProof, fqdn(name))
+}
+
+// ProveNoDS checks that proof shows there is no DS RRset at name, and
+// reports whether name is nonetheless a delegation, which makes the child
+// zone insecure. NSEC3 opt-out spans count as possible delegations.
+func ProveNoDS(proof []protocol.ResourceRecord, name string) (delegation bool, err error) {
+	if hasType(proof, protocol.TypeNSEC3) {
+		chain, err := newNSEC3Chain(proof)
+		if err != nil {
+			return false, err
+		}
+		if match := chain.match(name); match != nil {
+			return noDSAt(match.types())
+		}
+		// An opt-out span may hide unsigned delegations (RFC 5155 section 8.6)
+		_, cover, err := chain.closestEncloser(name)
+		if err != nil {
+			return false, err
+		}
+		return cover.record.Flags&nsec3OptOut != 0, nil
+	}
+
+	chain := newNSECChain(proof)
+	if match := chain.match(name); match != nil {
+		return noDSAt(match.types)
+	}
+	if chain.cover(name) != nil {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: no DS denial for %s", ErrNoProof, fqdn(name))
+}
+
+// ProveNoCloserMatch checks, for an answer synthesised from the wildcard
+// at closestEncloser, that name itself does not exist (RFC 4035 section
+// 5.3.4, RFC 5155 section 8.8).
+func ProveNoCloserMatch(proof []protocol.ResourceRecord, name, closestEncloser string) error {
+	if hasType(proof, protocol.TypeNSEC3) {
+		chain, err := newNSEC3Chain(proof)
+		if err != nil {
+			return err
+		}
+		if chain.cover(nextCloser(name, closestEncloser)) == nil {
+			return fmt.Errorf("%w: wildcard answer for %s", ErrNoProof, fqdn(name))
+		}
+		return nil
+	}
+
+	if newNSECChain(proof).cover(name) == nil {
+		return fmt.Errorf("%w: wildcard answer for %s", ErrNoProof, fqdn(name))
+	}
+	return nil
+}
+
+// HashName computes the NSEC3 hash of name (RFC 5155 section 5).
+func HashName(name string, iterations uint16, salt []byte) []byte {
+	h := sha1.New()
+	h.Write(canonicalName(name))
+	h.Write(salt)
+	digest := h.Sum(nil)
+
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(salt)
+		digest = h.Sum(digest[:0])
+	}
+	return digest
+}
+
+func checkNoData(types []uint16, qtype uint16) error {
+	if containsType(types, qtype) || containsType(types, protocol.TypeCNAME) {
+		return fmt.Errorf("%w: %s", ErrTypeExists, protocol.TypeToString(qtype))
+	}
+	// The parent's NSEC at a delegation cannot deny data in the child
+	if containsType(types, protocol.TypeNS) && !containsType(types, protocol.TypeSOA) {
+		return ErrWrongSideOfCut
+	}
+	return nil
+}
+
+func noDSAt(types []uint16) (bool, error) {
+	if containsType(types, protocol.TypeDS) {
+		return false, fmt.Errorf("%w: DS", ErrTypeExists)
+	}
+	// The child's apex NSEC cannot deny a DS, which lives in the parent
+	if containsType(types, protocol.TypeSOA) {
+		return false, ErrWrongSideOfCut
+	}
+	return containsType(types, protocol.TypeNS), nil
+}
+
+// nsecRecord is an NSEC record: owner, the next owner in the zone and the
+// types at owner.
+type nsecRecord struct {
+	owner string
+	next  string
+	types []uint16
+}
+
+type nsecChain []nsecRecord
+
+func newNSECChain(proof []protocol.ResourceRecord) nsecChain {
+	var chain nsecChain
+	for _, rr := range proof {
+		if rr.Type != protocol.TypeNSEC {
+			continue
+		}
+		data, err := rr.TypedData()
+		if err != nil {
+			continue
+		}
+		if nsec, ok := data.(*protocol.NSECRecord); ok {
+			chain = append(chain, nsecRecord{owner: rr.Name, next: nsec.NextDomain, types: nsec.Types})
+		}
+	}
+	return chain
+}
+
+func (c nsecChain) match(name string) *nsecRecord {
+	for i := range c {
+		if protocol.EqualNames(c[i].owner, name) {
+			return &c[i]
+		}
+	}
+	return nil
+}
+
+// cover finds the NSEC whose span contains name, which proves name does
+// not exist.
+func (c nsecChain) cover(name string) *nsecRecord {
+	for i := range c {
+		n := &c[i]
+		if !between(Compare(n.owner, name), Compare(name, n.next), Compare(n.next, n.owner) <= 0) {
+			continue
+		}
+		// Names below a delegation are not the parent's to deny
+		if IsSubdomain(name, n.owner) && containsType(n.types, protocol.TypeNS) && !containsType(n.types, protocol.TypeSOA) {
+			continue
+		}
+		return n
+	}
+	return nil
+}
+
+// closestEncloser is the deepest existing ancestor of a name that n
+// covers: the longer of its common ancestors with the NSEC's two ends.
+func (n *nsecRecord) closestEncloser(name string) string {
+	a, b := commonAncestor(name, n.owner), commonAncestor(name, n.next)
+	if CountLabels(a) >= CountLabels(b) {
+		return a
+	}
+	return b
+}
+
+// nsec3Record is an NSEC3 record with its owner's hash decoded.
+type nsec3Record struct {
+	hash   []byte
+	zone   string
+	record *protocol.NSEC3Record
+}
+
+func (n *nsec3Record) types() []uint16 {
+	return n.record.Types
+}
+
+// nsec3Chain is the NSEC3 records of one response, all sharing one set of
+// hash parameters.
+type nsec3Chain struct {
+	records    []nsec3Record
+	iterations uint16
+	salt       []byte
+}
+
+func newNSEC3Chain(proof []protocol.ResourceRecord) (*nsec3Chain, error) {
+	chain := &nsec3Chain{}
+	for _, rr := range proof {
+		if rr.Type != protocol.TypeNSEC3 {
+			continue
+		}
+		data, err := rr.TypedData()
+		if err != nil {
+			return nil, err
+		}
+		nsec3, ok := data.(*protocol.NSEC3Record)
+		if !ok {
+			return nil, ErrProofRecordsInvalid
+		}
+
+		if nsec3.HashAlgorithm != nsec3HashSHA1 {
+			return nil, fmt.Errorf("%w: %d", ErrUnsupportedNSEC3, nsec3.HashAlgorithm)
+		}
+		if nsec3.Iterations > MaxNSEC3Iterations {
+			return nil, fmt.Errorf("%w: %d", ErrNSEC3Iterations, nsec3.Iterations)
+		}
+		if len(chain.records) == 0 {
+			chain.iterations, chain.salt = nsec3.Iterations, nsec3.Salt
+		} else if nsec3.Iterations != chain.iterations || !bytes.Equal(nsec3.Salt, chain.salt) {
+			return nil, ErrInconsistentNSEC3
+		}
+
+		label, zone, _ := strings.Cut(protocol.CanonicalName(rr.Name), ".")
+		hash, err := base32Hex.DecodeString(strings.ToUpper(label))
+		if err != nil {
+			return nil, fmt.Errorf("%w: owner %s", ErrProofRecordsInvalid, rr.Name)
+		}
+		chain.records = append(chain.records, nsec3Record{hash: hash, zone: zone, record: nsec3})
+	}
+
+	if len(chain.records) == 0 {
+		return nil, ErrNoProof
+	}
+	return chain, nil
+}
+
+func (c *nsec3Chain) match(name string) *nsec3Record {
+	hash := HashName(name, c.iterations, c.salt)
+	for i := range c.records {
+		n := &c.records[i]
+		if IsSubdomain(name, n.zone) && bytes.Equal(n.hash, hash) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (c *nsec3Chain) cover(name string) *nsec3Record {
+	hash := HashName(name, c.iterations, c.salt)
+	for i := range c.records {
+		n := &c.records[i]
+		next := n.record.NextHashed
+		if IsSubdomain(name, n.zone) && between(bytes.Compare(n.hash, hash), bytes.Compare(hash, next), bytes.Compare(next, n.hash) <= 0) {
+			return n
+		}
+	}
+	return nil
+}
+
+// closestEncloser finds the closest encloser proof for name (RFC 5155
+// section 8.3): an NSEC3 matching an ancestor and one covering the next
+// closer name. The covering record is returned for its opt-out flag.
+func (c *nsec3Chain) closestEncloser(name string) (string, *nsec3Record, error) {
+	for ce := parentOf(name); ; ce = parentOf(ce) {
+		if match := c.match(ce); match != nil {
+			types := match.types()
+			if containsType(types, protocol.TypeNS) && !containsType(types, protocol.TypeSOA) {
+				return "", nil, ErrWrongSideOfCut
+			}
+			cover := c.cover(nextCloser(name, ce))
+			if cover == nil {
+				return "", nil, fmt.Errorf("%w: next closer name of %s not covered", ErrNoProof, fqdn(name))
+			}
+			return ce, cover, nil
+		}
+		if ce == "" {
+			return "", nil, fmt.Errorf("%w: no closest encloser for %s", ErrNoProof, fqdn(name))
+		}
+	}
+}
+
+// between reports whether a value lies strictly inside the span from an
+// NSEC or NSEC3 owner to the next owner, given how it compares to both.
+// The last span of a zone wraps around from the end to the start.
+func between(ownerVsValue, valueVsNext int, wraps bool) bool {
+	if wraps {
+		return ownerVsValue < 0 || valueVsNext < 0
+	}
+	return ownerVsValue < 0 && valueVsNext < 0
+}
+
+func hasType(records []protocol.ResourceRecord, rrType uint16) bool {
+	for _, rr := range records {
+		if rr.Type == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(types []uint16, rrType uint16) bool {
+	for _, t := range types {
+		if t == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+func parentOf(name string) string {
+	_, parent, _ := strings.Cut(protocol.CanonicalName(name), ".")
+	return parent
+}
+
+// nextCloser is the ancestor of name one label below closestEncloser.
+func nextCloser(name, closestEncloser string) string {
+	return lastLabels(name, CountLabels(closestEncloser)+1)
+}
+
+func commonAncestor(a, b string) string {
+	la, lb := labelsOf(a), labelsOf(b)
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+	return strings.Join(la[len(la)-n:], ".")
+}
+
+func wildcardOf(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+func fqdn(name string) string {
+	return protocol.CanonicalName(name) + "."
+}
@@ -0,0 +1,340 @@
+// Package dnssec verifies DNSSEC signatures, delegation signer digests and
+// authenticated denial of existence (RFC 4033-4035, RFC 5155).
+package dnssec
+
+import (
+	"DNS-server/internal/protocol"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing algorithms (RFC 8624)
+const (
+	AlgorithmRSASHA256       = 8
+	AlgorithmECDSAP256SHA256 = 13
+	AlgorithmECDSAP384SHA384 = 14
+	AlgorithmED25519         = 15
+)
+
+// DS digest types
+const (
+	DigestSHA1   = 1
+	DigestSHA256 = 2
+	DigestSHA384 = 4
+)
+
+// DNSKEY flags
+const (
+	FlagZoneKey = 1 << 8
+	FlagRevoke  = 1 << 7
+	FlagSEP     = 1 << 0
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported DNSSEC algorithm")
+	ErrUnsupportedDigest    = errors.New("unsupported DS digest type")
+	ErrInvalidKey           = errors.New("invalid DNSKEY public key")
+	ErrBadSignature         = errors.New("signature does not verify")
+	ErrSignatureExpired     = errors.New("signature expired")
+	ErrSignatureNotYetValid = errors.New("signature not yet valid")
+	ErrSignatureMismatch    = errors.New("signature does not cover the RRset")
+)
+
+// SupportedAlgorithm reports whether signatures made with algorithm can
+// be verified.
+func SupportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case AlgorithmRSASHA256, AlgorithmECDSAP256SHA256, AlgorithmECDSAP384SHA384, AlgorithmED25519:
+		return true
+	}
+	return false
+}
+
+// SupportedDigest reports whether DS records with digestType can be
+// checked.
+func SupportedDigest(digestType uint8) bool {
+	switch digestType {
+	case DigestSHA1, DigestSHA256, DigestSHA384:
+		return true
+	}
+	return false
+}
+
+// KeyTag computes the tag RRSIG and DS records use to refer to key (RFC
+// 4034 appendix B).
+func KeyTag(key *protocol.DNSKEYRecord) uint16 {
+	rdata, err := protocol.PackRecordData(key)
+	if err != nil {
+		return 0
+	}
+
+	var sum uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			sum += uint32(b) << 8
+		} else {
+			sum += uint32(b)
+		}
+	}
+	sum += sum >> 16
+	return uint16(sum)
+}
+
+// Digest computes the DS digest of key as published at owner.
+func Digest(owner string, key *protocol.DNSKEYRecord, digestType uint8) ([]byte, error) {
+	rdata, err := protocol.PackRecordData(key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(canonicalName(owner), rdata...)
+
+	switch digestType {
+	case DigestSHA1:
+		sum := sha1.Sum(data)
+		return sum[:], nil
+	case DigestSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case DigestSHA384:
+		sum := sha512.Sum384(data)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedDigest, digestType)
+}
+
+// MatchesDS reports whether ds refers to key published at owner.
+func MatchesDS(owner string, key *protocol.DNSKEYRecord, ds *protocol.DSRecord) bool {
+	if ds.Algorithm != key.Algorithm || ds.KeyTag != KeyTag(key) {
+		return false
+	}
+	digest, err := Digest(owner, key, ds.DigestType)
+	return err == nil && bytes.Equal(digest, ds.Digest)
+}
+
+// ParseDS parses the RDATA of a DS record in presentation format, such as
+// "20326 8 2 E06D44B8...", as used for trust anchors.
+func ParseDS(text string) (*protocol.DSRecord, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("DS record needs 4 fields, got %d", len(fields))
+	}
+
+	keyTag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key tag: %w", err)
+	}
+	algorithm, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid algorithm: %w", err)
+	}
+	digestType, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest type: %w", err)
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest: %w", err)
+	}
+
+	return &protocol.DSRecord{
+		KeyTag:     uint16(keyTag),
+		Algorithm:  uint8(algorithm),
+		DigestType: uint8(digestType),
+		Digest:     digest,
+	}, nil
+}
+
+// Verify checks that sig is a valid signature over rrset by key at time
+// now. rrset must hold every record of one owner, type and class.
+func Verify(rrset []protocol.ResourceRecord, sig *protocol.RRSIGRecord, key *protocol.DNSKEYRecord, now time.Time) error {
+	if len(rrset) == 0 {
+		return ErrSignatureMismatch
+	}
+	if rrset[0].Type != sig.TypeCovered || sig.Algorithm != key.Algorithm {
+		return ErrSignatureMismatch
+	}
+
+	// Validity periods use serial number arithmetic (RFC 4034 section 3.1.5)
+	t := uint32(now.Unix())
+	if int32(t-sig.Inception) < 0 {
+		return ErrSignatureNotYetValid
+	}
+	if int32(sig.Expiration-t) < 0 {
+		return ErrSignatureExpired
+	}
+
+	data, err := SignedData(rrset, sig)
+	if err != nil {
+		return err
+	}
+	return verifySignature(key, data, sig.Signature)
+}
+
+// SignedData builds the octets an RRSIG signs: its own RDATA without the
+// signature, then the RRset in canonical form and order (RFC 4034
+// section 3.1.8.1).
+func SignedData(rrset []protocol.ResourceRecord, sig *protocol.RRSIGRecord) ([]byte, error) {
+	owner, err := signedOwner(rrset[0].Name, sig.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	data = binary.BigEndian.AppendUint16(data, sig.TypeCovered)
+	data = append(data, sig.Algorithm, sig.Labels)
+	data = binary.BigEndian.AppendUint32(data, sig.OriginalTTL)
+	data = binary.BigEndian.AppendUint32(data, sig.Expiration)
+	data = binary.BigEndian.AppendUint32(data, sig.Inception)
+	data = binary.BigEndian.AppendUint16(data, sig.KeyTag)
+	data = append(data, canonicalName(sig.SignerName)...)
+
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdata, err := CanonicalRData(rr)
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	prefix := canonicalName(owner)
+	prefix = binary.BigEndian.AppendUint16(prefix, rrset[0].Type)
+	prefix = binary.BigEndian.AppendUint16(prefix, rrset[0].Class)
+	prefix = binary.BigEndian.AppendUint32(prefix, sig.OriginalTTL)
+
+	for i, rdata := range rdatas {
+		// Duplicate records count once
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, prefix...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// signedOwner returns the name the RRset was signed under: the owner
+// itself, or the wildcard it was synthesised from when the signature has
+// fewer labels than the owner.
+func signedOwner(owner string, labels uint8) (string, error) {
+	count := CountLabels(owner)
+	switch {
+	case int(labels) == count:
+		return owner, nil
+	case int(labels) > count:
+		return "", fmt.Errorf("%w: %d labels for %s", ErrSignatureMismatch, labels, owner)
+	}
+	return "*." + lastLabels(owner, int(labels)), nil
+}
+
+// IsWildcardExpansion reports whether sig shows that owner was synthesised
+// from a wildcard, and returns the wildcard's closest encloser.
+func IsWildcardExpansion(owner string, sig *protocol.RRSIGRecord) (string, bool) {
+	if int(sig.Labels) >= CountLabels(owner) {
+		return "", false
+	}
+	return lastLabels(owner, int(sig.Labels)), true
+}
+
+func verifySignature(key *protocol.DNSKEYRecord, data, signature []byte) error {
+	switch key.Algorithm {
+	case AlgorithmRSASHA256:
+		pub, err := rsaPublicKey(key.PublicKey)
+		if err != nil {
+			return err
+		}
+		hashed := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature) != nil {
+			return ErrBadSignature
+		}
+		return nil
+
+	case AlgorithmECDSAP256SHA256:
+		hashed := sha256.Sum256(data)
+		return verifyECDSA(elliptic.P256(), 32, key.PublicKey, hashed[:], signature)
+
+	case AlgorithmECDSAP384SHA384:
+		hashed := sha512.Sum384(data)
+		return verifyECDSA(elliptic.P384(), 48, key.PublicKey, hashed[:], signature)
+
+	case AlgorithmED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return ErrInvalidKey
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, signature) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d", ErrUnsupportedAlgorithm, key.Algorithm)
+}
+
+// rsaPublicKey decodes an RSA key in the RFC 3110 format: exponent length,
+// exponent, modulus.
+func rsaPublicKey(data []byte) (*rsa.PublicKey, error) {
+	if len(data) < 3 {
+		return nil, ErrInvalidKey
+	}
+
+	exponentLength := int(data[0])
+	data = data[1:]
+	if exponentLength == 0 {
+		exponentLength = int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if exponentLength == 0 || exponentLength > 4 || len(data) <= exponentLength {
+		return nil, ErrInvalidKey
+	}
+
+	exponent := 0
+	for _, b := range data[:exponentLength] {
+		exponent = exponent<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(data[exponentLength:]),
+		E: exponent,
+	}, nil
+}
+
+// verifyECDSA checks a signature in the RFC 6605 format: r and s, each
+// size bytes, against a key holding the point's x and y coordinates.
+func verifyECDSA(curve elliptic.Curve, size int, key, hashed, signature []byte) error {
+	if len(key) != 2*size {
+		return ErrInvalidKey
+	}
+	if len(signature) != 2*size {
+		return ErrBadSignature
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(key[:size]),
+		Y:     new(big.Int).SetBytes(key[size:]),
+	}
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(pub, hashed, r, s) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -1,24 +1,58 @@
 package resolver
 
 import (
+	"DNS-server/internal/protocol"
 	"DNS-server/models"
 	"container/list"
 	"sync"
 	"time"
 )
 
+// Longest CNAME chain followed through the cache before giving up
+const maxCachedCNAMEChain = 8
+
 type DNSCache struct {
-	config     *models.CacheConfig
-	entries    map[string]*cacheNode
-	lruList    *list.List
-	mu         sync.RWMutex
-	stats      models.CacheStatistics
+	config      *models.CacheConfig
+	entries     map[cacheKey]*cacheNode
+	lruList     *list.List
+	negative    map[cacheKey]*negativeNode
+	negativeLRU *list.List
+	mu          sync.RWMutex
+	stats       models.CacheStatistics
 	stopCleanup chan bool
 }
 
+// cacheKey identifies an RRset. Names are lowercased and without the
+// trailing dot.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func newCacheKey(name string, qtype, qclass uint16) cacheKey {
+	return cacheKey{
+		name:   protocol.CanonicalName(name),
+		qtype:  qtype,
+		qclass: qclass,
+	}
+}
+
 type cacheNode struct {
 	entry   *models.CacheEntry
 	element *list.Element
+	// prefetching is set while a refresh of the entry is in flight
+	prefetching bool
+	// recheckAt is when upstreams are next tried after failing to refresh
+	// the expired entry
+	recheckAt time.Time
+}
+
+// negativeNode holds a cached NXDOMAIN or NODATA answer (RFC 2308).
+type negativeNode struct {
+	response  *NegativeResponse
+	expiresAt time.Time
+	element   *list.Element
 }
 
 func NewDNSCache(config *models.CacheConfig) *DNSCache {
@@ -28,8 +62,10 @@ func NewDNSCache(config *models.CacheConfig) *DNSCache {
 
 	cache := &DNSCache{
 		config:      config,
-		entries:     make(map[string]*cacheNode),
+		entries:     make(map[cacheKey]*cacheNode),
 		lruList:     list.New(),
+		negative:    make(map[cacheKey]*negativeNode),
+		negativeLRU: list.New(),
 		stopCleanup: make(chan bool),
 	}
 
@@ -38,61 +74,317 @@ func NewDNSCache(config *models.CacheConfig) *DNSCache {
 	return cache
 }
 
-func (c *DNSCache) Get(domain string) (string, bool) {
+// Get returns the cached RRset for name/qtype/qclass with TTLs reduced by
+// the time spent in the cache.
+func (c *DNSCache) Get(name string, qtype, qclass uint16) ([]protocol.ResourceRecord, bool) {
+	entry, found := c.GetEntry(name, qtype, qclass)
+	if !found {
+		return nil, false
+	}
+	return decayedRecords(&entry, time.Now()), true
+}
+
+// lookupQuiet is Get for the resolver's own use, such as finding a zone's
+// nameservers. It is not a client lookup, so it is left out of the hit
+// and miss counts.
+func (c *DNSCache) lookupQuiet(name string, qtype, qclass uint16) ([]protocol.ResourceRecord, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	node, exists := c.entries[domain]
-	if !exists {
-		if c.config.EnableStats {
-			c.stats.Misses++
+	node, found := c.lookup(newCacheKey(name, qtype, qclass), false)
+	if !found {
+		return nil, false
+	}
+	return decayedRecords(node.entry, time.Now()), true
+}
+
+func (c *DNSCache) GetEntry(name string, qtype, qclass uint16) (models.CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, found := c.lookup(newCacheKey(name, qtype, qclass), false)
+	c.countLookup(found)
+	if !found {
+		return models.CacheEntry{}, false
+	}
+
+	return *node.entry, true
+}
+
+// Lookup answers name/qtype/qclass from the cache, following cached CNAME
+// chains the way an upstream answer section would. Only data that came
+// from answer sections is used; referral NS sets and glue are kept for
+// resolution but never handed to clients.
+func (c *DNSCache) Lookup(name string, qtype, qclass uint16) ([]protocol.ResourceRecord, bool) {
+	records, _, found := c.lookupAnswer(name, qtype, qclass)
+	return records, found
+}
+
+// lookupAnswer is Lookup that also reports the DNSSEC status of the
+// answer, the weakest of the RRsets it is made of.
+func (c *DNSCache) lookupAnswer(name string, qtype, qclass uint16) ([]protocol.ResourceRecord, models.Security, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records, security, found := c.answer(name, qtype, qclass, false)
+	c.countLookup(found)
+	return records, security, found
+}
+
+// LookupStale is Lookup for when fresh resolution has failed or is taking
+// too long: entries that expired less than the stale window ago are also
+// used, served with the short stale TTL (RFC 8767).
+func (c *DNSCache) LookupStale(name string, qtype, qclass uint16) ([]protocol.ResourceRecord, bool) {
+	if c.config.StaleWindow <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	records, _, found := c.answer(name, qtype, qclass, true)
+	if found && c.config.EnableStats {
+		c.stats.StaleServed++
+	}
+	return records, found
+}
+
+func (c *DNSCache) answer(name string, qtype, qclass uint16, allowStale bool) ([]protocol.ResourceRecord, models.Security, bool) {
+	now := time.Now()
+	var chain []protocol.ResourceRecord
+	security := models.SecuritySecure
+
+	for hops := 0; hops <= maxCachedCNAMEChain; hops++ {
+		if node, found := c.lookup(newCacheKey(name, qtype, qclass), allowStale); found && node.entry.Trust == models.TrustAnswer {
+			if hops == 0 {
+				node.entry.Hits++
+			}
+			return append(chain, c.recordsAt(node.entry, now)...), security.Combine(node.entry.Security), true
+		}
+		if qtype == protocol.TypeCNAME {
+			break
+		}
+
+		node, found := c.lookup(newCacheKey(name, protocol.TypeCNAME, qclass), allowStale)
+		if !found || node.entry.Trust != models.TrustAnswer {
+			break
+		}
+		if hops == 0 {
+			node.entry.Hits++
+		}
+		cnames := c.recordsAt(node.entry, now)
+		chain = append(chain, cnames...)
+		security = security.Combine(node.entry.Security)
+
+		target, ok := cnameTarget(cnames)
+		if !ok {
+			break
+		}
+		name = target
+	}
+
+	return nil, models.SecurityIndeterminate, false
+}
+
+// cnameTarget returns where a cached CNAME set, which may carry its
+// signature, points.
+func cnameTarget(records []protocol.ResourceRecord) (string, bool) {
+	for _, rr := range records {
+		if rr.Type == protocol.TypeCNAME {
+			target, err := rr.GetStringData()
+			return target, err == nil
 		}
-		return "", false
+	}
+	return "", false
+}
+
+// lookup finds an entry and marks it recently used. Expired entries are
+// kept for the stale window and only returned when allowStale is set.
+// The caller holds the lock.
+func (c *DNSCache) lookup(key cacheKey, allowStale bool) (*cacheNode, bool) {
+	node, exists := c.entries[key]
+	if !exists {
+		return nil, false
 	}
 
 	if node.entry.IsExpired() {
-		c.removeNode(domain)
-		if c.config.EnableStats {
-			c.stats.Misses++
+		if c.pastStaleWindow(node.entry, time.Now()) {
+			c.removeNode(key)
+			return nil, false
+		}
+		if !allowStale {
+			return nil, false
 		}
-		return "", false
 	}
 
 	c.lruList.MoveToFront(node.element)
-	
-	if c.config.EnableStats {
-		c.stats.Hits++
+	return node, true
+}
+
+// prefetchDue reports whether the entry answering name/qtype/qclass is
+// popular and close enough to expiry to be refreshed now, and claims the
+// refresh so only one caller starts it. A CNAME at the name stands in for
+// the RRset it leads to.
+func (c *DNSCache) prefetchDue(name string, qtype, qclass uint16) bool {
+	if c.config.PrefetchPercent <= 0 {
+		return false
 	}
 
-	return node.entry.IPAddress, true
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.answerNode(name, qtype, qclass)
+	if node == nil || node.prefetching || node.entry.IsExpired() || node.entry.Hits < c.config.PrefetchMinHits {
+		return false
+	}
+
+	remaining := time.Until(node.entry.ExpiresAt)
+	if remaining*100 > node.entry.TTL*time.Duration(c.config.PrefetchPercent) {
+		return false
+	}
+
+	node.prefetching = true
+	return true
 }
 
-func (c *DNSCache) Set(domain, ipAddress string, ttl time.Duration) {
+// releasePrefetch gives up a refresh claimed by prefetchDue that could not
+// be started.
+func (c *DNSCache) releasePrefetch(name string, qtype, qclass uint16) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if node, exists := c.entries[domain]; exists {
-		node.entry.IPAddress = ipAddress
-		node.entry.TTL = ttl
-		node.entry.ExpiresAt = time.Now().Add(ttl)
-		c.lruList.MoveToFront(node.element)
+	if node := c.answerNode(name, qtype, qclass); node != nil {
+		node.prefetching = false
+	}
+}
+
+// noteFailure records that the stale entry answering name/qtype/qclass
+// could not be refreshed, so it is served without asking upstreams again
+// until the recheck interval has passed (RFC 8767 section 4). It reports
+// whether a new interval started; within one it changes nothing.
+func (c *DNSCache) noteFailure(name string, qtype, qclass uint16) bool {
+	if c.config.StaleRecheckInterval <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := c.answerNode(name, qtype, qclass)
+	now := time.Now()
+	if node == nil || now.Before(node.recheckAt) {
+		return false
+	}
+	node.recheckAt = now.Add(c.config.StaleRecheckInterval)
+	return true
+}
+
+// failedRecently reports whether refreshing the entry answering
+// name/qtype/qclass failed less than the recheck interval ago.
+func (c *DNSCache) failedRecently(name string, qtype, qclass uint16) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	node := c.answerNode(name, qtype, qclass)
+	return node != nil && time.Now().Before(node.recheckAt)
+}
+
+func (c *DNSCache) answerNode(name string, qtype, qclass uint16) *cacheNode {
+	if node, exists := c.entries[newCacheKey(name, qtype, qclass)]; exists {
+		return node
+	}
+	return c.entries[newCacheKey(name, protocol.TypeCNAME, qclass)]
+}
+
+func (c *DNSCache) pastStaleWindow(entry *models.CacheEntry, now time.Time) bool {
+	return now.After(entry.ExpiresAt.Add(c.config.StaleWindow))
+}
+
+// recordsAt copies the records of an entry with TTLs as they should be
+// served at now: decayed while fresh, the stale TTL once expired.
+func (c *DNSCache) recordsAt(entry *models.CacheEntry, now time.Time) []protocol.ResourceRecord {
+	if !now.After(entry.ExpiresAt) {
+		return decayedRecords(entry, now)
+	}
+
+	staleTTL := uint32(c.config.StaleTTL / time.Second)
+	records := make([]protocol.ResourceRecord, len(entry.Records))
+	for i, rr := range entry.Records {
+		rr.TTL = staleTTL
+		records[i] = rr
+	}
+	return records
+}
+
+func (c *DNSCache) countLookup(hit bool) {
+	if !c.config.EnableStats {
 		return
 	}
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
 
-	if c.lruList.Len() >= c.config.MaxEntries {
-		c.evictLRU()
+// Set caches an RRset. The entry lives as long as the smallest TTL in the
+// set. Data is only replaced by data of the same or higher trust, unless
+// the existing entry has expired.
+func (c *DNSCache) Set(name string, qtype, qclass uint16, records []protocol.ResourceRecord, trust models.TrustLevel) {
+	c.set(name, qtype, qclass, records, trust, models.SecurityIndeterminate)
+}
+
+func (c *DNSCache) set(name string, qtype, qclass uint16, records []protocol.ResourceRecord, trust models.TrustLevel, security models.Security) {
+	if len(records) == 0 {
+		return
 	}
 
+	ttl := time.Duration(records[0].TTL) * time.Second
+	for _, rr := range records[1:] {
+		if d := time.Duration(rr.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	key := newCacheKey(name, qtype, qclass)
+	now := time.Now()
 	entry := &models.CacheEntry{
-		Domain:    domain,
-		IPAddress: ipAddress,
+		Name:      key.name,
+		Type:      qtype,
+		Class:     qclass,
+		Records:   append([]protocol.ResourceRecord(nil), records...),
+		Trust:     trust,
+		Security:  security,
 		TTL:       ttl,
-		ExpiresAt: time.Now().Add(ttl),
-		CreatedAt: time.Now(),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if node, exists := c.entries[key]; exists {
+		if trust < node.entry.Trust && !node.entry.IsExpired() {
+			return
+		}
+		// A refreshed entry stays as popular as the one it replaces
+		entry.Hits = node.entry.Hits
+		node.entry = entry
+		node.prefetching = false
+		node.recheckAt = time.Time{}
+		c.lruList.MoveToFront(node.element)
+		return
+	}
+
+	if c.lruList.Len() >= c.config.MaxEntries {
+		c.evictLRU()
 	}
 
-	element := c.lruList.PushFront(domain)
-	c.entries[domain] = &cacheNode{
+	element := c.lruList.PushFront(key)
+	c.entries[key] = &cacheNode{
 		entry:   entry,
 		element: element,
 	}
@@ -103,21 +395,166 @@ func (c *DNSCache) Set(domain, ipAddress string, ttl time.Duration) {
 	}
 }
 
+// SetRecords splits records into RRsets by owner, type and class and
+// caches each of them at the given trust level. Signatures go with the
+// RRset they cover.
+func (c *DNSCache) SetRecords(records []protocol.ResourceRecord, trust models.TrustLevel) {
+	c.setRecords(records, trust, models.SecurityIndeterminate)
+}
+
+func (c *DNSCache) setRecords(records []protocol.ResourceRecord, trust models.TrustLevel, security models.Security) {
+	var order []cacheKey
+	sets := make(map[cacheKey][]protocol.ResourceRecord)
+
+	var sigs []protocol.ResourceRecord
+
+	for _, rr := range records {
+		if rr.Type == protocol.TypeOPT {
+			continue
+		}
+		if rr.Type == protocol.TypeRRSIG {
+			sigs = append(sigs, rr)
+			continue
+		}
+		key := newCacheKey(rr.Name, rr.Type, rr.Class)
+		if _, seen := sets[key]; !seen {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	// Signatures are kept with the RRset they cover, so an answer comes
+	// back from the cache signed for clients that set DO. Those covering
+	// nothing cached here are an answer to an RRSIG query.
+	for _, sig := range sigs {
+		key := newCacheKey(sig.Name, protocol.TypeRRSIG, sig.Class)
+		if data, err := sig.TypedData(); err == nil {
+			if rrsig, ok := data.(*protocol.RRSIGRecord); ok && sets[newCacheKey(sig.Name, rrsig.TypeCovered, sig.Class)] != nil {
+				key = newCacheKey(sig.Name, rrsig.TypeCovered, sig.Class)
+			}
+		}
+		if _, seen := sets[key]; !seen {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], sig)
+	}
+
+	for _, key := range order {
+		c.set(key.name, key.qtype, key.qclass, sets[key], trust, security)
+	}
+}
+
+// decayedRecords copies the records of an entry with each TTL lowered by
+// the time the entry has spent in the cache.
+func decayedRecords(entry *models.CacheEntry, now time.Time) []protocol.ResourceRecord {
+	elapsed := uint32(now.Sub(entry.CreatedAt) / time.Second)
+
+	records := make([]protocol.ResourceRecord, len(entry.Records))
+	for i, rr := range entry.Records {
+		if rr.TTL > elapsed {
+			rr.TTL -= elapsed
+		} else {
+			rr.TTL = 0
+		}
+		records[i] = rr
+	}
+	return records
+}
+
+// GetNegative returns the negative answer cached for name/qtype/qclass,
+// with the SOA TTL lowered to the time it has left.
+func (c *DNSCache) GetNegative(name string, qtype, qclass uint16) (*NegativeResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(name, qtype, qclass)
+	node, exists := c.negative[key]
+	if exists && time.Now().After(node.expiresAt) {
+		c.removeNegative(key)
+		exists = false
+	}
+
+	if !exists {
+		if c.config.EnableStats {
+			c.stats.NegativeMisses++
+		}
+		return nil, false
+	}
+
+	c.negativeLRU.MoveToFront(node.element)
+
+	if c.config.EnableStats {
+		c.stats.NegativeHits++
+	}
+
+	return node.response.withTTL(time.Until(node.expiresAt)), true
+}
+
+// SetNegative caches a negative answer for ttl, capped at the configured
+// maximum negative TTL.
+func (c *DNSCache) SetNegative(name string, qtype, qclass uint16, response *NegativeResponse, ttl time.Duration) {
+	if c.config.MaxNegativeTTL > 0 && ttl > c.config.MaxNegativeTTL {
+		ttl = c.config.MaxNegativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(name, qtype, qclass)
+	if node, exists := c.negative[key]; exists {
+		node.response = response
+		node.expiresAt = time.Now().Add(ttl)
+		c.negativeLRU.MoveToFront(node.element)
+		return
+	}
+
+	if c.negativeLRU.Len() >= c.config.MaxEntries {
+		if element := c.negativeLRU.Back(); element != nil {
+			c.removeNegative(element.Value.(cacheKey))
+			if c.config.EnableStats {
+				c.stats.Evictions++
+			}
+		}
+	}
+
+	c.negative[key] = &negativeNode{
+		response:  response,
+		expiresAt: time.Now().Add(ttl),
+		element:   c.negativeLRU.PushFront(key),
+	}
+
+	if c.config.EnableStats {
+		c.stats.NegativeEntries = len(c.negative)
+	}
+}
+
+func (c *DNSCache) removeNegative(key cacheKey) {
+	if node, exists := c.negative[key]; exists {
+		c.negativeLRU.Remove(node.element)
+		delete(c.negative, key)
+		if c.config.EnableStats {
+			c.stats.NegativeEntries = len(c.negative)
+		}
+	}
+}
+
 func (c *DNSCache) evictLRU() {
 	element := c.lruList.Back()
 	if element != nil {
-		domain := element.Value.(string)
-		c.removeNode(domain)
+		c.removeNode(element.Value.(cacheKey))
 		if c.config.EnableStats {
 			c.stats.Evictions++
 		}
 	}
 }
 
-func (c *DNSCache) removeNode(domain string) {
-	if node, exists := c.entries[domain]; exists {
+func (c *DNSCache) removeNode(key cacheKey) {
+	if node, exists := c.entries[key]; exists {
 		c.lruList.Remove(node.element)
-		delete(c.entries, domain)
+		delete(c.entries, key)
 		if c.config.EnableStats {
 			c.stats.TotalEntries = len(c.entries)
 		}
@@ -142,15 +579,24 @@ func (c *DNSCache) removeExpiredEntries() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for domain, node := range c.entries {
-		if node.entry.IsExpired() {
+	now := time.Now()
+	for key, node := range c.entries {
+		if c.pastStaleWindow(node.entry, now) {
 			c.lruList.Remove(node.element)
-			delete(c.entries, domain)
+			delete(c.entries, key)
+		}
+	}
+
+	for key, node := range c.negative {
+		if now.After(node.expiresAt) {
+			c.negativeLRU.Remove(node.element)
+			delete(c.negative, key)
 		}
 	}
 
 	if c.config.EnableStats {
 		c.stats.TotalEntries = len(c.entries)
+		c.stats.NegativeEntries = len(c.negative)
 	}
 }
 
@@ -158,9 +604,12 @@ func (c *DNSCache) Clear() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.entries = make(map[string]*cacheNode)
+	c.entries = make(map[cacheKey]*cacheNode)
 	c.lruList = list.New()
+	c.negative = make(map[cacheKey]*negativeNode)
+	c.negativeLRU = list.New()
 	c.stats.TotalEntries = 0
+	c.stats.NegativeEntries = 0
 }
 
 func (c *DNSCache) GetStats() models.CacheStatistics {
@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrTooManyWaiters = errors.New("too many queries waiting on the same resolution")
+
+// inflightCall is one upstream resolution shared by every query for the
+// same name, type and class that arrives while it runs.
+type inflightCall[T any] struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	result T
+	err    error
+	// waiters counts the queries still waiting for the answer, the one
+	// that started the resolution included
+	waiters int
+}
+
+// coalescer collapses concurrent identical queries into a single upstream
+// resolution, so a burst of clients asking for an uncached name costs one
+// walk instead of one per client. T is what a resolution produces: answers
+// for the resolver, the trust of a zone for the validator.
+type coalescer[T any] struct {
+	mu         sync.Mutex
+	calls      map[cacheKey]*inflightCall[T]
+	maxWaiters int
+	coalesced  atomic.Int64
+	rejected   atomic.Int64
+}
+
+func newCoalescer[T any](maxWaiters int) *coalescer[T] {
+	return &coalescer[T]{
+		calls:      make(map[cacheKey]*inflightCall[T]),
+		maxWaiters: maxWaiters,
+	}
+}
+
+// do runs resolve for key unless an identical resolution is already in
+// flight, in which case it waits for that one and shares its result.
+// Waiters beyond the cap get ErrTooManyWaiters straight away.
+func (c *coalescer[T]) do(ctx context.Context, key cacheKey, resolve func(context.Context) (T, error)) (T, error) {
+	call, err := c.join(ctx, key, resolve)
+	if err != nil {
+		var none T
+		return none, err
+	}
+	return c.wait(ctx, key, call)
+}
+
+// join registers interest in the resolution for key, starting it if none
+// is in flight. The resolution belongs to no single query: it runs until
+// ctx's deadline, and is only cancelled once every waiter has given up.
+func (c *coalescer[T]) join(ctx context.Context, key cacheKey, resolve func(context.Context) (T, error)) (*inflightCall[T], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if call, exists := c.calls[key]; exists {
+		// The query that started the call does not count against the cap
+		if c.maxWaiters > 0 && call.waiters > c.maxWaiters {
+			c.rejected.Add(1)
+			return nil, ErrTooManyWaiters
+		}
+		call.waiters++
+		c.coalesced.Add(1)
+		return call, nil
+	}
+
+	call := &inflightCall[T]{done: make(chan struct{}), waiters: 1}
+	detached := context.WithoutCancel(ctx)
+	var callCtx context.Context
+	if deadline, ok := ctx.Deadline(); ok {
+		callCtx, call.cancel = context.WithDeadline(detached, deadline)
+	} else {
+		callCtx, call.cancel = context.WithCancel(detached)
+	}
+	c.calls[key] = call
+
+	go func() {
+		result, err := resolve(callCtx)
+
+		c.mu.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mu.Unlock()
+
+		call.result, call.err = result, err
+		call.cancel()
+		close(call.done)
+	}()
+
+	return call, nil
+}
+
+// wait returns the result of call, or ctx's error if ctx ends first.
+func (c *coalescer[T]) wait(ctx context.Context, key cacheKey, call *inflightCall[T]) (T, error) {
+	select {
+	case <-call.done:
+		c.leave(key, call)
+		return call.result, call.err
+	case <-ctx.Done():
+		c.leave(key, call)
+		var none T
+		return none, ctx.Err()
+	}
+}
+
+// leave drops a waiter from call, cancelling the resolution when nobody
+// is left to receive its answer. Later queries start afresh.
+func (c *coalescer[T]) leave(key cacheKey, call *inflightCall[T]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+	}
+}
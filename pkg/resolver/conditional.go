@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// forwardRule sends every name at or below suffix to its own forwarder.
+type forwardRule struct {
+	suffix    string
+	forwarder *Forwarder
+	hits      atomic.Int64
+}
+
+// ConditionalForwarder picks an upstream pool by domain suffix, so names
+// like corp.internal can go to internal servers while everything else is
+// resolved normally.
+type ConditionalForwarder struct {
+	rules     []*forwardRule
+	timeout   time.Duration
+	exchanger Exchanger
+}
+
+// NewConditionalForwarder creates an empty rule set. Rules added without
+// a timeout of their own give each upstream defaultTimeout to answer, or
+// the default query timeout when that is zero too.
+func NewConditionalForwarder(defaultTimeout time.Duration) *ConditionalForwarder {
+	return &ConditionalForwarder{timeout: defaultTimeout}
+}
+
+// AddRule forwards queries for suffix and its subdomains to servers. A
+// zero timeout uses the rule set's default.
+func (c *ConditionalForwarder) AddRule(suffix string, servers []string, strategy string, timeout, healthInterval time.Duration) {
+	if timeout == 0 {
+		timeout = c.timeout
+	}
+
+	forwarder := NewForwarder(servers, strategy, timeout, healthInterval)
+	if c.exchanger != nil {
+		forwarder.SetExchanger(c.exchanger)
+	}
+	c.rules = append(c.rules, &forwardRule{
+		suffix:    normalizeSuffix(suffix),
+		forwarder: forwarder,
+	})
+}
+
+// SetExchanger replaces how the forwarders of every rule, including ones
+// added later, talk to their upstreams.
+func (c *ConditionalForwarder) SetExchanger(x Exchanger) {
+	c.exchanger = x
+	for _, rule := range c.rules {
+		rule.forwarder.SetExchanger(x)
+	}
+}
+
+// match returns the rule with the longest suffix covering domain, or nil
+// when no rule applies.
+func (c *ConditionalForwarder) match(domain string) *forwardRule {
+	if c == nil {
+		return nil
+	}
+
+	domain = normalizeSuffix(domain)
+
+	var best *forwardRule
+	for _, rule := range c.rules {
+		if !hasSuffix(domain, rule.suffix) {
+			continue
+		}
+		if best == nil || len(rule.suffix) > len(best.suffix) {
+			best = rule
+		}
+	}
+
+	return best
+}
+
+// Hits returns how many queries each rule has handled, keyed by suffix.
+func (c *ConditionalForwarder) Hits() map[string]int64 {
+	if c == nil || len(c.rules) == 0 {
+		return nil
+	}
+
+	hits := make(map[string]int64, len(c.rules))
+	for _, rule := range c.rules {
+		hits[rule.suffix+"."] = rule.hits.Load()
+	}
+	return hits
+}
+
+func (c *ConditionalForwarder) Close() {
+	if c == nil {
+		return
+	}
+	for _, rule := range c.rules {
+		rule.forwarder.Close()
+	}
+}
+
+func normalizeSuffix(name string) string {
+	return protocol.CanonicalName(name)
+}
+
+func hasSuffix(domain, suffix string) bool {
+	if suffix == "" || domain == suffix {
+		return true
+	}
+	return strings.HasSuffix(domain, "."+suffix)
+}
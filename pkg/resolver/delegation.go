@@ -0,0 +1,236 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"context"
+	"errors"
+)
+
+// How many glueless nameserver lookups may nest inside one resolution
+const maxNameserverDepth = 4
+
+var (
+	ErrNoNameservers   = errors.New("no usable nameserver addresses for delegation")
+	ErrNameserverDepth = errors.New("glueless nameserver lookups nested too deeply")
+	ErrBogusReferral   = errors.New("referral does not lead closer to the query name")
+)
+
+// delegation is a referral to the nameservers of a child zone.
+type delegation struct {
+	zone  string
+	hosts []string
+	ns    []protocol.ResourceRecord
+}
+
+// parseDelegation extracts the NS set of a referral. Only NS records owned
+// by the same zone are used, as a referral describes exactly one cut.
+func parseDelegation(response *protocol.Message) *delegation {
+	var d *delegation
+	for _, rr := range response.Authorities {
+		if rr.Type != protocol.TypeNS {
+			continue
+		}
+
+		owner := normalizeSuffix(rr.Name)
+		if d == nil {
+			d = &delegation{zone: owner}
+		} else if owner != d.zone {
+			continue
+		}
+
+		host, err := rr.GetStringData()
+		if err != nil {
+			continue
+		}
+		d.hosts = append(d.hosts, normalizeSuffix(host))
+		d.ns = append(d.ns, rr)
+	}
+	return d
+}
+
+// validFor reports whether the delegation may be followed for domain when
+// received from servers for zone: the cut must lie strictly below zone and
+// at or above domain. Anything else is a lame server or a poisoning
+// attempt.
+func (d *delegation) validFor(domain, zone string) bool {
+	return d.zone != zone && hasSuffix(d.zone, zone) && hasSuffix(domain, d.zone)
+}
+
+// inBailiwick returns a copy of response keeping only records owned by
+// names inside zone, the zone the answering server is authoritative for.
+// A server for example.com has no business telling us about example.net.
+func inBailiwick(response *protocol.Message, zone string) *protocol.Message {
+	if zone == "" {
+		return response
+	}
+
+	filtered := *response
+	filtered.Answers = recordsInZone(response.Answers, zone)
+	filtered.Authorities = recordsInZone(response.Authorities, zone)
+	filtered.Additional = recordsInZone(response.Additional, zone)
+	return &filtered
+}
+
+func recordsInZone(records []protocol.ResourceRecord, zone string) []protocol.ResourceRecord {
+	var kept []protocol.ResourceRecord
+	for _, rr := range records {
+		if rr.Type == protocol.TypeOPT || hasSuffix(normalizeSuffix(rr.Name), zone) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// glueFor returns the address records in additional that belong to the
+// delegation's nameservers. Glue is only believed for hosts inside
+// bailiwick, the zone of the server that sent the referral: anything else
+// is data that server has no authority over.
+func (d *delegation) glueFor(additional []protocol.ResourceRecord, bailiwick string) []protocol.ResourceRecord {
+	var glue []protocol.ResourceRecord
+	for _, rr := range additional {
+		if rr.Type != protocol.TypeA && rr.Type != protocol.TypeAAAA {
+			continue
+		}
+		owner := normalizeSuffix(rr.Name)
+		if d.hasHost(owner) && hasSuffix(owner, bailiwick) {
+			glue = append(glue, rr)
+		}
+	}
+	return glue
+}
+
+func (d *delegation) hasHost(name string) bool {
+	for _, host := range d.hosts {
+		if host == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nameserverAddresses finds addresses for the delegation's nameservers:
+// from glue, then from the cache, then by resolving glueless names
+// ourselves. IPv6 addresses are only used when no IPv4 one is known.
+func (r *IterativeResolver) nameserverAddresses(ctx context.Context, d *delegation, glue []protocol.ResourceRecord, depth int) ([]string, error) {
+	v4, v6 := addressesOf(glue)
+	if len(v4) > 0 {
+		return v4, nil
+	}
+
+	if r.cache != nil {
+		for _, host := range d.hosts {
+			records, found := r.cache.lookupQuiet(host, protocol.TypeA, protocol.ClassIN)
+			if found {
+				cached, _ := addressesOf(records)
+				v4 = append(v4, cached...)
+			}
+		}
+		if len(v4) > 0 {
+			return v4, nil
+		}
+	}
+
+	if depth >= maxNameserverDepth {
+		if len(v6) > 0 {
+			return v6, nil
+		}
+		return nil, ErrNameserverDepth
+	}
+
+	for _, host := range d.hosts {
+		// A nameserver inside the zone it serves can only be reached
+		// through glue; looking it up would ask the zone itself
+		if hasSuffix(host, d.zone) {
+			continue
+		}
+
+		records, err := r.resolve(ctx, host, protocol.TypeA, depth+1)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		if resolved, _ := addressesOf(records); len(resolved) > 0 {
+			return resolved, nil
+		}
+	}
+
+	if len(v6) > 0 {
+		return v6, nil
+	}
+	return nil, ErrNoNameservers
+}
+
+func addressesOf(records []protocol.ResourceRecord) (v4, v6 []string) {
+	for _, rr := range records {
+		data, err := rr.TypedData()
+		if err != nil {
+			continue
+		}
+		switch a := data.(type) {
+		case *protocol.ARecord:
+			v4 = append(v4, a.IP.String())
+		case *protocol.AAAARecord:
+			v6 = append(v6, a.IP.String())
+		}
+	}
+	return v4, v6
+}
+
+// closestCut is where resolution of domain starts: the deepest enclosing
+// zone whose NS set and nameserver addresses are still cached, or the
+// root. A zone's DS RRset is served from the parent side of its cut, so
+// DS queries start above domain.
+func (r *IterativeResolver) closestCut(domain string, recordType uint16) (string, []string) {
+	if r.cache == nil {
+		return "", r.rootServers
+	}
+
+	name := domain
+	if recordType == protocol.TypeDS {
+		name = parentName(name)
+	}
+	for ; name != ""; name = parentName(name) {
+		if addrs := r.cachedNameservers(name); len(addrs) > 0 {
+			return name, addrs
+		}
+	}
+	return "", r.rootServers
+}
+
+// cachedNameservers returns the cached IPv4 addresses of zone's cached
+// nameservers.
+func (r *IterativeResolver) cachedNameservers(zone string) []string {
+	ns, found := r.cache.lookupQuiet(zone, protocol.TypeNS, protocol.ClassIN)
+	if !found {
+		return nil
+	}
+
+	var addrs []string
+	for _, rr := range ns {
+		if rr.Type != protocol.TypeNS {
+			continue
+		}
+		host, err := rr.GetStringData()
+		if err != nil {
+			continue
+		}
+		if records, found := r.cache.lookupQuiet(normalizeSuffix(host), protocol.TypeA, protocol.ClassIN); found {
+			v4, _ := addressesOf(records)
+			addrs = append(addrs, v4...)
+		}
+	}
+	return addrs
+}
+
+// cacheDelegation keeps the NS set and its glue so later queries below
+// the cut can start there.
+func (r *IterativeResolver) cacheDelegation(d *delegation, glue []protocol.ResourceRecord) {
+	if r.cache == nil {
+		return
+	}
+	r.cache.SetRecords(d.ns, models.TrustAuthority)
+	r.cache.SetRecords(glue, models.TrustGlue)
+}
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const dohContentType = "application/dns-message"
+
+// exchangeHTTPS POSTs query to a DNS-over-HTTPS server (RFC 8484). The
+// HTTP client of each endpoint keeps its connections, HTTP/2 where the
+// server offers it, open between queries.
+func (x *networkExchanger) exchangeHTTPS(ctx context.Context, endpoint *Endpoint, query *protocol.Message) (*protocol.Message, error) {
+	queryData, err := protocol.BuildMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.Address, bytes.NewReader(queryData))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := x.httpsClient(endpoint).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: HTTP status %s from %s", ErrInvalidResponse, resp.Status, endpoint)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	response, err := protocol.ParseMessage(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if err := validateResponse(query, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (x *networkExchanger) httpsClient(endpoint *Endpoint) *http.Client {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	key := endpoint.key()
+	if client, ok := x.https[key]; ok {
+		return client
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     endpoint.tlsConfig(),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: maxIdleTLSConns,
+			IdleConnTimeout:     tlsIdleTimeout,
+		},
+	}
+	x.https[key] = client
+	return client
+}
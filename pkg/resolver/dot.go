@@ -0,0 +1,126 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Idle connections kept per DNS-over-TLS server
+	maxIdleTLSConns = 4
+	// Idle connections older than this are closed rather than reused;
+	// servers drop them soon after anyway (RFC 7766 section 6.2.3)
+	tlsIdleTimeout = 30 * time.Second
+)
+
+// exchangeTLS sends query over DNS over TLS (RFC 7858), reusing an idle
+// connection to the same endpoint when there is one.
+func (x *networkExchanger) exchangeTLS(ctx context.Context, endpoint *Endpoint, query *protocol.Message) (*protocol.Message, error) {
+	key := endpoint.key()
+
+	// The server may have closed a pooled connection since it was last
+	// used, so a failure on one is retried on a fresh connection
+	if conn := x.tls.get(key); conn != nil {
+		if response, err := exchangeStream(ctx, conn, query); err == nil {
+			x.tls.put(key, conn)
+			return response, nil
+		}
+		conn.Close()
+	}
+
+	dialer := &tls.Dialer{Config: endpoint.tlsConfig()}
+	conn, err := dialer.DialContext(ctx, "tcp", endpoint.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+
+	response, err := exchangeStream(ctx, conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	x.tls.put(key, conn)
+	return response, nil
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// tlsPool holds idle DNS-over-TLS connections by endpoint key.
+type tlsPool struct {
+	mu     sync.Mutex
+	idle   map[string][]idleConn
+	closed bool
+}
+
+func newTLSPool() *tlsPool {
+	return &tlsPool{idle: make(map[string][]idleConn)}
+}
+
+// get takes the most recently used idle connection for key, or returns nil.
+func (p *tlsPool) get(key string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	last := conns[len(conns)-1]
+	p.idle[key] = conns[:len(conns)-1]
+	return last.conn
+}
+
+// put returns a connection to the pool once its query is answered.
+func (p *tlsPool) put(key string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || len(p.idle[key]) >= maxIdleTLSConns {
+		conn.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleConn{conn: conn, since: time.Now()})
+}
+
+// expire closes connections that have been idle too long.
+func (p *tlsPool) expire() {
+	cutoff := time.Now().Add(-tlsIdleTimeout)
+	for key, conns := range p.idle {
+		kept := conns[:0]
+		for _, c := range conns {
+			if c.since.Before(cutoff) {
+				c.conn.Close()
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.idle, key)
+		} else {
+			p.idle[key] = kept
+		}
+	}
+}
+
+func (p *tlsPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for key, conns := range p.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+		delete(p.idle, key)
+	}
+}
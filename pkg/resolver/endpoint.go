@@ -0,0 +1,164 @@
+package resolver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Upstream transport protocols
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTPS = "https"
+)
+
+var (
+	ErrInvalidEndpoint = errors.New("invalid upstream endpoint")
+	ErrPinMismatch     = errors.New("server key matches no SPKI pin")
+)
+
+// Endpoint says how to reach one upstream server.
+type Endpoint struct {
+	Protocol string
+	// Address is host:port, or the URL of a DNS-over-HTTPS server
+	Address string
+	// ServerName is sent as SNI and checked against the certificate
+	ServerName string
+	// Pins are base64 SHA-256 digests of acceptable SubjectPublicKeyInfos
+	// (RFC 7858 section 4.2). When set, matching one replaces certificate
+	// chain validation.
+	Pins []string
+
+	// opportunistic endpoints encrypt without authenticating the server
+	// (RFC 9539), for authoritative servers that have no name to check
+	opportunistic bool
+}
+
+// ParseEndpoint reads an upstream given as "ip", "ip:port" or a URL whose
+// scheme picks the protocol:
+//
+//	udp://192.0.2.53        plain DNS, over TCP when truncated
+//	tcp://192.0.2.53:5353   plain DNS over TCP
+//	tls://192.0.2.53?sni=dns.example&pin=<base64>
+//	https://dns.example/dns-query?pin=<base64>
+//
+// DNS over TLS defaults to port 853 and to the host as the server name.
+// Pins may be repeated.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	if !strings.Contains(s, "://") {
+		if s == "" {
+			return nil, fmt.Errorf("%w: empty address", ErrInvalidEndpoint)
+		}
+		return &Endpoint{Protocol: ProtocolUDP, Address: withDefaultPort(s, "53")}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: %s has no host", ErrInvalidEndpoint, s)
+	}
+
+	query := u.Query()
+	pins := query["pin"]
+	for _, pin := range pins {
+		if digest, err := base64.StdEncoding.DecodeString(pin); err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("%w: pin %q is not a base64 SHA-256 digest", ErrInvalidEndpoint, pin)
+		}
+	}
+
+	switch u.Scheme {
+	case ProtocolUDP, ProtocolTCP:
+		return &Endpoint{Protocol: u.Scheme, Address: withDefaultPort(u.Host, "53")}, nil
+
+	case ProtocolTLS:
+		serverName := query.Get("sni")
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return &Endpoint{
+			Protocol:   ProtocolTLS,
+			Address:    withDefaultPort(u.Host, "853"),
+			ServerName: serverName,
+			Pins:       pins,
+		}, nil
+
+	case ProtocolHTTPS:
+		// The pins are ours, not part of the server's URL
+		query.Del("pin")
+		u.RawQuery = query.Encode()
+		return &Endpoint{
+			Protocol:   ProtocolHTTPS,
+			Address:    u.String(),
+			ServerName: u.Hostname(),
+			Pins:       pins,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidEndpoint, u.Scheme)
+}
+
+func (e *Endpoint) String() string {
+	switch e.Protocol {
+	case ProtocolUDP:
+		return e.Address
+	case ProtocolHTTPS:
+		return e.Address
+	}
+	return e.Protocol + "://" + e.Address
+}
+
+// key identifies the endpoint's connections: two endpoints with the same
+// key may share them.
+func (e *Endpoint) key() string {
+	return e.String() + "#" + e.ServerName + "#" + strings.Join(e.Pins, ",")
+}
+
+// tlsConfig authenticates the server by its pins if it has any, by its
+// certificate otherwise, or not at all for opportunistic endpoints.
+func (e *Endpoint) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		ServerName: e.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch {
+	case e.opportunistic:
+		config.InsecureSkipVerify = true
+	case len(e.Pins) > 0:
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = e.verifyPins
+	}
+
+	return config
+}
+
+// verifyPins accepts a connection when any certificate the server sent
+// has one of the pinned keys.
+func (e *Endpoint) verifyPins(state tls.ConnectionState) error {
+	for _, cert := range state.PeerCertificates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		spki := base64.StdEncoding.EncodeToString(digest[:])
+		for _, pin := range e.Pins {
+			if pin == spki {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPinMismatch, e)
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
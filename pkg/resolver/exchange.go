@@ -0,0 +1,364 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Random source ports tried before leaving the choice to the kernel
+	sourcePortAttempts = 5
+	// Queries with a fresh case pattern sent to a server whose answers do
+	// not echo it before it is treated as not preserving case
+	caseAttempts = 2
+)
+
+var ErrResponseMismatch = errors.New("response does not match query")
+
+// Exchanger sends one query to an upstream server and returns its answer.
+// Answers that do not match the query are rejected by the caller, so an
+// Exchanger only has to deliver what the server sent. It must give up
+// when ctx ends; ctx's deadline is the time the server has to answer.
+// Implementations other than the network one let the resolver run against
+// fake servers.
+type Exchanger interface {
+	Exchange(ctx context.Context, endpoint *Endpoint, query *protocol.Message) (*protocol.Message, error)
+}
+
+// networkExchanger talks to real servers over the endpoint's protocol.
+// Connections to DNS-over-TLS and DNS-over-HTTPS servers are kept open and
+// reused.
+type networkExchanger struct {
+	tls *tlsPool
+
+	mu    sync.Mutex
+	https map[string]*http.Client
+}
+
+func newNetworkExchanger() *networkExchanger {
+	return &networkExchanger{
+		tls:   newTLSPool(),
+		https: make(map[string]*http.Client),
+	}
+}
+
+func (x *networkExchanger) Exchange(ctx context.Context, endpoint *Endpoint, query *protocol.Message) (*protocol.Message, error) {
+	switch endpoint.Protocol {
+	case ProtocolTCP:
+		return exchangeTCP(ctx, endpoint.Address, query)
+	case ProtocolTLS:
+		return x.exchangeTLS(ctx, endpoint, query)
+	case ProtocolHTTPS:
+		return x.exchangeHTTPS(ctx, endpoint, query)
+	}
+	return exchangeUDP(ctx, endpoint.Address, query)
+}
+
+// close drops the pooled connections.
+func (x *networkExchanger) close() {
+	x.tls.close()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, client := range x.https {
+		client.CloseIdleConnections()
+	}
+}
+
+// queryOptions are the settings of a single queryServer call.
+type queryOptions struct {
+	// timeout is how long each exchange with the server may take, within
+	// whatever is left of the caller's deadline
+	timeout time.Duration
+	// dnssec sets the DO bit, asking for signatures and denial proofs
+	dnssec bool
+}
+
+// queryServer sends a single question to endpoint, falling back to plain
+// DNS for servers that reject EDNS and to TCP when a UDP answer is
+// truncated.
+func queryServer(ctx context.Context, x Exchanger, endpoint *Endpoint, domain string, recordType uint16, opts queryOptions) (*protocol.Message, error) {
+	query := newQuery(domain, recordType, true, opts.dnssec)
+	response, err := exchangeValidated(ctx, x, endpoint, query, opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers that predate EDNS reject the OPT record instead of ignoring it
+	rcode := response.Header.Flags & 0x0F
+	if rcode == protocol.RCodeFormErr || rcode == protocol.RCodeNotImpl {
+		if e, _ := response.EDNS(); e == nil {
+			query = newQuery(domain, recordType, false, false)
+			if response, err = exchangeValidated(ctx, x, endpoint, query, opts.timeout); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if response.Header.Flags&protocol.FlagTC != 0 && endpoint.Protocol == ProtocolUDP {
+		tcp := *endpoint
+		tcp.Protocol = ProtocolTCP
+		return exchangeValidated(ctx, x, &tcp, query, opts.timeout)
+	}
+
+	return response, nil
+}
+
+func exchangeValidated(ctx context.Context, x Exchanger, endpoint *Endpoint, query *protocol.Message, timeout time.Duration) (*protocol.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	response, err := x.Exchange(ctx, endpoint, query)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateResponse(query, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func newQuery(domain string, recordType uint16, edns, dnssec bool) *protocol.Message {
+	query := &protocol.Message{
+		Header: protocol.Header{
+			ID:            randomUint16(),
+			Flags:         0x0100,
+			QuestionCount: 1,
+		},
+		Questions: []protocol.Question{
+			{
+				Name:  domain,
+				Type:  recordType,
+				Class: protocol.ClassIN,
+			},
+		},
+	}
+
+	if edns {
+		e := protocol.NewEDNS(ednsPayloadSize)
+		e.DO = dnssec
+		query.SetEDNS(e)
+	}
+
+	return query
+}
+
+// exchangeUDP sends query from a random source port and waits for the
+// matching answer. Packets from other addresses or with the wrong ID or
+// question are ignored rather than accepted, so an off-path attacker has
+// to guess both the port and the ID before ctx's deadline.
+func exchangeUDP(ctx context.Context, addr string, query *protocol.Message) (*protocol.Message, error) {
+	queryData, err := protocol.BuildMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nameserver address: %w", err)
+	}
+
+	conn, err := listenRandomPort(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open query socket: %w", err)
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	if _, err := conn.WriteToUDP(queryData, server); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	buffer := make([]byte, ednsPayloadSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if !from.IP.Equal(server.IP) || from.Port != server.Port {
+			continue
+		}
+
+		response, err := protocol.ParseMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		if err := validateResponse(query, response); err != nil {
+			continue
+		}
+
+		return response, nil
+	}
+}
+
+// listenRandomPort opens a UDP socket on a randomly chosen port for one
+// query to server.
+func listenRandomPort(server *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if server.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	for i := 0; i < sourcePortAttempts; i++ {
+		port := 1024 + int(randomUint16())%(65536-1024)
+		if conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+
+	return net.ListenUDP(network, nil)
+}
+
+// validateResponse checks that response answers query: same ID, QR set
+// and the same question. Servers rejecting a query outright may leave the
+// question out.
+func validateResponse(query, response *protocol.Message) error {
+	if response.Header.ID != query.Header.ID {
+		return fmt.Errorf("%w: ID %d, want %d", ErrResponseMismatch, response.Header.ID, query.Header.ID)
+	}
+	if response.Header.Flags&protocol.FlagQR == 0 {
+		return fmt.Errorf("%w: not a response", ErrResponseMismatch)
+	}
+
+	rcode := response.Header.Flags & 0x0F
+	if len(response.Questions) == 0 && (rcode == protocol.RCodeFormErr || rcode == protocol.RCodeNotImpl) {
+		return nil
+	}
+
+	if len(response.Questions) != 1 {
+		return fmt.Errorf("%w: %d questions", ErrResponseMismatch, len(response.Questions))
+	}
+	got, want := response.Questions[0], query.Questions[0]
+	if !protocol.EqualNames(got.Name, want.Name) || got.Type != want.Type || got.Class != want.Class {
+		return fmt.Errorf("%w: question %s %s", ErrResponseMismatch, got.Name, protocol.TypeToString(got.Type))
+	}
+
+	return nil
+}
+
+// randomizeCase flips the case of each letter in name at random, the
+// "0x20" encoding. Servers copy the question back byte for byte, so the
+// pattern adds up to one bit per letter that a forged answer has to guess
+// on top of the ID and port.
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	rand.Read(bits)
+
+	mixed := []byte(name)
+	for i, c := range mixed {
+		if bits[i]&1 == 0 {
+			continue
+		}
+		switch {
+		case c >= 'a' && c <= 'z':
+			mixed[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			mixed[i] = c - 'A' + 'a'
+		}
+	}
+	return string(mixed)
+}
+
+// echoesCase reports whether response repeats qname exactly as sent.
+// validateResponse has already matched the name case-insensitively.
+func echoesCase(response *protocol.Message, qname string) bool {
+	if len(response.Questions) == 0 {
+		return true
+	}
+	return strings.TrimSuffix(response.Questions[0].Name, ".") == strings.TrimSuffix(qname, ".")
+}
+
+// restoreCase renames the question, and records owned by the query name,
+// back from the 0x20 pattern to domain so the pattern never reaches the
+// cache or clients.
+func restoreCase(response *protocol.Message, domain string) {
+	for i := range response.Questions {
+		response.Questions[i].Name = domain
+	}
+	for _, section := range [][]protocol.ResourceRecord{response.Answers, response.Authorities, response.Additional} {
+		for i := range section {
+			if section[i].Type != protocol.TypeOPT && protocol.EqualNames(section[i].Name, domain) {
+				section[i].Name = domain
+			}
+		}
+	}
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// exchangeTCP sends a query over a new TCP connection, used for TCP
+// upstreams and when a UDP answer came back truncated.
+func exchangeTCP(ctx context.Context, addr string, query *protocol.Message) (*protocol.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nameserver over TCP: %w", err)
+	}
+	defer conn.Close()
+
+	return exchangeStream(ctx, conn, query)
+}
+
+// exchangeStream sends query over a TCP or TLS connection with the
+// two-byte length prefix of RFC 1035 section 4.2.2 and reads the answer.
+func exchangeStream(ctx context.Context, conn net.Conn, query *protocol.Message) (*protocol.Message, error) {
+	queryData, err := protocol.BuildMessage(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	defer watchContext(ctx, conn)()
+
+	frame := make([]byte, 2, 2+len(queryData))
+	binary.BigEndian.PutUint16(frame, uint16(len(queryData)))
+	frame = append(frame, queryData...)
+
+	if _, err := conn.Write(frame); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+		return nil, fmt.Errorf("failed to read response length: %w", err)
+	}
+
+	buffer := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	response, err := protocol.ParseMessage(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if err := validateResponse(query, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// watchContext applies ctx's deadline to conn and interrupts any read or
+// write on it as soon as ctx is cancelled. The returned function stops
+// watching.
+func watchContext(ctx context.Context, conn net.Conn) func() bool {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
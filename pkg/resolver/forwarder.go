@@ -0,0 +1,277 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyRandom     = "random"
+	StrategyFastest    = "fastest"
+
+	// Consecutive failed queries before an upstream is taken out of rotation
+	maxUpstreamFailures = 3
+)
+
+var ErrNoUpstreams = errors.New("no upstream servers configured")
+
+type upstreamServer struct {
+	endpoint *Endpoint
+	healthy  bool
+	failures int
+	rtt      time.Duration
+}
+
+// Forwarder resolves queries by sending them to a pool of recursive
+// upstream servers instead of walking the hierarchy from the roots.
+type Forwarder struct {
+	servers   []*upstreamServer
+	strategy  string
+	timeout   time.Duration
+	exchanger Exchanger
+	next      atomic.Uint32
+	mu        sync.RWMutex
+
+	// ctx bounds the health probes and ends on Close
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// NewForwarder creates a forwarder for upstreams given as "ip", "ip:port"
+// or an endpoint URL choosing the protocol (see ParseEndpoint); upstreams
+// that do not parse are skipped. Each upstream gets timeout to answer, or
+// the default query timeout when zero. A positive healthInterval starts a
+// background probe that takes dead upstreams out of rotation and brings
+// them back once they answer again.
+func NewForwarder(addrs []string, strategy string, timeout, healthInterval time.Duration) *Forwarder {
+	if timeout <= 0 {
+		timeout = queryTimeout
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	f := &Forwarder{
+		strategy:  strategy,
+		timeout:   timeout,
+		exchanger: newNetworkExchanger(),
+		ctx:       ctx,
+		stop:      stop,
+	}
+
+	for _, addr := range addrs {
+		endpoint, err := ParseEndpoint(addr)
+		if err != nil {
+			log.Printf("Skipping upstream %s: %v", addr, err)
+			continue
+		}
+		f.servers = append(f.servers, &upstreamServer{
+			endpoint: endpoint,
+			healthy:  true,
+		})
+	}
+
+	if healthInterval > 0 && len(f.servers) > 0 {
+		go f.probeLoop(healthInterval)
+	}
+
+	return f
+}
+
+// SetExchanger replaces how the forwarder talks to its upstreams, for
+// example with fake servers in tests.
+func (f *Forwarder) SetExchanger(x Exchanger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.exchanger = x
+}
+
+func (f *Forwarder) currentExchanger() Exchanger {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.exchanger
+}
+
+func (f *Forwarder) Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error) {
+	if len(f.servers) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	var lastErr error
+	for _, server := range f.candidates() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		start := time.Now()
+		response, err := queryServer(ctx, f.currentExchanger(), server.endpoint, domain, recordType, queryOptions{timeout: f.timeout})
+		if err == nil {
+			err = checkRCode(response)
+		}
+		if err != nil && ctx.Err() != nil {
+			// The query ran out of time, which is not the upstream's fault
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			f.recordFailure(server)
+			lastErr = fmt.Errorf("upstream %s: %w", server.endpoint, err)
+			continue
+		}
+
+		f.recordSuccess(server, time.Since(start))
+
+		// Only the answer and the CNAME chain leading to it are passed on,
+		// so an upstream cannot slip unrelated records into the cache
+		answers, _ := extractAnswers(response.Answers, domain, recordType)
+		if response.Header.Flags&0x0F == protocol.RCodeNXDomain || !hasAnswer(answers, recordType) {
+			return answers, negativeResponse(response, answers)
+		}
+		return answers, nil
+	}
+
+	return nil, lastErr
+}
+
+// checkRCode rejects answers that should make us fail over to the next
+// server rather than be relayed to the client: anything but NOERROR and
+// NXDOMAIN.
+func checkRCode(response *protocol.Message) error {
+	switch rcode := response.Header.Flags & 0x0F; rcode {
+	case protocol.RCodeNoError, protocol.RCodeNXDomain:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidResponse, protocol.RCodeToString(rcode))
+	}
+}
+
+// candidates orders the upstreams to try according to the strategy, with
+// unhealthy servers last so they are only used when everything else fails.
+func (f *Forwarder) candidates() []*upstreamServer {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var healthy, unhealthy []*upstreamServer
+	for _, server := range f.servers {
+		if server.healthy {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+
+	switch f.strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case StrategyFastest:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].rtt < healthy[j].rtt
+		})
+	default:
+		if len(healthy) > 0 {
+			start := int(f.next.Add(1)-1) % len(healthy)
+			rotated := make([]*upstreamServer, 0, len(f.servers))
+			rotated = append(rotated, healthy[start:]...)
+			healthy = append(rotated, healthy[:start]...)
+		}
+	}
+
+	return append(healthy, unhealthy...)
+}
+
+func (f *Forwarder) recordSuccess(server *upstreamServer, rtt time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !server.healthy {
+		log.Printf("Upstream %s is back up", server.endpoint)
+	}
+	server.healthy = true
+	server.failures = 0
+
+	// Exponentially weighted so one slow answer does not reorder the pool
+	if server.rtt == 0 {
+		server.rtt = rtt
+	} else {
+		server.rtt = (server.rtt*7 + rtt) / 8
+	}
+}
+
+func (f *Forwarder) recordFailure(server *upstreamServer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	server.failures++
+	if server.healthy && server.failures >= maxUpstreamFailures {
+		log.Printf("Upstream %s marked down after %d failures", server.endpoint, server.failures)
+		server.healthy = false
+	}
+}
+
+func (f *Forwarder) probeLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.probe()
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe asks every upstream for the root NS set, which any working
+// recursive server can answer. Probes still running when the forwarder
+// is closed are abandoned.
+func (f *Forwarder) probe() {
+	var wg sync.WaitGroup
+	for _, server := range f.servers {
+		wg.Add(1)
+		go func(server *upstreamServer) {
+			defer wg.Done()
+
+			start := time.Now()
+			response, err := queryServer(f.ctx, f.currentExchanger(), server.endpoint, "", protocol.TypeNS, queryOptions{timeout: f.timeout})
+			if err == nil {
+				err = checkRCode(response)
+			}
+			if err != nil && f.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				f.markDown(server, err)
+				return
+			}
+			f.recordSuccess(server, time.Since(start))
+		}(server)
+	}
+	wg.Wait()
+}
+
+func (f *Forwarder) markDown(server *upstreamServer, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if server.healthy {
+		log.Printf("Upstream %s failed health check: %v", server.endpoint, err)
+	}
+	server.healthy = false
+	server.failures++
+}
+
+func (f *Forwarder) Close() {
+	f.stop()
+	if network, ok := f.currentExchanger().(*networkExchanger); ok {
+		network.close()
+	}
+}
@@ -0,0 +1,208 @@
+package resolver
+
+import (
+	"container/list"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout for servers we have never heard from
+	initialServerTimeout = 1 * time.Second
+	minServerTimeout     = 200 * time.Millisecond
+	maxServerTimeout     = queryTimeout
+
+	// Unresponsive servers are skipped for backoffBase, doubling with
+	// every further timeout up to maxBackoff
+	backoffBase = 1 * time.Second
+	maxBackoff  = 2 * time.Minute
+
+	// How long a server that failed DNS over TLS is asked in the clear
+	// before TLS is tried again
+	noTLSInterval = 1 * time.Hour
+
+	// How long a server that did not echo a 0x20 query name's case is
+	// sent plain names before randomised case is tried again
+	plainNameInterval = 1 * time.Hour
+
+	// Share of selections that try a random usable server instead of the
+	// fastest, so estimates for the others stay current
+	explorationRate = 0.05
+
+	// Most nameserver addresses tracked at once
+	maxInfraEntries = 10000
+)
+
+// serverInfo is what we know about one nameserver address.
+type serverInfo struct {
+	addr         string
+	srtt         time.Duration
+	rttvar       time.Duration
+	measured     bool
+	timeouts     int
+	backoffUntil time.Time
+	// Until then the server is sent plain names, having answered without
+	// echoing a 0x20 query name's case
+	plainNamesUntil time.Time
+	noTLSUntil      time.Time
+}
+
+// infraCache tracks round-trip times and failures per nameserver IP, the
+// way RFC 6298 tracks a TCP peer, and uses them to pick servers and size
+// timeouts. Servers not heard of for longest are forgotten once
+// maxInfraEntries are tracked.
+type infraCache struct {
+	mu      sync.Mutex
+	servers map[string]*list.Element
+	lru     *list.List
+}
+
+func newInfraCache() *infraCache {
+	return &infraCache{
+		servers: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns what is known about addr, starting afresh for a server not
+// tracked, and marks it recently used. The caller holds the lock.
+func (c *infraCache) get(addr string) *serverInfo {
+	if element, exists := c.servers[addr]; exists {
+		c.lru.MoveToFront(element)
+		return element.Value.(*serverInfo)
+	}
+
+	if c.lru.Len() >= maxInfraEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.servers, oldest.Value.(*serverInfo).addr)
+	}
+	info := &serverInfo{addr: addr}
+	c.servers[addr] = c.lru.PushFront(info)
+	return info
+}
+
+// timeout is how long to wait for addr: the retransmission timeout from
+// its RTT estimate, doubled for each timeout in a row. The floor applies
+// before the doubling, as in RFC 6298, so a fast server that stops
+// answering still backs off.
+func (c *infraCache) timeout(addr string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.get(addr)
+	timeout := initialServerTimeout
+	if info.measured {
+		timeout = max(info.srtt+4*info.rttvar, minServerTimeout)
+	}
+	for i := 0; i < info.timeouts && timeout < maxServerTimeout; i++ {
+		timeout *= 2
+	}
+
+	return min(timeout, maxServerTimeout)
+}
+
+func (c *infraCache) recordRTT(addr string, rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.get(addr)
+	if !info.measured {
+		info.srtt = rtt
+		info.rttvar = rtt / 2
+		info.measured = true
+	} else {
+		diff := info.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		info.rttvar = (3*info.rttvar + diff) / 4
+		info.srtt = (7*info.srtt + rtt) / 8
+	}
+	info.timeouts = 0
+	info.backoffUntil = time.Time{}
+}
+
+func (c *infraCache) recordTimeout(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.get(addr)
+	info.timeouts++
+
+	backoff := backoffBase
+	for i := 1; i < info.timeouts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	info.backoffUntil = time.Now().Add(min(backoff, maxBackoff))
+}
+
+// preservesCase reports whether addr can be sent 0x20-encoded names.
+func (c *infraCache) preservesCase(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.get(addr).plainNamesUntil)
+}
+
+func (c *infraCache) recordCaseMismatch(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(addr).plainNamesUntil = time.Now().Add(plainNameInterval)
+}
+
+// offersTLS reports whether addr is worth trying over DNS over TLS.
+func (c *infraCache) offersTLS(addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.get(addr).noTLSUntil)
+}
+
+func (c *infraCache) recordNoTLS(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(addr).noTLSUntil = time.Now().Add(noTLSInterval)
+}
+
+// order returns addrs in the order they should be tried: usable servers
+// by smoothed RTT, with unmeasured ones first so they get measured, then
+// servers in backoff as a last resort. Occasionally a random usable server
+// is moved to the front.
+func (c *infraCache) order(addrs []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	infos := make(map[string]*serverInfo, len(addrs))
+	var usable, backedOff []string
+	for _, addr := range addrs {
+		infos[addr] = c.get(addr)
+		if now.Before(infos[addr].backoffUntil) {
+			backedOff = append(backedOff, addr)
+		} else {
+			usable = append(usable, addr)
+		}
+	}
+
+	sort.SliceStable(usable, func(i, j int) bool {
+		return infos[usable[i]].estimate() < infos[usable[j]].estimate()
+	})
+	sort.SliceStable(backedOff, func(i, j int) bool {
+		return infos[backedOff[i]].backoffUntil.Before(infos[backedOff[j]].backoffUntil)
+	})
+
+	if len(usable) > 1 && rand.Float64() < explorationRate {
+		i := 1 + rand.Intn(len(usable)-1)
+		usable[0], usable[i] = usable[i], usable[0]
+	}
+
+	return append(usable, backedOff...)
+}
+
+func (info *serverInfo) estimate() time.Duration {
+	if !info.measured {
+		return 0
+	}
+	return info.srtt
+}
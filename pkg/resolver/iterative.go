@@ -3,6 +3,8 @@ package resolver
 import (
 	"DNS-server/data"
 	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -11,195 +13,372 @@ import (
 )
 
 const (
-	maxIterations = 15
-	queryTimeout  = 5 * time.Second
+	maxIterations   = 15
+	queryTimeout    = 5 * time.Second
+	ednsPayloadSize = protocol.DefaultEDNSPayloadSize
 )
 
 var (
 	ErrMaxIterationsExceeded = errors.New("maximum iterations exceeded")
 	ErrNoAnswer              = errors.New("no answer received")
 	ErrInvalidResponse       = errors.New("invalid DNS response")
+	ErrNXDomain              = errors.New("domain does not exist")
 )
 
 type IterativeResolver struct {
-	rootServers []string
-	cache       *DNSCache
+	rootServers  []string
+	cache        *DNSCache
+	infra        *infraCache
+	minimisation string
+	// protocol is how authoritative servers are queried: ProtocolUDP,
+	// ProtocolTCP, or ProtocolTLS where servers offer it
+	protocol  string
+	exchanger Exchanger
+	// hopTimeout caps how long any one nameserver is waited for
+	hopTimeout time.Duration
+	// validator checks answers against the DNSSEC chain of trust; nil
+	// when validation is off
+	validator *validator
 }
 
 func NewIterativeResolver(cache *DNSCache) *IterativeResolver {
 	return &IterativeResolver{
-		rootServers: data.GetRootServers(),
-		cache:       cache,
+		rootServers:  data.GetRootServers(),
+		cache:        cache,
+		infra:        newInfraCache(),
+		minimisation: MinimiseRelaxed,
+		protocol:     ProtocolUDP,
+		exchanger:    newNetworkExchanger(),
+		hopTimeout:   queryTimeout,
 	}
 }
 
-func (r *IterativeResolver) Resolve(domain string, recordType uint16) (string, error) {
-	domain = strings.TrimSuffix(domain, ".")
-	domain = strings.ToLower(domain)
+func (r *IterativeResolver) Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error) {
+	records, _, err := r.resolveValidated(ctx, domain, recordType)
+	return records, err
+}
 
-	if r.cache != nil {
-		if ip, found := r.cache.Get(domain); found {
-			return ip, nil
-		}
+// resolveValidated resolves domain and, with DNSSEC enabled, validates the
+// answer. Bogus answers come back with a *BogusError. Signatures and
+// proofs are kept, for clients that set DO; Resolver strips them for the
+// rest.
+func (r *IterativeResolver) resolveValidated(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, models.Security, error) {
+	records, err := r.resolve(ctx, domain, recordType, 0)
+
+	var negative *NegativeResponse
+	if err != nil && !errors.As(err, &negative) {
+		return nil, models.SecurityIndeterminate, err
+	}
+
+	security := models.SecurityIndeterminate
+	var validationErr error
+	if r.validator != nil {
+		security, validationErr = r.validator.validate(ctx, domain, recordType, records, negative)
+	}
+	// Lookups cut short by ctx make answers look bogus that are not
+	if err := ctx.Err(); err != nil {
+		return nil, models.SecurityIndeterminate, err
 	}
 
-	nameservers := r.rootServers
+	if negative != nil {
+		negative.Security = security
+	}
+
+	if security == models.SecurityBogus {
+		return records, security, &BogusError{Reason: validationErr, Negative: negative}
+	}
+	if negative != nil {
+		return records, security, negative
+	}
+	return records, security, nil
+}
+
+// resolve walks down to an answer from the closest cached zone cut, or
+// from the roots. depth counts how many glueless nameserver lookups this
+// resolution is nested in.
+func (r *IterativeResolver) resolve(ctx context.Context, domain string, recordType uint16, depth int) ([]protocol.ResourceRecord, error) {
+	domain = protocol.CanonicalName(domain)
+
+	var answers []protocol.ResourceRecord
+	// zone is the zone the current nameservers are authoritative for
+	zone, nameservers := r.closestCut(domain, recordType)
 	iteration := 0
 
-	for iteration < maxIterations {
+	// With minimisation the servers for zone are asked about step, one
+	// label below the deepest cut found so far, until step reaches domain
+	minimising := r.minimisation != MinimiseOff
+	step := childName(domain, zone)
+	minimised := 0
+
+	for iteration < maxIterations+maxMinimisedQueries {
 		iteration++
 
-		response, err := r.queryNameserver(nameservers[0], domain, recordType)
+		if minimised >= maxMinimisedQueries {
+			minimising = false
+		}
+		name, qtype := domain, recordType
+		if minimising && step != domain {
+			// A rather than NS: some servers mishandle NS queries below a
+			// cut they are not authoritative for (RFC 9156 section 3)
+			name, qtype = step, protocol.TypeA
+			minimised++
+		}
+
+		response, err := r.queryBest(ctx, nameservers, name, qtype)
 		if err != nil {
-			if len(nameservers) > 1 {
-				nameservers = nameservers[1:]
-				continue
+			return nil, fmt.Errorf("failed to query nameserver: %w", err)
+		}
+		filtered := inBailiwick(response, zone)
+		if len(filtered.Answers) == 0 && len(response.Answers) > 0 {
+			return nil, fmt.Errorf("%w: answers outside %s", ErrInvalidResponse, fqdnOrRoot(zone))
+		}
+		response = filtered
+
+		if name != domain && !isReferral(response) {
+			rcode := response.Header.Flags & 0x0F
+			switch {
+			case rcode == protocol.RCodeNoError:
+				// Answer or NODATA: no cut at step, reveal one more label
+				step = childName(domain, step)
+			case r.minimisation == MinimiseRelaxed:
+				minimising = false
+			case rcode == protocol.RCodeNXDomain:
+				return answers, negativeResponse(response, answers)
+			default:
+				return nil, fmt.Errorf("%w: %s for %s", ErrInvalidResponse, protocol.RCodeToString(rcode), name)
 			}
-			return "", fmt.Errorf("failed to query nameserver: %w", err)
+			continue
+		}
+
+		if err := checkRCode(response); err != nil {
+			return nil, fmt.Errorf("servers for %s: %w", fqdnOrRoot(zone), err)
+		}
+
+		if response.Header.Flags&0x0F == protocol.RCodeNXDomain {
+			return answers, negativeResponse(response, answers)
 		}
 
 		if len(response.Answers) > 0 {
-			for _, answer := range response.Answers {
-				if answer.Type == protocol.TypeA {
-					ip, err := answer.GetStringData()
-					if err != nil {
-						continue
-					}
-					if r.cache != nil {
-						r.cache.Set(domain, ip, time.Duration(answer.TTL)*time.Second)
-					}
-					return ip, nil
-				} else if answer.Type == protocol.TypeCNAME {
-					cname, err := answer.GetStringData()
-					if err != nil {
-						continue
-					}
-					domain = cname
-					nameservers = r.rootServers
-					break
-				}
+			records, target := extractAnswers(response.Answers, domain, recordType)
+			answers = append(answers, records...)
+			// Wildcard answers come with proof that no closer name exists
+			answers = append(answers, denialRecords(response.Authorities)...)
+
+			if target == "" {
+				return answers, nil
 			}
+
+			domain = protocol.CanonicalName(target)
+			zone, nameservers = r.closestCut(domain, recordType)
+			minimising = r.minimisation != MinimiseOff
+			step = childName(domain, zone)
+			continue
 		}
 
-		if len(response.Authorities) > 0 {
-			newNameservers := make([]string, 0)
-			for _, auth := range response.Authorities {
-				if auth.Type == protocol.TypeNS {
-					nsName, err := auth.GetStringData()
-					if err != nil {
-						continue
-					}
-					nsIP, err := r.resolveNameserver(nsName)
-					if err == nil {
-						newNameservers = append(newNameservers, nsIP)
-					}
-				}
-			}
+		if !isReferral(response) {
+			// NOERROR without answers or a delegation is a NODATA response
+			return answers, negativeResponse(response, answers)
+		}
 
-			if len(newNameservers) > 0 {
-				nameservers = newNameservers
-				continue
-			}
+		cut := parseDelegation(response)
+		if !cut.validFor(name, zone) {
+			return nil, fmt.Errorf("%w: %s from servers for %s", ErrBogusReferral, cut.zone, fqdnOrRoot(zone))
 		}
+		glue := cut.glueFor(response.Additional, zone)
+		r.cacheDelegation(cut, glue)
 
-		if len(response.Additional) > 0 {
-			newNameservers := make([]string, 0)
-			for _, add := range response.Additional {
-				if add.Type == protocol.TypeA {
-					ip, err := add.GetStringData()
-					if err != nil {
-						continue
-					}
-					newNameservers = append(newNameservers, ip)
-				}
-			}
+		addrs, err := r.nameserverAddresses(ctx, cut, glue, depth)
+		if err != nil {
+			return nil, fmt.Errorf("delegation to %s: %w", cut.zone, err)
+		}
+		nameservers = addrs
+		zone = cut.zone
+		step = childName(domain, zone)
+	}
+
+	return nil, ErrMaxIterationsExceeded
+}
+
+// extractAnswers collects the records answering name/recordType from an
+// answer section, following any CNAME chain contained in it. If the chain
+// leaves the section unanswered, the last CNAME target is returned so the
+// caller can continue resolving it.
+func extractAnswers(section []protocol.ResourceRecord, name string, recordType uint16) ([]protocol.ResourceRecord, string) {
+	var records []protocol.ResourceRecord
+	followed := false
+
+	for hops := 0; hops < maxIterations; hops++ {
+		var cname *protocol.ResourceRecord
+		var sigs []protocol.ResourceRecord
+		matched := false
 
-			if len(newNameservers) > 0 {
-				nameservers = newNameservers
+		for i := range section {
+			rr := section[i]
+			if !protocol.EqualNames(rr.Name, name) {
 				continue
 			}
+			if rr.Type == recordType {
+				records = append(records, rr)
+				matched = true
+			} else if rr.Type == protocol.TypeCNAME && cname == nil {
+				cname = &section[i]
+			} else if rr.Type == protocol.TypeRRSIG {
+				sigs = append(sigs, rr)
+			}
 		}
 
-		return "", ErrNoAnswer
+		if matched {
+			records = append(records, signaturesCovering(sigs, recordType)...)
+		}
+		if matched || cname == nil {
+			if !matched && followed {
+				return records, name
+			}
+			return records, ""
+		}
+
+		target, err := cname.GetStringData()
+		if err != nil {
+			return records, ""
+		}
+		records = append(records, *cname)
+		records = append(records, signaturesCovering(sigs, protocol.TypeCNAME)...)
+		name = strings.TrimSuffix(target, ".")
+		followed = true
 	}
 
-	return "", ErrMaxIterationsExceeded
+	return records, ""
 }
 
-func (r *IterativeResolver) queryNameserver(nameserver, domain string, recordType uint16) (*protocol.Message, error) {
-	query := &protocol.Message{
-		Header: protocol.Header{
-			ID:            uint16(time.Now().Unix() & 0xFFFF),
-			Flags:         0x0100,
-			QuestionCount: 1,
-		},
-		Questions: []protocol.Question{
-			{
-				Name:  domain,
-				Type:  recordType,
-				Class: protocol.ClassIN,
-			},
-		},
-	}
-
-	queryData, err := protocol.BuildMessage(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build query: %w", err)
+func signaturesCovering(sigs []protocol.ResourceRecord, rrType uint16) []protocol.ResourceRecord {
+	var covering []protocol.ResourceRecord
+	for _, rr := range sigs {
+		data, err := rr.TypedData()
+		if err != nil {
+			continue
+		}
+		if sig, ok := data.(*protocol.RRSIGRecord); ok && sig.TypeCovered == rrType {
+			covering = append(covering, rr)
+		}
 	}
+	return covering
+}
 
-	conn, err := net.DialTimeout("udp", nameserver+":53", queryTimeout)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to nameserver: %w", err)
+// isReferral reports whether a response without answers delegates to
+// another zone. Authoritative answers may list the zone's own NS records
+// in the authority section, which does not make them referrals.
+func isReferral(response *protocol.Message) bool {
+	if response.Header.Flags&protocol.FlagAA != 0 {
+		return false
 	}
-	defer conn.Close()
-
-	conn.SetDeadline(time.Now().Add(queryTimeout))
-
-	_, err = conn.Write(queryData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send query: %w", err)
+	for _, auth := range response.Authorities {
+		if auth.Type == protocol.TypeNS {
+			return true
+		}
 	}
+	return false
+}
 
-	buffer := make([]byte, 512)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+// queryBest asks the nameservers of a zone in the order the infrastructure
+// cache ranks them until one answers. Lame or broken servers answer
+// REFUSED or SERVFAIL, so such answers only count when no server for the
+// zone did better. Once ctx ends no further server is tried.
+func (r *IterativeResolver) queryBest(ctx context.Context, nameservers []string, domain string, recordType uint16) (*protocol.Message, error) {
+	var lastErr error
+	var failed *protocol.Message
+	for _, nameserver := range r.infra.order(nameservers) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		response, err := r.queryNameserver(ctx, nameserver, domain, recordType)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if checkRCode(response) != nil {
+			failed = response
+			continue
+		}
+		return response, nil
+	}
+	if failed != nil {
+		return failed, nil
 	}
+	return nil, lastErr
+}
 
-	response, err := protocol.ParseMessage(buffer[:n])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+// queryNameserver sends one query with the name's case randomised and
+// insists the answer echoes it. Servers that keep failing to do so are
+// remembered and asked with plain names instead.
+func (r *IterativeResolver) queryNameserver(ctx context.Context, nameserver, domain string, recordType uint16) (*protocol.Message, error) {
+	if r.infra.preservesCase(nameserver) {
+		for attempt := 0; attempt < caseAttempts; attempt++ {
+			qname := randomizeCase(domain)
+			response, err := r.exchange(ctx, nameserver, qname, recordType)
+			if err != nil {
+				return nil, err
+			}
+			if echoesCase(response, qname) {
+				restoreCase(response, domain)
+				return response, nil
+			}
+		}
+		r.infra.recordCaseMismatch(nameserver)
 	}
 
-	return response, nil
+	return r.exchange(ctx, nameserver, domain, recordType)
 }
 
-func (r *IterativeResolver) resolveNameserver(nsName string) (string, error) {
-	if r.cache != nil {
-		if ip, found := r.cache.Get(nsName); found {
-			return ip, nil
-		}
+// exchange sends one query, sizing the timeout from what we know about the
+// server and feeding the outcome back into that knowledge. Failures
+// caused by ctx ending are not held against the server.
+func (r *IterativeResolver) exchange(ctx context.Context, nameserver, domain string, recordType uint16) (*protocol.Message, error) {
+	opts := queryOptions{
+		timeout: min(r.infra.timeout(nameserver), r.hopTimeout),
+		dnssec:  r.validator != nil,
 	}
 
-	ips, err := net.LookupIP(nsName)
+	start := time.Now()
+	endpoint := r.endpoint(nameserver)
+	response, err := queryServer(ctx, r.exchanger, endpoint, domain, recordType, opts)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil && endpoint.opportunistic {
+		// Few authoritative servers speak DNS over TLS yet (RFC 9539)
+		r.infra.recordNoTLS(nameserver)
+		start = time.Now()
+		endpoint = &Endpoint{Protocol: ProtocolUDP, Address: net.JoinHostPort(nameserver, "53")}
+		response, err = queryServer(ctx, r.exchanger, endpoint, domain, recordType, opts)
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		return "", err
+		r.infra.recordTimeout(nameserver)
+		return nil, err
 	}
 
-	if len(ips) == 0 {
-		return "", errors.New("no IP addresses found")
-	}
+	r.infra.recordRTT(nameserver, time.Since(start))
+	return response, nil
+}
 
-	for _, ip := range ips {
-		if ip.To4() != nil {
-			ipStr := ip.String()
-			if r.cache != nil {
-				r.cache.Set(nsName, ipStr, 5*time.Minute)
-			}
-			return ipStr, nil
-		}
+// endpoint is how to reach nameserver with the configured protocol. DNS
+// over TLS to authoritative servers is opportunistic: there is no name to
+// authenticate them by, and servers without it are asked in the clear.
+func (r *IterativeResolver) endpoint(nameserver string) *Endpoint {
+	switch {
+	case r.protocol == ProtocolTCP:
+		return &Endpoint{Protocol: ProtocolTCP, Address: net.JoinHostPort(nameserver, "53")}
+	case r.protocol == ProtocolTLS && r.infra.offersTLS(nameserver):
+		return &Endpoint{Protocol: ProtocolTLS, Address: net.JoinHostPort(nameserver, "853"), opportunistic: true}
 	}
-
-	return "", errors.New("no IPv4 address found")
+	return &Endpoint{Protocol: ProtocolUDP, Address: net.JoinHostPort(nameserver, "53")}
 }
 
+func fqdnOrRoot(zone string) string {
+	if zone == "" {
+		return "."
+	}
+	return zone + "."
+}
@@ -0,0 +1,35 @@
+package resolver
+
+import "strings"
+
+// QNAME minimisation modes (RFC 9156)
+const (
+	// Send the full query name to every server
+	MinimiseOff = "off"
+	// Minimise, but retry with the full name when a server answers a
+	// minimised query with NXDOMAIN or an error, as some get empty
+	// non-terminals wrong
+	MinimiseRelaxed = "relaxed"
+	// Minimise and believe every answer: NXDOMAIN for an ancestor means the
+	// query name does not exist (RFC 8020)
+	MinimiseStrict = "strict"
+)
+
+// Most minimised queries sent in one resolution. Names with more labels
+// than this reveal the rest in the last query.
+const maxMinimisedQueries = 10
+
+// childName returns the name one label below zone on the way to domain,
+// which is what a minimising resolver asks the servers for zone about.
+// zone must be domain or one of its ancestors.
+func childName(domain, zone string) string {
+	if domain == zone {
+		return domain
+	}
+
+	rest := domain
+	if zone != "" {
+		rest = strings.TrimSuffix(domain, "."+zone)
+	}
+	return domain[strings.LastIndex(rest, ".")+1:]
+}
@@ -0,0 +1,123 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"errors"
+	"time"
+)
+
+var ErrNoData = errors.New("no records of the requested type")
+
+// NegativeResponse reports an NXDOMAIN or NODATA answer together with the
+// SOA record from the authority section, which bounds how long the answer
+// may be cached (RFC 2308). It matches ErrNXDomain or ErrNoData with
+// errors.Is.
+type NegativeResponse struct {
+	NXDomain bool
+	// Answers holds the CNAME chain, if any, that led to the negative answer
+	Answers []protocol.ResourceRecord
+	SOA     *protocol.ResourceRecord
+	// Proof holds the NSEC or NSEC3 records and signatures from the
+	// authority section that deny the name or type (RFC 4035 section 3.1.3)
+	Proof []protocol.ResourceRecord
+	// Security is the DNSSEC status of the denial
+	Security models.Security
+}
+
+func (e *NegativeResponse) Error() string {
+	if e.NXDomain {
+		return ErrNXDomain.Error()
+	}
+	return ErrNoData.Error()
+}
+
+func (e *NegativeResponse) Is(target error) bool {
+	if e.NXDomain {
+		return target == ErrNXDomain
+	}
+	return target == ErrNoData
+}
+
+// negativeResponse builds a NegativeResponse from an upstream answer,
+// keeping the answers gathered while following CNAMEs.
+func negativeResponse(response *protocol.Message, answers []protocol.ResourceRecord) *NegativeResponse {
+	negative := &NegativeResponse{
+		NXDomain: response.Header.Flags&0x0F == protocol.RCodeNXDomain,
+		Answers:  answers,
+		Proof:    denialRecords(response.Authorities),
+	}
+
+	for _, rr := range response.Authorities {
+		if rr.Type == protocol.TypeSOA {
+			soa := rr
+			negative.SOA = &soa
+			break
+		}
+	}
+
+	return negative
+}
+
+// denialRecords returns the NSEC and NSEC3 records of an authority
+// section along with every signature there, which covers the SOA and the
+// denial records.
+func denialRecords(section []protocol.ResourceRecord) []protocol.ResourceRecord {
+	var proof []protocol.ResourceRecord
+	for _, rr := range section {
+		switch rr.Type {
+		case protocol.TypeNSEC, protocol.TypeNSEC3, protocol.TypeRRSIG:
+			proof = append(proof, rr)
+		}
+	}
+	return proof
+}
+
+// ttl is how long the answer may be cached: the smaller of the SOA's own
+// TTL and its MINIMUM field. Answers without an SOA are not cached.
+func (e *NegativeResponse) ttl() (time.Duration, bool) {
+	if e.SOA == nil {
+		return 0, false
+	}
+
+	ttl := e.SOA.TTL
+	if data, err := e.SOA.TypedData(); err == nil {
+		if soa, ok := data.(*protocol.SOARecord); ok && soa.Minimum < ttl {
+			ttl = soa.Minimum
+		}
+	}
+
+	return time.Duration(ttl) * time.Second, true
+}
+
+// withTTL returns a copy whose SOA TTL is lowered to the remaining cache
+// lifetime, so replayed answers age like they would downstream.
+func (e *NegativeResponse) withTTL(remaining time.Duration) *NegativeResponse {
+	negative := *e
+	if e.SOA != nil {
+		soa := *e.SOA
+		soa.TTL = uint32(remaining / time.Second)
+		negative.SOA = &soa
+	}
+	return &negative
+}
+
+// withoutDNSSEC returns a copy without the proof and without the
+// signatures on the CNAME chain, for clients that did not set DO.
+func (e *NegativeResponse) withoutDNSSEC(qtype uint16) *NegativeResponse {
+	negative := *e
+	negative.Answers = withoutDNSSEC(e.Answers, qtype)
+	negative.Proof = nil
+	return &negative
+}
+
+// hasAnswer reports whether answers contains a record of recordType, which
+// separates a real answer from a CNAME chain ending in NODATA.
+func hasAnswer(answers []protocol.ResourceRecord, recordType uint16) bool {
+	for _, rr := range answers {
+		if rr.Type == recordType || recordType == protocol.TypeANY {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package resolver
+
+import "sync/atomic"
+
+// prefetcher runs background re-resolutions of popular cache entries,
+// never more than its slot count at once.
+type prefetcher struct {
+	slots   chan struct{}
+	started atomic.Int64
+	dropped atomic.Int64
+}
+
+func newPrefetcher(maxConcurrent int) *prefetcher {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &prefetcher{slots: make(chan struct{}, maxConcurrent)}
+}
+
+// start runs refresh in the background if a slot is free and reports
+// whether it did. Busy slots drop the prefetch: the entry is still served
+// and is refreshed on expiry.
+func (p *prefetcher) start(refresh func()) bool {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+
+	p.started.Add(1)
+	go func() {
+		defer func() { <-p.slots }()
+		refresh()
+	}()
+	return true
+}
@@ -3,19 +3,43 @@ package resolver
 import (
 	"DNS-server/internal/protocol"
 	"DNS-server/models"
+	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
+// How long one query may spend resolving, every upstream exchange and
+// nested lookup included, unless SetTimeouts says otherwise
+const defaultResolutionTimeout = 10 * time.Second
+
 var (
 	ErrResolutionFailed = errors.New("DNS resolution failed")
 	ErrInvalidDomain    = errors.New("invalid domain name")
 )
 
+// Upstream answers the queries the resolver cannot serve from its cache,
+// either by walking the hierarchy or by forwarding.
+type Upstream interface {
+	Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error)
+}
+
 type Resolver struct {
-	cache              *DNSCache
-	iterativeResolver  *IterativeResolver
-	mu                 sync.RWMutex
+	cache       *DNSCache
+	upstream    Upstream
+	forwarder   *Forwarder
+	conditional *ConditionalForwarder
+	prefetcher  *prefetcher
+	coalescer   *coalescer[resolved]
+	mu          sync.RWMutex
+
+	// timeout is the budget of each resolution
+	timeout time.Duration
+	// ctx bounds background work, prefetches and stale refreshes, which
+	// no client waits for; it ends when the resolver is closed
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 var (
@@ -26,53 +50,425 @@ var (
 func GetInstance() *Resolver {
 	once.Do(func() {
 		cache := NewDNSCache(models.DefaultCacheConfig())
-		instance = &Resolver{
-			cache:             cache,
-			iterativeResolver: NewIterativeResolver(cache),
-		}
+		instance = newResolver(cache, NewIterativeResolver(cache))
 	})
 	return instance
 }
 
 func NewResolver(config *models.CacheConfig) *Resolver {
 	cache := NewDNSCache(config)
+	return newResolver(cache, NewIterativeResolver(cache))
+}
+
+// NewForwardingResolver creates a resolver that sends cache misses to the
+// forwarder's upstream pool instead of resolving iteratively.
+func NewForwardingResolver(config *models.CacheConfig, forwarder *Forwarder) *Resolver {
+	r := newResolver(NewDNSCache(config), forwarder)
+	r.forwarder = forwarder
+	return r
+}
+
+// NewResolverWithUpstream creates a resolver that sends cache misses to
+// any Upstream implementation.
+func NewResolverWithUpstream(config *models.CacheConfig, upstream Upstream) *Resolver {
+	return newResolver(NewDNSCache(config), upstream)
+}
+
+func newResolver(cache *DNSCache, upstream Upstream) *Resolver {
+	ctx, stop := context.WithCancel(context.Background())
 	return &Resolver{
-		cache:             cache,
-		iterativeResolver: NewIterativeResolver(cache),
+		cache:      cache,
+		upstream:   upstream,
+		prefetcher: newPrefetcher(cache.config.MaxConcurrentPrefetches),
+		coalescer:  newCoalescer[resolved](cache.config.MaxCoalescedWaiters),
+		timeout:    defaultResolutionTimeout,
+		ctx:        ctx,
+		stop:       stop,
+	}
+}
+
+// SetConditionalForwarder installs suffix rules that take precedence over
+// the default upstream. It must be called before the resolver is used.
+func (r *Resolver) SetConditionalForwarder(c *ConditionalForwarder) {
+	r.conditional = c
+}
+
+// SetQNAMEMinimisation selects how much of each query name iterative
+// resolution reveals to servers above the name's zone: MinimiseOff,
+// MinimiseRelaxed or MinimiseStrict. Forwarding resolvers ignore it. It
+// must be called before the resolver is used.
+func (r *Resolver) SetQNAMEMinimisation(mode string) {
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		iterative.minimisation = mode
+	}
+}
+
+// SetIterativeProtocol selects how iterative resolution queries
+// authoritative servers: ProtocolUDP, ProtocolTCP, or ProtocolTLS to
+// encrypt queries to servers that accept DNS over TLS. Forwarding resolvers
+// ignore it. It must be called before the resolver is used.
+func (r *Resolver) SetIterativeProtocol(protocol string) {
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		iterative.protocol = protocol
+	}
+}
+
+// SetExchanger replaces how iterative resolution talks to nameservers,
+// for example with an in-memory hierarchy in tests. Forwarding resolvers
+// ignore it. It must be called before the resolver is used.
+func (r *Resolver) SetExchanger(x Exchanger) {
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		iterative.exchanger = x
+	}
+}
+
+// SetRootServers replaces the root server addresses iterative resolution
+// starts from. Forwarding resolvers ignore it. It must be called before
+// the resolver is used.
+func (r *Resolver) SetRootServers(addrs []string) {
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		iterative.rootServers = addrs
+	}
+}
+
+// SetTimeouts bounds how long a query may take to resolve in total, and
+// how long iterative resolution waits for any one nameserver. Forwarders
+// take their per-upstream timeout when they are created. Zero keeps the
+// default. It must be called before the resolver is used.
+func (r *Resolver) SetTimeouts(query, hop time.Duration) {
+	if query > 0 {
+		r.timeout = query
+	}
+	if iterative, ok := r.upstream.(*IterativeResolver); ok && hop > 0 {
+		iterative.hopTimeout = hop
+	}
+}
+
+// EnableDNSSEC turns on validation of iteratively resolved answers against
+// the given trust anchors, DS records for the root zone. Forwarding
+// resolvers ignore it. It must be called before the resolver is used.
+func (r *Resolver) EnableDNSSEC(anchors []*protocol.DSRecord) {
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		iterative.validator = newValidator(iterative, anchors)
+	}
+}
+
+// Resolve answers domain/recordType from the cache or upstream. The work
+// stops when ctx ends or the resolution budget runs out, whichever comes
+// first.
+func (r *Resolver) Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error) {
+	records, _, err := r.ResolveSecure(ctx, domain, recordType, false)
+	return records, err
+}
+
+// ResolveSecure is Resolve that also reports the DNSSEC status of the
+// answer. Answers that fail validation are returned as a *BogusError,
+// unless checkingDisabled (the client's CD flag) asks for them anyway.
+// Signatures and denial proofs fetched for validation are left out.
+func (r *Resolver) ResolveSecure(ctx context.Context, domain string, recordType uint16, checkingDisabled bool) ([]protocol.ResourceRecord, models.Security, error) {
+	records, security, err := r.ResolveSigned(ctx, domain, recordType, checkingDisabled)
+
+	var (
+		bogus    *BogusError
+		negative *NegativeResponse
+	)
+	switch {
+	case errors.As(err, &bogus):
+		if bogus.Negative != nil {
+			err = &BogusError{Reason: bogus.Reason, Negative: bogus.Negative.withoutDNSSEC(recordType)}
+		}
+	case errors.As(err, &negative):
+		err = negative.withoutDNSSEC(recordType)
+	}
+	return withoutDNSSEC(records, recordType), security, err
+}
+
+// ResolveSigned is ResolveSecure for clients that set DO: the RRSIG
+// records covering the answer are kept, and negative answers carry their
+// NSEC or NSEC3 proof (RFC 4035 section 3.2.1).
+func (r *Resolver) ResolveSigned(ctx context.Context, domain string, recordType uint16, checkingDisabled bool) ([]protocol.ResourceRecord, models.Security, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	records, security, err := r.resolve(ctx, domain, recordType)
+
+	var bogus *BogusError
+	if checkingDisabled && errors.As(err, &bogus) {
+		if bogus.Negative != nil {
+			return bogus.Negative.Answers, security, bogus.Negative
+		}
+		return records, security, nil
 	}
+	return records, security, err
 }
 
-func (r *Resolver) Resolve(domain string, recordType uint16) (string, error) {
+// ResolveCached answers domain/recordType from the cache alone, the way
+// RFC 1034 section 4.3.2 answers a query that does not ask for recursion.
+// A cached denial comes back as a *NegativeResponse. On a miss there are
+// no records, and referral holds the NS set of the closest enclosing zone
+// cut still cached, if any.
+func (r *Resolver) ResolveCached(domain string, recordType uint16) (records, referral []protocol.ResourceRecord, err error) {
 	if domain == "" {
-		return "", ErrInvalidDomain
+		return nil, nil, ErrInvalidDomain
+	}
+
+	if records, _, found := r.cache.lookupAnswer(domain, recordType, protocol.ClassIN); found {
+		return withoutDNSSEC(records, recordType), nil, nil
+	}
+	if negative, found := r.cache.GetNegative(domain, recordType, protocol.ClassIN); found {
+		return nil, nil, negative.withoutDNSSEC(recordType)
+	}
+
+	for name := protocol.CanonicalName(domain); ; name = parentName(name) {
+		if ns, found := r.cache.lookupQuiet(name, protocol.TypeNS, protocol.ClassIN); found {
+			return nil, withoutDNSSEC(ns, protocol.TypeNS), nil
+		}
+		if name == "" {
+			return nil, nil, nil
+		}
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, models.Security, error) {
+	if domain == "" {
+		return nil, models.SecurityIndeterminate, ErrInvalidDomain
+	}
+
+	if records, security, found := r.cache.lookupAnswer(domain, recordType, protocol.ClassIN); found {
+		if r.cache.prefetchDue(domain, recordType, protocol.ClassIN) {
+			upstream, _ := r.upstreamFor(domain)
+			started := r.prefetcher.start(func() {
+				ctx, cancel := r.backgroundContext()
+				defer cancel()
+				if _, _, err := r.resolveFresh(ctx, upstream, domain, recordType); err != nil {
+					// A successful refresh replaces the entry and clears the
+					// claim; a failed one has to give it up so a later hit
+					// can try again
+					r.cache.releasePrefetch(domain, recordType, protocol.ClassIN)
+				}
+			})
+			if !started {
+				r.cache.releasePrefetch(domain, recordType, protocol.ClassIN)
+			}
+		}
+		return records, security, nil
+	}
+
+	if negative, found := r.cache.GetNegative(domain, recordType, protocol.ClassIN); found {
+		return negative.Answers, negative.Security, negative
+	}
+
+	// Upstreams that just failed are left alone while the entry is
+	// rechecked in the background
+	if r.cache.failedRecently(domain, recordType, protocol.ClassIN) {
+		if records, found := r.cache.LookupStale(domain, recordType, protocol.ClassIN); found {
+			return records, models.SecurityIndeterminate, nil
+		}
+	}
+
+	upstream, rule := r.upstreamFor(domain)
+	if rule != nil {
+		rule.hits.Add(1)
+	}
+
+	timeout := r.cache.config.StaleClientTimeout
+	if r.cache.config.StaleWindow <= 0 || timeout <= 0 {
+		records, security, err := r.resolveFresh(ctx, upstream, domain, recordType)
+		return r.staleOnFailure(upstream, domain, recordType, records, security, err)
+	}
+
+	done := make(chan upstreamResult, 1)
+	go func() {
+		records, security, err := r.resolveFresh(ctx, upstream, domain, recordType)
+		done <- upstreamResult{records, security, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return r.staleOnFailure(upstream, domain, recordType, result.records, result.security, result.err)
+	case <-timer.C:
+		if records, found := r.cache.LookupStale(domain, recordType, protocol.ClassIN); found {
+			// The resolution keeps running after the client is answered,
+			// so the stale entry is refreshed
+			r.refreshInBackground(upstream, domain, recordType)
+			return records, models.SecurityIndeterminate, nil
+		}
+		result := <-done
+		return r.staleOnFailure(upstream, domain, recordType, result.records, result.security, result.err)
+	}
+}
+
+// upstreamFor picks the conditional forwarding rule covering domain, or
+// the default upstream when there is none.
+func (r *Resolver) upstreamFor(domain string) (Upstream, *forwardRule) {
+	if rule := r.conditional.match(domain); rule != nil {
+		return rule.forwarder, rule
+	}
+	return r.upstream, nil
+}
+
+type upstreamResult struct {
+	records  []protocol.ResourceRecord
+	security models.Security
+	err      error
+}
+
+// resolved is what one upstream resolution hands to every query sharing it.
+type resolved struct {
+	records  []protocol.ResourceRecord
+	security models.Security
+}
+
+// validatingUpstream is an Upstream that checks DNSSEC itself and reports
+// the status of each answer.
+type validatingUpstream interface {
+	resolveValidated(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, models.Security, error)
+}
+
+// resolveFresh asks upstream and caches the outcome, positive or negative.
+// Concurrent calls for the same question share one upstream resolution.
+func (r *Resolver) resolveFresh(ctx context.Context, upstream Upstream, domain string, recordType uint16) ([]protocol.ResourceRecord, models.Security, error) {
+	key := newCacheKey(domain, recordType, protocol.ClassIN)
+	result, err := r.coalescer.do(ctx, key, r.resolution(upstream, domain, recordType))
+	// Each caller gets its own slice to modify
+	return append([]protocol.ResourceRecord(nil), result.records...), result.security, err
+}
+
+// refreshInBackground keeps the resolution of domain/recordType going on
+// the resolver's own budget, so it survives the client that started it.
+func (r *Resolver) refreshInBackground(upstream Upstream, domain string, recordType uint16) {
+	ctx, cancel := r.backgroundContext()
+	key := newCacheKey(domain, recordType, protocol.ClassIN)
+
+	// Joining before returning keeps the resolution alive when the client
+	// stops waiting for it
+	call, err := r.coalescer.join(ctx, key, r.resolution(upstream, domain, recordType))
+	if err != nil {
+		cancel()
+		return
+	}
+	go func() {
+		defer cancel()
+		r.coalescer.wait(ctx, key, call)
+	}()
+}
+
+// recheckLater refreshes a stale entry in the background once its failure
+// recheck interval is over, rather than waiting for a client to ask.
+func (r *Resolver) recheckLater(upstream Upstream, domain string, recordType uint16) {
+	time.AfterFunc(r.cache.config.StaleRecheckInterval, func() {
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.refreshInBackground(upstream, domain, recordType)
+	})
+}
+
+func (r *Resolver) resolution(upstream Upstream, domain string, recordType uint16) func(context.Context) (resolved, error) {
+	return func(ctx context.Context) (resolved, error) {
+		records, security, err := r.resolveAndCache(ctx, upstream, domain, recordType)
+		return resolved{records, security}, err
 	}
+}
 
-	if ip, found := r.cache.Get(domain); found {
-		return ip, nil
+// backgroundContext bounds work no client waits for by the resolution
+// budget and the resolver's lifetime.
+func (r *Resolver) backgroundContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.ctx, r.timeout)
+}
+
+// resolveAndCache resolves through upstream and caches the answer. Bogus
+// answers are never cached.
+func (r *Resolver) resolveAndCache(ctx context.Context, upstream Upstream, domain string, recordType uint16) ([]protocol.ResourceRecord, models.Security, error) {
+	var records []protocol.ResourceRecord
+	security := models.SecurityIndeterminate
+	var err error
+	if validating, ok := upstream.(validatingUpstream); ok {
+		records, security, err = validating.resolveValidated(ctx, domain, recordType)
+	} else {
+		records, err = upstream.Resolve(ctx, domain, recordType)
 	}
 
-	ip, err := r.iterativeResolver.Resolve(domain, recordType)
+	var negative *NegativeResponse
+	if errors.As(err, &negative) && security != models.SecurityBogus {
+		if ttl, ok := negative.ttl(); ok {
+			r.cache.SetNegative(domain, recordType, protocol.ClassIN, negative, ttl)
+		}
+		return records, security, negative
+	}
 	if err != nil {
-		return "", ErrResolutionFailed
+		return records, security, err
+	}
+
+	r.cache.setRecords(records, models.TrustAnswer, security)
+
+	return records, security, nil
+}
+
+// staleOnFailure falls back to an expired answer when resolution failed,
+// which beats a SERVFAIL while the upstreams are unreachable. Denials and
+// bogus answers are outcomes, not failures, and are passed through. A
+// failure starts the entry's recheck interval, after which it is
+// refreshed in the background.
+func (r *Resolver) staleOnFailure(upstream Upstream, domain string, recordType uint16, records []protocol.ResourceRecord, security models.Security, err error) ([]protocol.ResourceRecord, models.Security, error) {
+	var negative *NegativeResponse
+	if err == nil || errors.As(err, &negative) || errors.Is(err, ErrBogus) {
+		return records, security, err
 	}
 
-	return ip, nil
+	if stale, found := r.cache.LookupStale(domain, recordType, protocol.ClassIN); found {
+		if r.cache.noteFailure(domain, recordType, protocol.ClassIN) {
+			r.recheckLater(upstream, domain, recordType)
+		}
+		return stale, models.SecurityIndeterminate, nil
+	}
+	// Callers tell a query that ran out of time or was abandoned from one
+	// the upstreams failed
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return nil, models.SecurityIndeterminate, fmt.Errorf("%w: %w", ErrResolutionFailed, err)
+	}
+	return nil, models.SecurityIndeterminate, ErrResolutionFailed
 }
 
-func (r *Resolver) ResolveA(domain string) (string, error) {
-	return r.Resolve(domain, protocol.TypeA)
+func (r *Resolver) ResolveA(ctx context.Context, domain string) (string, error) {
+	records, err := r.Resolve(ctx, domain, protocol.TypeA)
+	if err != nil {
+		return "", err
+	}
+
+	for _, record := range records {
+		if record.Type == protocol.TypeA {
+			return record.GetStringData()
+		}
+	}
+
+	return "", ErrNoAnswer
 }
 
-func (r *Resolver) LookupCache(domain string) (string, bool) {
-	return r.cache.Get(domain)
+func (r *Resolver) LookupCache(domain string, recordType uint16) ([]protocol.ResourceRecord, bool) {
+	return r.cache.Lookup(domain, recordType, protocol.ClassIN)
 }
 
-func (r *Resolver) UpdateCache(domain, ip string, ttl int) {
-	r.cache.Set(domain, ip, protocol.ParseTTL(ttl))
+func (r *Resolver) UpdateCache(domain, ip string, ttl int) error {
+	record, err := protocol.CreateARecord(domain, ip, uint32(ttl))
+	if err != nil {
+		return err
+	}
+	r.cache.Set(domain, protocol.TypeA, protocol.ClassIN, []protocol.ResourceRecord{record}, models.TrustAnswer)
+	return nil
 }
 
 func (r *Resolver) GetStats() models.CacheStatistics {
-	return r.cache.GetStats()
+	stats := r.cache.GetStats()
+	stats.ForwardRuleHits = r.conditional.Hits()
+	stats.Prefetches = r.prefetcher.started.Load()
+	stats.PrefetchesDropped = r.prefetcher.dropped.Load()
+	stats.CoalescedQueries = r.coalescer.coalesced.Load()
+	stats.CoalesceRejected = r.coalescer.rejected.Load()
+	return stats
 }
 
 func (r *Resolver) ClearCache() {
@@ -80,11 +476,21 @@ func (r *Resolver) ClearCache() {
 }
 
 func (r *Resolver) Close() {
+	r.stop()
+	if r.forwarder != nil {
+		r.forwarder.Close()
+	}
+	if iterative, ok := r.upstream.(*IterativeResolver); ok {
+		if network, ok := iterative.exchanger.(*networkExchanger); ok {
+			network.close()
+		}
+	}
+	r.conditional.Close()
 	r.cache.Close()
 }
 
 func RetrieveIP(url models.URL) (string, error) {
 	resolver := GetInstance()
 	domain := url.Authority.Host
-	return resolver.ResolveA(domain)
+	return resolver.ResolveA(context.Background(), domain)
 }
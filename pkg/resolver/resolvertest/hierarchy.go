@@ -0,0 +1,263 @@
+// Package resolvertest runs the resolver against an in-memory DNS
+// hierarchy, so iterative resolution can be tested without a network.
+package resolvertest
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/zone"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behaviour is how a fake server reacts to queries.
+type Behaviour int
+
+const (
+	// Answer serves the server's zones like an authoritative server
+	Answer Behaviour = iota
+	// Timeout never answers, and the query times out at once
+	Timeout
+	// Hang never answers either, but the query waits for its deadline
+	Hang
+	// Refuse answers REFUSED, like a lame delegation
+	Refuse
+	// ServerFailure answers SERVFAIL
+	ServerFailure
+	// WrongID answers with a query ID that does not match
+	WrongID
+	// WrongQuestion answers a different question than the one asked
+	WrongQuestion
+	// MangleCase answers, but lower-cases the question it echoes back
+	MangleCase
+	// Malformed answers with wire data cut one byte short, which fails
+	// to parse just as it would off the network
+	Malformed
+	// Pollute answers, adding a record for an unrelated name to the
+	// answer section as a poisoning attempt would
+	Pollute
+	// Forge answers, but changes the addresses in the answer section
+	// after they were signed, as an attacker on the path would
+	Forge
+)
+
+// PollutedName is the owner of the record Pollute slips into answers.
+const PollutedName = "victim.example"
+
+// Hierarchy is a set of fake authoritative servers by IP address. It
+// implements resolver.Exchanger: every query is answered by the server it
+// is addressed to, from that server's zones.
+type Hierarchy struct {
+	mu      sync.Mutex
+	servers map[string]*server
+	// signers are the keys of the zones made signed, by origin
+	signers map[string]*signer
+}
+
+type server struct {
+	zones     *zone.Store
+	behaviour Behaviour
+	delay     time.Duration
+	queries   []protocol.Question
+}
+
+func NewHierarchy() *Hierarchy {
+	return &Hierarchy{servers: make(map[string]*server), signers: make(map[string]*signer)}
+}
+
+// AddZone has the server at ip serve a zone for origin, given as master
+// file text. Use "." for the root zone.
+func (h *Hierarchy) AddZone(ip, origin, text string) error {
+	z, err := zone.Parse(text, origin)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.server(ip).zones.Add(z)
+	return nil
+}
+
+// SetBehaviour changes how the server at ip reacts from now on.
+func (h *Hierarchy) SetBehaviour(ip string, behaviour Behaviour) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.server(ip).behaviour = behaviour
+}
+
+// SetDelay has the server at ip take delay to react to each query, or
+// until the query's deadline if that comes first.
+func (h *Hierarchy) SetDelay(ip string, delay time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.server(ip).delay = delay
+}
+
+// Queries returns the questions the server at ip has been sent, in order.
+func (h *Hierarchy) Queries(ip string) []protocol.Question {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]protocol.Question(nil), h.server(ip).queries...)
+}
+
+func (h *Hierarchy) server(ip string) *server {
+	s, exists := h.servers[ip]
+	if !exists {
+		s = &server{zones: zone.NewStore()}
+		h.servers[ip] = s
+	}
+	return s
+}
+
+// Exchange answers query as the server at endpoint's address would.
+// Addresses without a server behave like servers that never answer.
+func (h *Hierarchy) Exchange(ctx context.Context, endpoint *resolver.Endpoint, query *protocol.Message) (*protocol.Message, error) {
+	ip, _, err := net.SplitHostPort(endpoint.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	s, exists := h.servers[ip]
+	if !exists {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("query %s: %w", ip, os.ErrDeadlineExceeded)
+	}
+	if len(query.Questions) > 0 {
+		s.queries = append(s.queries, query.Questions[0])
+	}
+	wait := s.delay
+	if s.behaviour == Hang {
+		wait = -1
+	}
+	h.mu.Unlock()
+
+	if wait != 0 {
+		var elapsed <-chan time.Time
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			elapsed = timer.C
+		}
+		select {
+		case <-elapsed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("query %s: %w", ip, ctx.Err())
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch s.behaviour {
+	case Timeout:
+		return nil, fmt.Errorf("query %s: %w", ip, os.ErrDeadlineExceeded)
+	case Refuse:
+		return reply(query, protocol.RCodeRefused), nil
+	case ServerFailure:
+		return reply(query, protocol.RCodeServFail), nil
+	case WrongID:
+		response := s.answer(query, h.signers)
+		response.Header.ID++
+		return response, nil
+	case WrongQuestion:
+		response := s.answer(query, h.signers)
+		response.Questions[0].Name = "attacker.example"
+		return response, nil
+	case MangleCase:
+		response := s.answer(query, h.signers)
+		response.Questions[0].Name = strings.ToLower(response.Questions[0].Name)
+		return response, nil
+	case Malformed:
+		return malformed(s.answer(query, h.signers))
+	case Pollute:
+		rr, err := protocol.NewRecord(PollutedName, protocol.TypeA, 86400, &protocol.ARecord{IP: net.IPv4(203, 0, 113, 66)})
+		if err != nil {
+			return nil, err
+		}
+		response := s.answer(query, h.signers)
+		response.Answers = append(response.Answers, rr)
+		return response, nil
+	case Forge:
+		response := s.answer(query, h.signers)
+		for i, rr := range response.Answers {
+			if rr.Type != protocol.TypeA {
+				continue
+			}
+			forged, err := protocol.NewRecord(rr.Name, rr.Type, rr.TTL, &protocol.ARecord{IP: net.IPv4(203, 0, 113, 66)})
+			if err != nil {
+				return nil, err
+			}
+			response.Answers[i] = forged
+		}
+		return response, nil
+	}
+	return s.answer(query, h.signers), nil
+}
+
+// answer looks the question up in the closest enclosing zone, signing the
+// answer when the zone is signed and the query sets DO. Names outside
+// every zone are refused.
+func (s *server) answer(query *protocol.Message, signers map[string]*signer) *protocol.Message {
+	if len(query.Questions) != 1 {
+		return reply(query, protocol.RCodeFormErr)
+	}
+	question := query.Questions[0]
+
+	z := s.zones.Find(question.Name)
+	if z == nil {
+		return reply(query, protocol.RCodeRefused)
+	}
+
+	result := z.Lookup(question.Name, question.Type)
+	response := reply(query, result.RCode)
+	response.Answers = result.Answers
+	response.Authorities = result.Authorities
+	response.Additional = result.Additional
+	if result.Authoritative {
+		response.Header.Flags |= protocol.FlagAA
+	}
+
+	if e, _ := query.EDNS(); e != nil && e.DO && signers[z.Origin] != nil {
+		if err := signers[z.Origin].signResponse(response, z, question, signers); err != nil {
+			return reply(query, protocol.RCodeServFail)
+		}
+	}
+	return response
+}
+
+// malformed sends response through the wire format with its last byte
+// missing, returning what parsing it makes of that.
+func malformed(response *protocol.Message) (*protocol.Message, error) {
+	data, err := protocol.BuildMessage(response)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseMessage(data[:len(data)-1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return parsed, nil
+}
+
+// reply starts a response to query that echoes its question exactly,
+// case included, and its EDNS OPT record.
+func reply(query *protocol.Message, rcode uint16) *protocol.Message {
+	response := &protocol.Message{
+		Header: protocol.Header{
+			ID:    query.Header.ID,
+			Flags: protocol.FlagQR | (query.Header.Flags & protocol.FlagRD) | (rcode & 0x0F),
+		},
+		Questions: append([]protocol.Question(nil), query.Questions...),
+	}
+	if e, _ := query.EDNS(); e != nil {
+		response.SetEDNS(protocol.NewEDNS(e.UDPSize))
+	}
+	return response
+}
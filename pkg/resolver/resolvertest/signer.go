@@ -0,0 +1,225 @@
+package resolvertest
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/pkg/dnssec"
+	"DNS-server/pkg/zone"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lifetime of the signatures and keys the fake servers hand out
+const signedTTL = 3600
+
+// Types looked for at a name when writing its NSEC type bitmap
+var bitmapTypes = []uint16{
+	protocol.TypeA, protocol.TypeNS, protocol.TypeCNAME, protocol.TypeSOA,
+	protocol.TypePTR, protocol.TypeMX, protocol.TypeTXT, protocol.TypeAAAA,
+	protocol.TypeSRV,
+}
+
+// signer holds the key a signed zone's answers are signed with.
+type signer struct {
+	origin string
+	key    *protocol.DNSKEYRecord
+	priv   ed25519.PrivateKey
+}
+
+// Sign makes origin a signed zone. From now on the servers serving it
+// sign their answers with a new ED25519 key, serve its DNSKEY set and
+// deny names with NSEC records, whenever the query sets DO. The DS
+// record returned is what parents serving origin's DS answer with; for
+// the root it is the trust anchor. Wildcard answers are signed as if
+// their owners existed.
+func (h *Hierarchy) Sign(origin string) (*protocol.DSRecord, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &signer{
+		origin: protocol.CanonicalName(origin),
+		key: &protocol.DNSKEYRecord{
+			Flags:     dnssec.FlagZoneKey | dnssec.FlagSEP,
+			Protocol:  3,
+			Algorithm: dnssec.AlgorithmED25519,
+			PublicKey: pub,
+		},
+		priv: priv,
+	}
+
+	digest, err := dnssec.Digest(s.origin, s.key, dnssec.DigestSHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.signers[s.origin] = s
+	return &protocol.DSRecord{
+		KeyTag:     dnssec.KeyTag(s.key),
+		Algorithm:  s.key.Algorithm,
+		DigestType: dnssec.DigestSHA256,
+		Digest:     digest,
+	}, nil
+}
+
+// signResponse turns the answer z gave to question into the one a signed
+// zone gives: keys and child DS records served, RRsets signed and
+// negative answers proved. Referrals are left alone.
+func (s *signer) signResponse(response *protocol.Message, z *zone.Zone, question protocol.Question, signers map[string]*signer) error {
+	name := protocol.CanonicalName(question.Name)
+
+	switch {
+	case question.Type == protocol.TypeDNSKEY && name == s.origin:
+		rr, err := protocol.NewRecord(question.Name, protocol.TypeDNSKEY, signedTTL, s.key)
+		if err != nil {
+			return err
+		}
+		setAnswers(response, rr)
+	case question.Type == protocol.TypeDS && signers[name] != nil && name != s.origin:
+		ds, err := dnssec.Digest(name, signers[name].key, dnssec.DigestSHA256)
+		if err != nil {
+			return err
+		}
+		rr, err := protocol.NewRecord(question.Name, protocol.TypeDS, signedTTL, &protocol.DSRecord{
+			KeyTag:     dnssec.KeyTag(signers[name].key),
+			Algorithm:  signers[name].key.Algorithm,
+			DigestType: dnssec.DigestSHA256,
+			Digest:     ds,
+		})
+		if err != nil {
+			return err
+		}
+		setAnswers(response, rr)
+	}
+
+	if response.Header.Flags&protocol.FlagAA == 0 {
+		return nil
+	}
+
+	sigs, err := s.signSets(response.Answers)
+	if err != nil {
+		return err
+	}
+	response.Answers = append(response.Answers, sigs...)
+
+	if len(response.Authorities) == 0 {
+		return nil
+	}
+
+	// A negative answer: deny the last name of the CNAME chain, if any
+	denied := name
+	for _, rr := range response.Answers {
+		if cname, ok := rr.Data.(*protocol.CNAMERecord); ok {
+			denied = protocol.CanonicalName(cname.Target)
+		}
+	}
+	nsec, err := s.denial(z, denied, response.RCode() == protocol.RCodeNXDomain)
+	if err != nil {
+		return err
+	}
+	response.Authorities = append(response.Authorities, nsec)
+	sigs, err = s.signSets(response.Authorities)
+	if err != nil {
+		return err
+	}
+	response.Authorities = append(response.Authorities, sigs...)
+	return nil
+}
+
+func setAnswers(response *protocol.Message, rr protocol.ResourceRecord) {
+	response.Answers = []protocol.ResourceRecord{rr}
+	response.Authorities = nil
+	response.Additional = nil
+	response.Header.Flags = response.Header.Flags&^0x0F | protocol.FlagAA
+}
+
+// denial returns an NSEC record proving name has no data of the type
+// asked for or, for nxdomain, that it and any wildcard matching it do not
+// exist. Records are minted around the name as they are needed, rather
+// than taken from a chain over the whole zone.
+func (s *signer) denial(z *zone.Zone, name string, nxdomain bool) (protocol.ResourceRecord, error) {
+	owner, next := name, "!."+name
+	if nxdomain {
+		// The closest encloser's NSEC runs past name and everything below
+		// it, covering the closest encloser's wildcard on the way
+		var label string
+		label, owner, _ = strings.Cut(name, ".")
+		for owner != s.origin && z.Lookup(owner, protocol.TypeA).RCode == protocol.RCodeNXDomain {
+			label, owner, _ = strings.Cut(owner, ".")
+		}
+		next = label + "!"
+		if owner != "" {
+			next += "." + owner
+		}
+	}
+
+	types := []uint16{protocol.TypeNSEC, protocol.TypeRRSIG}
+	if owner == s.origin {
+		types = append(types, protocol.TypeDNSKEY)
+	}
+	for _, t := range bitmapTypes {
+		result := z.Lookup(owner, t)
+		for _, rr := range append(result.Answers, result.Authorities...) {
+			if rr.Type == t && protocol.EqualNames(rr.Name, owner) {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+
+	return protocol.NewRecord(owner, protocol.TypeNSEC, signedTTL, &protocol.NSECRecord{NextDomain: next, Types: types})
+}
+
+// signSets signs every RRset among records that belongs to the zone,
+// other than signatures themselves.
+func (s *signer) signSets(records []protocol.ResourceRecord) ([]protocol.ResourceRecord, error) {
+	type setKey struct {
+		name   string
+		rrType uint16
+	}
+	var order []setKey
+	sets := make(map[setKey][]protocol.ResourceRecord)
+	for _, rr := range records {
+		key := setKey{protocol.CanonicalName(rr.Name), rr.Type}
+		if rr.Type == protocol.TypeRRSIG || !dnssec.IsSubdomain(key.name, s.origin) {
+			continue
+		}
+		if _, seen := sets[key]; !seen {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	var sigs []protocol.ResourceRecord
+	for _, key := range order {
+		sig, err := s.sign(sets[key])
+		if err != nil {
+			return nil, fmt.Errorf("sign %s %s: %w", key.name, protocol.TypeToString(key.rrType), err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+func (s *signer) sign(rrset []protocol.ResourceRecord) (protocol.ResourceRecord, error) {
+	now := time.Now()
+	sig := &protocol.RRSIGRecord{
+		TypeCovered: rrset[0].Type,
+		Algorithm:   s.key.Algorithm,
+		Labels:      uint8(dnssec.CountLabels(rrset[0].Name)),
+		OriginalTTL: rrset[0].TTL,
+		Expiration:  uint32(now.Add(signedTTL * time.Second).Unix()),
+		Inception:   uint32(now.Add(-signedTTL * time.Second).Unix()),
+		KeyTag:      dnssec.KeyTag(s.key),
+		SignerName:  s.origin + ".",
+	}
+	data, err := dnssec.SignedData(rrset, sig)
+	if err != nil {
+		return protocol.ResourceRecord{}, err
+	}
+	sig.Signature = ed25519.Sign(s.priv, data)
+	return protocol.NewRecord(rrset[0].Name, protocol.TypeRRSIG, rrset[0].TTL, sig)
+}
@@ -0,0 +1,601 @@
+package resolver
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"DNS-server/pkg/dnssec"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Longest time a zone's verified keys, or its being unsigned, is
+	// trusted before the chain is checked again
+	maxTrustTTL = time.Hour
+	// How long a zone whose chain of trust is broken stays bogus
+	bogusTrustTTL = time.Minute
+	// Most zones whose trust is remembered at once
+	maxTrustEntries = 1000
+)
+
+var ErrBogus = errors.New("DNSSEC validation failed")
+
+// BogusError is returned for answers that fail DNSSEC validation. It
+// matches ErrBogus with errors.Is. When the bogus answer was a denial,
+// Negative holds it so that clients setting CD can still be given it.
+type BogusError struct {
+	Reason   error
+	Negative *NegativeResponse
+}
+
+func (e *BogusError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrBogus, e.Reason)
+}
+
+func (e *BogusError) Is(target error) bool {
+	return target == ErrBogus
+}
+
+func (e *BogusError) Unwrap() error {
+	return e.Reason
+}
+
+// zoneTrust is what the chain of trust says about the zone enclosing a
+// name: its verified keys when secure, or why it is not.
+type zoneTrust struct {
+	zone     string
+	security models.Security
+	keys     []*protocol.DNSKEYRecord
+	err      error
+	expires  time.Time
+	// apex is set when the trust was decided at zone's apex, from its DS
+	// set or a proof that it is an unsigned delegation; only such trust is
+	// remembered
+	apex bool
+}
+
+func (t *zoneTrust) atApex() *zoneTrust {
+	t.apex = true
+	return t
+}
+
+func secureZone(zone string, keys []*protocol.DNSKEYRecord, ttl time.Duration) *zoneTrust {
+	return &zoneTrust{zone: zone, security: models.SecuritySecure, keys: keys, expires: time.Now().Add(min(ttl, maxTrustTTL))}
+}
+
+func insecureZone(zone string) *zoneTrust {
+	return &zoneTrust{zone: zone, security: models.SecurityInsecure, expires: time.Now().Add(maxTrustTTL)}
+}
+
+func bogusZone(zone string, err error) *zoneTrust {
+	return &zoneTrust{zone: zone, security: models.SecurityBogus, err: err, expires: time.Now().Add(bogusTrustTTL)}
+}
+
+// validator checks answers from the iterative resolver against a chain of
+// trust running from the root trust anchor through DS and DNSKEY records
+// to the signatures on the answer (RFC 4035 section 5).
+type validator struct {
+	resolver *IterativeResolver
+	anchors  []*protocol.DSRecord
+	// establishing shares the work of finding a zone's trust among
+	// answers that need it at the same time
+	establishing *coalescer[*zoneTrust]
+
+	mu       sync.Mutex
+	trust    map[string]*list.Element
+	trustLRU *list.List
+}
+
+func newValidator(resolver *IterativeResolver, anchors []*protocol.DSRecord) *validator {
+	return &validator{
+		resolver:     resolver,
+		anchors:      anchors,
+		establishing: newCoalescer[*zoneTrust](0),
+		trust:        make(map[string]*list.Element),
+		trustLRU:     list.New(),
+	}
+}
+
+// signedSet is one RRset of a response with the signatures covering it.
+type signedSet struct {
+	name    string
+	rrType  uint16
+	records []protocol.ResourceRecord
+	sigs    []*protocol.RRSIGRecord
+}
+
+// signedSets groups records into RRsets and attaches each RRSIG to the set
+// it covers. Signatures over sets that are not present are dropped.
+func signedSets(records []protocol.ResourceRecord) []*signedSet {
+	var sets []*signedSet
+	find := func(name string, rrType uint16) *signedSet {
+		for _, set := range sets {
+			if set.rrType == rrType && protocol.EqualNames(set.name, name) {
+				return set
+			}
+		}
+		return nil
+	}
+
+	for _, rr := range records {
+		if rr.Type == protocol.TypeRRSIG || rr.Type == protocol.TypeOPT {
+			continue
+		}
+		if set := find(rr.Name, rr.Type); set != nil {
+			set.records = append(set.records, rr)
+		} else {
+			sets = append(sets, &signedSet{name: rr.Name, rrType: rr.Type, records: []protocol.ResourceRecord{rr}})
+		}
+	}
+
+	for _, rr := range records {
+		if rr.Type != protocol.TypeRRSIG {
+			continue
+		}
+		data, err := rr.TypedData()
+		if err != nil {
+			continue
+		}
+		sig, ok := data.(*protocol.RRSIGRecord)
+		if !ok {
+			continue
+		}
+		if set := find(rr.Name, sig.TypeCovered); set != nil {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+
+	return sets
+}
+
+func findSet(sets []*signedSet, name string, rrType uint16) *signedSet {
+	for _, set := range sets {
+		if set.rrType == rrType && protocol.EqualNames(set.name, name) {
+			return set
+		}
+	}
+	return nil
+}
+
+func isDenialType(rrType uint16) bool {
+	return rrType == protocol.TypeNSEC || rrType == protocol.TypeNSEC3
+}
+
+// validate works out the DNSSEC status of an answer to domain/qtype: the
+// records of a positive answer, or the CNAME chain and denial of a
+// negative one. A bogus status comes with the reason.
+func (v *validator) validate(ctx context.Context, domain string, qtype uint16, records []protocol.ResourceRecord, negative *NegativeResponse) (models.Security, error) {
+	security := models.SecuritySecure
+	name := domain
+
+	sets := signedSets(records)
+	for _, set := range sets {
+		// Denial records here prove a wildcard answer and are checked with it
+		if isDenialType(set.rrType) && set.rrType != qtype {
+			continue
+		}
+
+		status, err := v.verifySet(ctx, set)
+		if err != nil {
+			return models.SecurityBogus, err
+		}
+		if status == models.SecuritySecure {
+			if err := v.verifyWildcard(ctx, set, sets); err != nil {
+				return models.SecurityBogus, err
+			}
+		}
+		security = security.Combine(status)
+
+		if set.rrType == protocol.TypeCNAME && protocol.EqualNames(set.name, name) {
+			if target, err := set.records[0].GetStringData(); err == nil {
+				name = target
+			}
+		}
+	}
+
+	if negative == nil {
+		return security, nil
+	}
+
+	status, err := v.verifyDenial(ctx, name, qtype, negative)
+	return security.Combine(status), err
+}
+
+// verifySet checks the signatures on one RRset. An unsigned set is fine
+// only in a zone proven to be unsigned.
+func (v *validator) verifySet(ctx context.Context, set *signedSet) (models.Security, error) {
+	if len(set.sigs) == 0 {
+		trust := v.trustFor(ctx, set.name)
+		switch trust.security {
+		case models.SecurityInsecure:
+			return models.SecurityInsecure, nil
+		case models.SecurityBogus:
+			return models.SecurityBogus, trust.err
+		}
+		return models.SecurityBogus, fmt.Errorf("%s %s unsigned in signed zone %s",
+			set.name, protocol.TypeToString(set.rrType), fqdnOrRoot(trust.zone))
+	}
+
+	var lastErr error
+	for _, sig := range set.sigs {
+		if !dnssec.IsSubdomain(set.name, sig.SignerName) {
+			lastErr = fmt.Errorf("%s signed by unrelated zone %s", set.name, sig.SignerName)
+			continue
+		}
+
+		trust := v.trustFor(ctx, sig.SignerName)
+		switch {
+		case trust.security == models.SecurityInsecure:
+			return models.SecurityInsecure, nil
+		case trust.security == models.SecurityBogus:
+			lastErr = trust.err
+			continue
+		case !protocol.EqualNames(trust.zone, sig.SignerName):
+			lastErr = fmt.Errorf("signer %s is not a zone apex", sig.SignerName)
+			continue
+		}
+
+		if err := verifyWithKeys(set, sig, trust.keys); err != nil {
+			lastErr = err
+			continue
+		}
+		return models.SecuritySecure, nil
+	}
+
+	return models.SecurityBogus, fmt.Errorf("%s %s: %w", set.name, protocol.TypeToString(set.rrType), lastErr)
+}
+
+func verifyWithKeys(set *signedSet, sig *protocol.RRSIGRecord, keys []*protocol.DNSKEYRecord) error {
+	err := fmt.Errorf("no key with tag %d", sig.KeyTag)
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || dnssec.KeyTag(key) != sig.KeyTag {
+			continue
+		}
+		if err = dnssec.Verify(set.records, sig, key, time.Now()); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyWildcard checks that an RRset synthesised from a wildcard comes
+// with verified proof that its owner does not exist itself.
+func (v *validator) verifyWildcard(ctx context.Context, set *signedSet, sets []*signedSet) error {
+	var closestEncloser string
+	expanded := false
+	for _, sig := range set.sigs {
+		if ce, ok := dnssec.IsWildcardExpansion(set.name, sig); ok {
+			closestEncloser, expanded = ce, true
+		}
+	}
+	if !expanded {
+		return nil
+	}
+
+	proof, status, err := v.verifyProof(ctx, sets)
+	if err != nil || status != models.SecuritySecure {
+		return fmt.Errorf("wildcard answer for %s without a valid proof: %v", set.name, err)
+	}
+	return dnssec.ProveNoCloserMatch(proof, set.name, closestEncloser)
+}
+
+// verifyProof checks the signatures on the NSEC or NSEC3 sets among sets
+// and returns their records.
+func (v *validator) verifyProof(ctx context.Context, sets []*signedSet) ([]protocol.ResourceRecord, models.Security, error) {
+	var proof []protocol.ResourceRecord
+	security := models.SecuritySecure
+	for _, set := range sets {
+		if !isDenialType(set.rrType) {
+			continue
+		}
+		status, err := v.verifySet(ctx, set)
+		if err != nil {
+			return nil, models.SecurityBogus, err
+		}
+		security = security.Combine(status)
+		proof = append(proof, set.records...)
+	}
+	if proof == nil {
+		return nil, models.SecurityBogus, dnssec.ErrNoProof
+	}
+	return proof, security, nil
+}
+
+// verifyDenial checks an NXDOMAIN or NODATA answer for name/qtype.
+func (v *validator) verifyDenial(ctx context.Context, name string, qtype uint16, negative *NegativeResponse) (models.Security, error) {
+	proof, security, err := v.verifyProof(ctx, signedSets(negative.Proof))
+	if errors.Is(err, dnssec.ErrNoProof) {
+		// Denials from unsigned zones carry no proof
+		trust := v.trustFor(ctx, name)
+		if trust.security != models.SecuritySecure {
+			return trust.security, trust.err
+		}
+		return models.SecurityBogus, fmt.Errorf("denial for %s without proof from signed zone %s", name, fqdnOrRoot(trust.zone))
+	}
+	if err != nil || security != models.SecuritySecure {
+		return security, err
+	}
+
+	if negative.NXDomain {
+		err = dnssec.ProveNXDomain(proof, name)
+	} else {
+		err = dnssec.ProveNoData(proof, name, qtype)
+	}
+	if errors.Is(err, dnssec.ErrNSEC3Iterations) || errors.Is(err, dnssec.ErrUnsupportedNSEC3) {
+		return models.SecurityInsecure, nil
+	}
+	if err != nil {
+		return models.SecurityBogus, err
+	}
+	return models.SecuritySecure, nil
+}
+
+// trustFor returns the trust of the zone enclosing name. Names that are
+// not a remembered zone apex have it established, with concurrent callers
+// for the same name sharing the work.
+func (v *validator) trustFor(ctx context.Context, name string) *zoneTrust {
+	name = protocol.CanonicalName(name)
+	if trust, found := v.rememberedTrust(name); found {
+		return trust
+	}
+
+	key := newCacheKey(name, protocol.TypeDS, protocol.ClassIN)
+	trust, err := v.establishing.do(ctx, key, func(ctx context.Context) (*zoneTrust, error) {
+		trust := v.establish(ctx, name)
+		// A lookup cut short says nothing about the zone
+		if trust.apex && ctx.Err() == nil {
+			v.remember(trust)
+		}
+		return trust, nil
+	})
+	if err != nil {
+		return bogusZone(name, err)
+	}
+	return trust
+}
+
+// rememberedTrust returns the unexpired trust remembered for the zone
+// whose apex is name.
+func (v *validator) rememberedTrust(name string) (*zoneTrust, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	element, found := v.trust[name]
+	if !found {
+		return nil, false
+	}
+	trust := element.Value.(*zoneTrust)
+	if !time.Now().Before(trust.expires) {
+		v.trustLRU.Remove(element)
+		delete(v.trust, name)
+		return nil, false
+	}
+	v.trustLRU.MoveToFront(element)
+	return trust, true
+}
+
+// remember keeps trust under its zone's apex, making room by forgetting
+// the zone used least recently.
+func (v *validator) remember(trust *zoneTrust) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if element, found := v.trust[trust.zone]; found {
+		element.Value = trust
+		v.trustLRU.MoveToFront(element)
+		return
+	}
+	if v.trustLRU.Len() >= maxTrustEntries {
+		oldest := v.trustLRU.Back()
+		v.trustLRU.Remove(oldest)
+		delete(v.trust, oldest.Value.(*zoneTrust).zone)
+	}
+	v.trust[trust.zone] = v.trustLRU.PushFront(trust)
+}
+
+// establish follows the DS records for name up towards the trust anchor.
+// A DS set makes name the apex of a signed zone whose keys are then
+// fetched; a proven absence leaves name in its parent's zone, or makes it
+// an unsigned delegation.
+func (v *validator) establish(ctx context.Context, name string) *zoneTrust {
+	if name == "" {
+		return v.zoneKeys(ctx, "", v.anchors).atApex()
+	}
+
+	records, err := v.resolver.resolve(ctx, name, protocol.TypeDS, 0)
+	var negative *NegativeResponse
+	if err != nil && !errors.As(err, &negative) {
+		return bogusZone(name, fmt.Errorf("DS lookup for %s: %w", name, err))
+	}
+
+	var sets []*signedSet
+	if negative != nil {
+		sets = signedSets(negative.Proof)
+	} else {
+		sets = signedSets(records)
+	}
+
+	signer, signed := keepSignersAbove(sets, name)
+	if !signed {
+		// Only an unsigned parent can hand out unsigned DS answers
+		parent := v.trustFor(ctx, parentName(name))
+		if parent.security == models.SecuritySecure {
+			return bogusZone(name, fmt.Errorf("unsigned DS answer for %s from signed zone %s", name, fqdnOrRoot(parent.zone)))
+		}
+		return parent
+	}
+
+	if negative == nil {
+		set := findSet(sets, name, protocol.TypeDS)
+		if set == nil || len(set.sigs) == 0 {
+			return bogusZone(name, fmt.Errorf("DS answer for %s without a signed DS set", name))
+		}
+		switch status, err := v.verifySet(ctx, set); status {
+		case models.SecurityBogus:
+			return bogusZone(name, err)
+		case models.SecurityInsecure:
+			return insecureZone(name)
+		}
+
+		ds := make([]*protocol.DSRecord, 0, len(set.records))
+		for _, rr := range set.records {
+			if data, err := rr.TypedData(); err == nil {
+				if record, ok := data.(*protocol.DSRecord); ok {
+					ds = append(ds, record)
+				}
+			}
+		}
+		return v.zoneKeys(ctx, name, ds).atApex()
+	}
+
+	for _, set := range sets {
+		if isDenialType(set.rrType) && len(set.sigs) == 0 {
+			return bogusZone(name, fmt.Errorf("unsigned %s in denial of DS for %s", protocol.TypeToString(set.rrType), name))
+		}
+	}
+	proof, status, err := v.verifyProof(ctx, sets)
+	switch {
+	case status == models.SecurityBogus:
+		return bogusZone(name, err)
+	case status == models.SecurityInsecure:
+		return insecureZone(name)
+	}
+
+	if negative.NXDomain {
+		err = dnssec.ProveNXDomain(proof, name)
+		if err == nil {
+			return v.trustFor(ctx, signer)
+		}
+	} else {
+		var delegation bool
+		delegation, err = dnssec.ProveNoDS(proof, name)
+		if err == nil && delegation {
+			return insecureZone(name).atApex()
+		}
+		if err == nil {
+			return v.trustFor(ctx, signer)
+		}
+	}
+	if errors.Is(err, dnssec.ErrNSEC3Iterations) || errors.Is(err, dnssec.ErrUnsupportedNSEC3) {
+		return insecureZone(name)
+	}
+	return bogusZone(name, err)
+}
+
+// keepSignersAbove drops signatures that do not come from a proper
+// ancestor of name, the only zones that can answer for name's DS, and
+// returns the signer of what is left. Checking a DS with a key of the
+// zone it leads to would go round in circles.
+func keepSignersAbove(sets []*signedSet, name string) (string, bool) {
+	signer := ""
+	signed := false
+	for _, set := range sets {
+		kept := set.sigs[:0]
+		for _, sig := range set.sigs {
+			zone := protocol.CanonicalName(sig.SignerName)
+			if zone != name && dnssec.IsSubdomain(name, zone) {
+				kept = append(kept, sig)
+				signer, signed = zone, true
+			}
+		}
+		set.sigs = kept
+	}
+	return signer, signed
+}
+
+// zoneKeys fetches the DNSKEY set of zone and accepts it when a key
+// matching one of ds signs the whole set. A zone whose DS records all use
+// algorithms or digests we cannot check is treated as unsigned (RFC 4035
+// section 5.2).
+func (v *validator) zoneKeys(ctx context.Context, zone string, ds []*protocol.DSRecord) *zoneTrust {
+	var usable []*protocol.DSRecord
+	for _, d := range ds {
+		if dnssec.SupportedAlgorithm(d.Algorithm) && dnssec.SupportedDigest(d.DigestType) {
+			usable = append(usable, d)
+		}
+	}
+	if len(usable) == 0 {
+		return insecureZone(zone)
+	}
+
+	records, err := v.resolver.resolve(ctx, zone, protocol.TypeDNSKEY, 0)
+	if err != nil {
+		return bogusZone(zone, fmt.Errorf("DNSKEY lookup for %s: %w", fqdnOrRoot(zone), err))
+	}
+	set := findSet(signedSets(records), zone, protocol.TypeDNSKEY)
+	if set == nil {
+		return bogusZone(zone, fmt.Errorf("no DNSKEY set for %s", fqdnOrRoot(zone)))
+	}
+
+	var keys []*protocol.DNSKEYRecord
+	ttl := maxTrustTTL
+	for _, rr := range set.records {
+		data, err := rr.TypedData()
+		if err != nil {
+			continue
+		}
+		if key, ok := data.(*protocol.DNSKEYRecord); ok {
+			keys = append(keys, key)
+		}
+		ttl = min(ttl, time.Duration(rr.TTL)*time.Second)
+	}
+
+	for _, key := range keys {
+		if !matchesAny(zone, key, usable) {
+			continue
+		}
+		for _, sig := range set.sigs {
+			if protocol.EqualNames(sig.SignerName, zone) && verifyWithKeys(set, sig, []*protocol.DNSKEYRecord{key}) == nil {
+				return secureZone(zone, zoneSigningKeys(keys), ttl)
+			}
+		}
+	}
+
+	return bogusZone(zone, fmt.Errorf("no DNSKEY for %s matching its DS signs the key set", fqdnOrRoot(zone)))
+}
+
+func matchesAny(zone string, key *protocol.DNSKEYRecord, ds []*protocol.DSRecord) bool {
+	for _, d := range ds {
+		if dnssec.MatchesDS(zone, key, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSigningKeys keeps the keys that may sign zone data: zone keys that
+// have not been revoked.
+func zoneSigningKeys(keys []*protocol.DNSKEYRecord) []*protocol.DNSKEYRecord {
+	var usable []*protocol.DNSKEYRecord
+	for _, key := range keys {
+		if key.Flags&dnssec.FlagZoneKey != 0 && key.Flags&dnssec.FlagRevoke == 0 && key.Protocol == 3 {
+			usable = append(usable, key)
+		}
+	}
+	return usable
+}
+
+// withoutDNSSEC drops the signatures and denial records that were fetched
+// for validation, unless they are what was asked for.
+func withoutDNSSEC(records []protocol.ResourceRecord, qtype uint16) []protocol.ResourceRecord {
+	kept := records[:0:0]
+	for _, rr := range records {
+		if (rr.Type == protocol.TypeRRSIG || isDenialType(rr.Type)) && rr.Type != qtype {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+func parentName(name string) string {
+	if _, parent, found := strings.Cut(name, "."); found {
+		return parent
+	}
+	return ""
+}
@@ -0,0 +1,428 @@
+package zone
+
+import (
+	"DNS-server/internal/protocol"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxIncludeDepth = 8
+
+// token is a single field of a master file entry. Quoted fields keep
+// their spaces and can never be mistaken for a name or directive.
+type token struct {
+	text   string
+	quoted bool
+}
+
+// entry is one logical line of a master file, with parentheses already
+// joined and comments removed.
+type entry struct {
+	line       int
+	blankOwner bool
+	tokens     []token
+}
+
+type loader struct {
+	zone       *Zone
+	origin     string
+	defaultTTL uint32
+	hasTTL     bool
+	lastOwner  string
+	hasOwner   bool
+	lastTTL    uint32
+	depth      int
+	// noIncludes is set for text that has no file for $INCLUDE paths to
+	// be relative to
+	noIncludes bool
+}
+
+// LoadFile reads an RFC 1035 master file for the zone rooted at origin.
+func LoadFile(path, origin string) (*Zone, error) {
+	origin = normalizeName(origin)
+
+	l := &loader{
+		zone:   newZone(origin),
+		origin: origin,
+	}
+
+	if err := l.loadFile(path); err != nil {
+		return nil, err
+	}
+
+	if err := l.zone.finalize(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return l.zone, nil
+}
+
+// Parse reads a zone for origin from master file text. The text must be
+// self-contained: $INCLUDE is rejected, as there is no file to resolve
+// its path against.
+func Parse(text, origin string) (*Zone, error) {
+	origin = normalizeName(origin)
+
+	l := &loader{
+		zone:       newZone(origin),
+		origin:     origin,
+		noIncludes: true,
+	}
+
+	if err := l.load("zone "+fqdnOf(origin), text); err != nil {
+		return nil, err
+	}
+
+	if err := l.zone.finalize(); err != nil {
+		return nil, err
+	}
+
+	return l.zone, nil
+}
+
+func (l *loader) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read zone file: %w", err)
+	}
+
+	return l.load(path, string(content))
+}
+
+// load processes master file text read from source, which names it in
+// errors and anchors relative $INCLUDE paths.
+func (l *loader) load(source, text string) error {
+	entries, err := tokenize(text)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	for _, e := range entries {
+		if err := l.processEntry(source, e); err != nil {
+			return fmt.Errorf("%s:%d: %w", source, e.line, err)
+		}
+	}
+
+	return nil
+}
+
+func (l *loader) processEntry(path string, e entry) error {
+	first := e.tokens[0]
+
+	if !first.quoted && !e.blankOwner && strings.HasPrefix(first.text, "$") {
+		return l.processDirective(path, e.tokens)
+	}
+
+	return l.processRecord(e)
+}
+
+func (l *loader) processDirective(path string, tokens []token) error {
+	switch strings.ToUpper(tokens[0].text) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$ORIGIN takes exactly one name")
+		}
+		l.origin = l.absoluteName(tokens[1].text)
+		return nil
+
+	case "$TTL":
+		if len(tokens) != 2 {
+			return fmt.Errorf("$TTL takes exactly one value")
+		}
+		ttl, err := parseTTL(tokens[1].text)
+		if err != nil {
+			return err
+		}
+		l.defaultTTL = ttl
+		l.hasTTL = true
+		return nil
+
+	case "$INCLUDE":
+		if len(tokens) < 2 || len(tokens) > 3 {
+			return fmt.Errorf("$INCLUDE takes a file name and an optional origin")
+		}
+		if l.noIncludes {
+			return fmt.Errorf("$INCLUDE is only allowed in zone files")
+		}
+		if l.depth >= maxIncludeDepth {
+			return fmt.Errorf("$INCLUDE nested too deeply")
+		}
+
+		includePath := tokens[1].text
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(path), includePath)
+		}
+
+		// The included file's origin does not leak back into this one
+		savedOrigin, savedOwner, savedHasOwner := l.origin, l.lastOwner, l.hasOwner
+		if len(tokens) == 3 {
+			l.origin = l.absoluteName(tokens[2].text)
+		}
+
+		l.depth++
+		err := l.loadFile(includePath)
+		l.depth--
+
+		l.origin, l.lastOwner, l.hasOwner = savedOrigin, savedOwner, savedHasOwner
+		return err
+
+	default:
+		return fmt.Errorf("unknown directive %s", tokens[0].text)
+	}
+}
+
+func (l *loader) processRecord(e entry) error {
+	tokens := e.tokens
+
+	owner := l.lastOwner
+	if !e.blankOwner {
+		owner = l.absoluteName(tokens[0].text)
+		tokens = tokens[1:]
+	} else if !l.hasOwner {
+		return fmt.Errorf("record has no owner name")
+	}
+	l.lastOwner = owner
+	l.hasOwner = true
+
+	// TTL and class may appear in either order before the type
+	var ttl uint32
+	hasTTL := false
+	class := uint16(protocol.ClassIN)
+
+	for len(tokens) > 0 {
+		text := tokens[0].text
+		if c, found := protocol.StringToClass(text); found && !tokens[0].quoted {
+			class = c
+			tokens = tokens[1:]
+			continue
+		}
+		if !hasTTL && !tokens[0].quoted && len(text) > 0 && unicode.IsDigit(rune(text[0])) {
+			value, err := parseTTL(text)
+			if err != nil {
+				return err
+			}
+			ttl = value
+			hasTTL = true
+			tokens = tokens[1:]
+			continue
+		}
+		break
+	}
+
+	if len(tokens) == 0 {
+		return fmt.Errorf("missing record type")
+	}
+	if class != protocol.ClassIN {
+		return fmt.Errorf("unsupported class %s", protocol.ClassToString(class))
+	}
+
+	rrType, found := protocol.StringToType(tokens[0].text)
+	if !found || tokens[0].quoted {
+		return fmt.Errorf("unknown record type %s", tokens[0].text)
+	}
+
+	data, err := parseRecordData(rrType, tokens[1:], l.absoluteName)
+	if err != nil {
+		return fmt.Errorf("%s record: %w", protocol.TypeToString(rrType), err)
+	}
+
+	if !hasTTL {
+		switch {
+		case l.hasTTL:
+			ttl = l.defaultTTL
+		case rrType == protocol.TypeSOA:
+			// Before $TTL existed, the SOA MINIMUM was the default TTL
+			ttl = data.(*protocol.SOARecord).Minimum
+		default:
+			ttl = l.lastTTL
+		}
+	}
+	l.lastTTL = ttl
+
+	record, err := protocol.NewRecord(owner, rrType, ttl, data)
+	if err != nil {
+		return err
+	}
+
+	return l.zone.add(record)
+}
+
+// absoluteName resolves a name from the file against the current origin.
+func (l *loader) absoluteName(name string) string {
+	if name == "@" {
+		return l.origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return normalizeName(name)
+	}
+	if l.origin == "" {
+		return normalizeName(name)
+	}
+	return normalizeName(name + "." + l.origin)
+}
+
+// parseTTL accepts plain seconds or BIND-style unit suffixes like 1h30m.
+func parseTTL(s string) (uint32, error) {
+	if value, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(value), nil
+	}
+
+	var total, current uint64
+	hasDigits := false
+
+	for _, c := range strings.ToLower(s) {
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			hasDigits = true
+			continue
+		}
+
+		if !hasDigits {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+
+		switch c {
+		case 's':
+		case 'm':
+			current *= 60
+		case 'h':
+			current *= 3600
+		case 'd':
+			current *= 86400
+		case 'w':
+			current *= 604800
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+
+		total += current
+		current = 0
+		hasDigits = false
+	}
+
+	total += current
+	if total > 0xFFFFFFFF {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return uint32(total), nil
+}
+
+// tokenize splits master file text into entries, handling comments,
+// quoted strings and parenthesised continuation lines.
+func tokenize(text string) ([]entry, error) {
+	var entries []entry
+	var current entry
+	line := 1
+	depth := 0
+	atLineStart := true
+
+	flush := func() {
+		if len(current.tokens) > 0 {
+			entries = append(entries, current)
+		}
+		current = entry{}
+	}
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == '\n':
+			if depth == 0 {
+				flush()
+				atLineStart = true
+			}
+			line++
+
+		case c == ';':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			i--
+
+		case c == ' ' || c == '\t' || c == '\r':
+			if atLineStart && depth == 0 && len(current.tokens) == 0 {
+				current.blankOwner = true
+			}
+			atLineStart = false
+
+		case c == '(':
+			depth++
+			atLineStart = false
+
+		case c == ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parenthesis", line)
+			}
+			depth--
+
+		case c == '"':
+			start := line
+			var sb strings.Builder
+			i++
+			for ; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\n' {
+					line++
+				}
+				if text[i] == '\\' && i+1 < len(text) {
+					decoded, width := decodeEscape(text[i+1:])
+					sb.WriteString(decoded)
+					i += width
+					continue
+				}
+				sb.WriteByte(text[i])
+			}
+			if i >= len(text) {
+				return nil, fmt.Errorf("line %d: unterminated quoted string", start)
+			}
+			if len(current.tokens) == 0 {
+				current.line = line
+			}
+			current.tokens = append(current.tokens, token{text: sb.String(), quoted: true})
+			atLineStart = false
+
+		default:
+			var sb strings.Builder
+			for ; i < len(text); i++ {
+				c := text[i]
+				if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '(' || c == ')' || c == '"' {
+					break
+				}
+				sb.WriteByte(c)
+			}
+			i--
+			if len(current.tokens) == 0 {
+				current.line = line
+			}
+			current.tokens = append(current.tokens, token{text: sb.String()})
+			atLineStart = false
+		}
+	}
+
+	if depth != 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parenthesis", line)
+	}
+	flush()
+
+	return entries, nil
+}
+
+// decodeEscape decodes a \X or \DDD escape inside a quoted string and
+// returns the text and the number of bytes consumed after the backslash.
+func decodeEscape(s string) (string, int) {
+	if len(s) >= 3 && isDigit(s[0]) && isDigit(s[1]) && isDigit(s[2]) {
+		value, _ := strconv.Atoi(s[:3])
+		if value <= 255 {
+			return string([]byte{byte(value)}), 3
+		}
+	}
+	return s[:1], 1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
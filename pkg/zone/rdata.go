@@ -0,0 +1,246 @@
+package zone
+
+import (
+	"DNS-server/internal/protocol"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseRecordData converts the presentation-format RDATA fields of a
+// master file entry into typed data. Names are made absolute with
+// absoluteName.
+func parseRecordData(rrType uint16, tokens []token, absoluteName func(string) string) (protocol.RecordData, error) {
+	if len(tokens) > 0 && tokens[0].text == `\#` && !tokens[0].quoted {
+		return parseGenericData(rrType, tokens[1:])
+	}
+
+	fields := make([]string, len(tokens))
+	for i, t := range tokens {
+		fields[i] = t.text
+	}
+
+	switch rrType {
+	case protocol.TypeA:
+		if err := expectFields(fields, 1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", fields[0])
+		}
+		return &protocol.ARecord{IP: ip.To4()}, nil
+
+	case protocol.TypeAAAA:
+		if err := expectFields(fields, 1); err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || !strings.Contains(fields[0], ":") {
+			return nil, fmt.Errorf("invalid IPv6 address %q", fields[0])
+		}
+		return &protocol.AAAARecord{IP: ip}, nil
+
+	case protocol.TypeNS:
+		if err := expectFields(fields, 1); err != nil {
+			return nil, err
+		}
+		return &protocol.NSRecord{Host: absoluteName(fields[0])}, nil
+
+	case protocol.TypeCNAME:
+		if err := expectFields(fields, 1); err != nil {
+			return nil, err
+		}
+		return &protocol.CNAMERecord{Target: absoluteName(fields[0])}, nil
+
+	case protocol.TypePTR:
+		if err := expectFields(fields, 1); err != nil {
+			return nil, err
+		}
+		return &protocol.PTRRecord{Target: absoluteName(fields[0])}, nil
+
+	case protocol.TypeMX:
+		if err := expectFields(fields, 2); err != nil {
+			return nil, err
+		}
+		preference, err := parseUint16(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.MXRecord{Preference: preference, Exchange: absoluteName(fields[1])}, nil
+
+	case protocol.TypeTXT:
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("missing text")
+		}
+		for _, f := range fields {
+			if len(f) > 255 {
+				return nil, fmt.Errorf("text string longer than 255 bytes")
+			}
+		}
+		return &protocol.TXTRecord{Strings: fields}, nil
+
+	case protocol.TypeSOA:
+		if err := expectFields(fields, 7); err != nil {
+			return nil, err
+		}
+		soa := &protocol.SOARecord{
+			MName: absoluteName(fields[0]),
+			RName: absoluteName(fields[1]),
+		}
+		for i, field := range []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum} {
+			value, err := parseTTL(fields[2+i])
+			if err != nil {
+				return nil, err
+			}
+			*field = value
+		}
+		return soa, nil
+
+	case protocol.TypeSRV:
+		if err := expectFields(fields, 4); err != nil {
+			return nil, err
+		}
+		srv := &protocol.SRVRecord{Target: absoluteName(fields[3])}
+		for i, field := range []*uint16{&srv.Priority, &srv.Weight, &srv.Port} {
+			value, err := parseUint16(fields[i])
+			if err != nil {
+				return nil, err
+			}
+			*field = value
+		}
+		return srv, nil
+
+	case protocol.TypeCAA:
+		if err := expectFields(fields, 3); err != nil {
+			return nil, err
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CAA flags %q", fields[0])
+		}
+		return &protocol.CAARecord{Flags: uint8(flags), Tag: fields[1], Value: fields[2]}, nil
+
+	case protocol.TypeNAPTR:
+		if err := expectFields(fields, 6); err != nil {
+			return nil, err
+		}
+		order, err := parseUint16(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		preference, err := parseUint16(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.NAPTRRecord{
+			Order:       order,
+			Preference:  preference,
+			Flags:       fields[2],
+			Services:    fields[3],
+			Regexp:      fields[4],
+			Replacement: absoluteName(fields[5]),
+		}, nil
+
+	case protocol.TypeDS:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("expected at least 4 fields, got %d", len(fields))
+		}
+		keyTag, err := parseUint16(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := parseUint8(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		digestType, err := parseUint8(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DS digest: %w", err)
+		}
+		return &protocol.DSRecord{KeyTag: keyTag, Algorithm: algorithm, DigestType: digestType, Digest: digest}, nil
+
+	case protocol.TypeDNSKEY:
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("expected at least 4 fields, got %d", len(fields))
+		}
+		flags, err := parseUint16(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		proto, err := parseUint8(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		algorithm, err := parseUint8(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNSKEY public key: %w", err)
+		}
+		return &protocol.DNSKEYRecord{Flags: flags, Protocol: proto, Algorithm: algorithm, PublicKey: key}, nil
+
+	default:
+		return nil, fmt.Errorf("presentation format not supported, use the \\# generic form")
+	}
+}
+
+// parseGenericData handles the RFC 3597 "\# length hex" form, which can
+// express any record type.
+func parseGenericData(rrType uint16, tokens []token) (protocol.RecordData, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("missing generic RDATA length")
+	}
+
+	length, err := strconv.Atoi(tokens[0].text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA length %q", tokens[0].text)
+	}
+
+	var hexData strings.Builder
+	for _, t := range tokens[1:] {
+		hexData.WriteString(t.text)
+	}
+
+	rdata, err := hex.DecodeString(hexData.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA: %w", err)
+	}
+	if len(rdata) != length {
+		return nil, fmt.Errorf("generic RDATA is %d bytes, declared %d", len(rdata), length)
+	}
+
+	return protocol.UnpackRecordData(rrType, rdata)
+}
+
+func expectFields(fields []string, n int) error {
+	if len(fields) != n {
+		return fmt.Errorf("expected %d fields, got %d", n, len(fields))
+	}
+	return nil
+}
+
+func parseUint16(s string) (uint16, error) {
+	value, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(value), nil
+}
+
+func parseUint8(s string) (uint8, error) {
+	value, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint8(value), nil
+}
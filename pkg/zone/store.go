@@ -0,0 +1,64 @@
+package zone
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Store holds every zone the server is authoritative for.
+type Store struct {
+	mu    sync.RWMutex
+	zones map[string]*Zone
+}
+
+func NewStore() *Store {
+	return &Store{
+		zones: make(map[string]*Zone),
+	}
+}
+
+// Add registers z, replacing any zone previously loaded for its origin.
+func (s *Store) Add(z *Zone) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.zones[z.Origin] = z
+}
+
+// LoadFile loads a master file and adds the zone to the store.
+func (s *Store) LoadFile(path, origin string) error {
+	z, err := LoadFile(path, origin)
+	if err != nil {
+		return fmt.Errorf("load zone %s: %w", fqdnOf(normalizeName(origin)), err)
+	}
+
+	s.Add(z)
+	return nil
+}
+
+// Find returns the most specific zone containing name, or nil if the
+// server is not authoritative for it.
+func (s *Store) Find(name string) *Zone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.zones) == 0 {
+		return nil
+	}
+
+	for candidate := normalizeName(name); ; candidate = parentName(candidate) {
+		if z, found := s.zones[candidate]; found {
+			return z
+		}
+		if candidate == "" {
+			return nil
+		}
+	}
+}
+
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.zones)
+}
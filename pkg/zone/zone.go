@@ -0,0 +1,277 @@
+package zone
+
+import (
+	"DNS-server/internal/protocol"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const maxCNAMEChain = 8
+
+var ErrNoSOA = errors.New("zone has no SOA record at its apex")
+
+// Zone holds the records of one authoritative zone, indexed by owner name
+// and type. Names are stored lowercased and without the trailing dot.
+type Zone struct {
+	Origin  string
+	soa     protocol.ResourceRecord
+	records map[string]map[uint16][]protocol.ResourceRecord
+	// names contains every owner name plus the empty non-terminals
+	// between owners and the apex
+	names map[string]bool
+}
+
+// Result is the outcome of an authoritative lookup, ready to be copied
+// into a response.
+type Result struct {
+	RCode         uint16
+	Authoritative bool
+	Answers       []protocol.ResourceRecord
+	Authorities   []protocol.ResourceRecord
+	Additional    []protocol.ResourceRecord
+}
+
+func newZone(origin string) *Zone {
+	return &Zone{
+		Origin:  origin,
+		records: make(map[string]map[uint16][]protocol.ResourceRecord),
+		names:   make(map[string]bool),
+	}
+}
+
+func (z *Zone) add(rr protocol.ResourceRecord) error {
+	name := normalizeName(rr.Name)
+	if !isSubdomain(name, z.Origin) {
+		return fmt.Errorf("%s is outside zone %s", fqdnOf(name), fqdnOf(z.Origin))
+	}
+
+	rr.Name = name
+	types, exists := z.records[name]
+	if !exists {
+		types = make(map[uint16][]protocol.ResourceRecord)
+		z.records[name] = types
+	}
+	types[rr.Type] = append(types[rr.Type], rr)
+
+	for n := name; ; n = parentName(n) {
+		z.names[n] = true
+		if n == z.Origin {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (z *Zone) finalize() error {
+	soa := z.records[z.Origin][protocol.TypeSOA]
+	if len(soa) != 1 {
+		return ErrNoSOA
+	}
+	z.soa = soa[0]
+
+	for name, types := range z.records {
+		if cnames, found := types[protocol.TypeCNAME]; found && (len(cnames) > 1 || len(types) > 1) {
+			return fmt.Errorf("CNAME at %s cannot coexist with other data", fqdnOf(name))
+		}
+	}
+
+	return nil
+}
+
+// Lookup answers name/qtype from the zone following RFC 1034 section
+// 4.3.2: delegations produce referrals with glue, CNAMEs are chased inside
+// the zone, wildcards are synthesised, and negative answers carry the SOA.
+func (z *Zone) Lookup(name string, qtype uint16) *Result {
+	result := &Result{Authoritative: true}
+	// Answers keep the spelling of the query, which also turns wildcard
+	// records into synthesised answers
+	owner := strings.TrimSuffix(name, ".")
+	name = normalizeName(name)
+
+	for chain := 0; chain <= maxCNAMEChain; chain++ {
+		if !isSubdomain(name, z.Origin) {
+			// The CNAME target lives elsewhere; the client follows it
+			return result
+		}
+
+		if referral := z.findDelegation(name, qtype); referral != nil {
+			if len(result.Answers) > 0 {
+				// Chased into a delegated child: hand back what we have
+				return result
+			}
+			result.Authoritative = false
+			result.Authorities = referral
+			result.Additional = z.glueFor(referral)
+			return result
+		}
+
+		types, found := z.findNode(name)
+		if !found {
+			if z.names[name] {
+				z.addNegative(result, protocol.RCodeNoError)
+			} else {
+				z.addNegative(result, protocol.RCodeNXDomain)
+			}
+			return result
+		}
+
+		if records, ok := types[qtype]; ok {
+			result.Answers = append(result.Answers, withOwner(records, owner)...)
+			result.Additional = append(result.Additional, z.additionalFor(records)...)
+			return result
+		}
+
+		cnames, ok := types[protocol.TypeCNAME]
+		if !ok || qtype == protocol.TypeCNAME {
+			z.addNegative(result, protocol.RCodeNoError)
+			return result
+		}
+
+		result.Answers = append(result.Answers, withOwner(cnames, owner)...)
+		name = normalizeName(cnames[0].Data.(*protocol.CNAMERecord).Target)
+		owner = name
+	}
+
+	return result
+}
+
+// findDelegation returns the NS records of a zone cut between the apex and
+// name, if there is one. DS queries for the cut itself are answered by
+// the parent side, so the cut's own name is skipped for them.
+func (z *Zone) findDelegation(name string, qtype uint16) []protocol.ResourceRecord {
+	if name == z.Origin {
+		return nil
+	}
+
+	labels := strings.Split(name, ".")
+	originLabels := 0
+	if z.Origin != "" {
+		originLabels = len(strings.Split(z.Origin, "."))
+	}
+
+	for i := len(labels) - originLabels - 1; i >= 0; i-- {
+		candidate := strings.Join(labels[i:], ".")
+		if candidate == name && qtype == protocol.TypeDS {
+			break
+		}
+		if ns, found := z.records[candidate][protocol.TypeNS]; found {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// findNode returns the records owned by name, falling back to a wildcard
+// at the closest encloser when name does not exist.
+func (z *Zone) findNode(name string) (map[uint16][]protocol.ResourceRecord, bool) {
+	if types, found := z.records[name]; found {
+		return types, true
+	}
+	if z.names[name] {
+		return nil, false
+	}
+
+	for encloser := parentName(name); isSubdomain(encloser, z.Origin); encloser = parentName(encloser) {
+		if z.names[encloser] {
+			wildcard := joinName("*", encloser)
+			types, found := z.records[wildcard]
+			return types, found
+		}
+		if encloser == z.Origin {
+			break
+		}
+	}
+
+	return nil, false
+}
+
+func (z *Zone) addNegative(result *Result, rcode uint16) {
+	soa := z.soa
+	// RFC 2308: negative answers are cached for min(SOA TTL, MINIMUM)
+	if minimum := soa.Data.(*protocol.SOARecord).Minimum; minimum < soa.TTL {
+		soa.TTL = minimum
+	}
+
+	result.RCode = rcode
+	result.Authorities = append(result.Authorities, soa)
+}
+
+// glueFor returns address records for in-zone nameservers of a referral.
+func (z *Zone) glueFor(nsRecords []protocol.ResourceRecord) []protocol.ResourceRecord {
+	var glue []protocol.ResourceRecord
+	for _, ns := range nsRecords {
+		glue = append(glue, z.addresses(ns.Data.(*protocol.NSRecord).Host)...)
+	}
+	return glue
+}
+
+// additionalFor returns in-zone addresses of the hosts named by answers,
+// sparing the client a follow-up query.
+func (z *Zone) additionalFor(records []protocol.ResourceRecord) []protocol.ResourceRecord {
+	var additional []protocol.ResourceRecord
+	for _, rr := range records {
+		switch data := rr.Data.(type) {
+		case *protocol.NSRecord:
+			additional = append(additional, z.addresses(data.Host)...)
+		case *protocol.MXRecord:
+			additional = append(additional, z.addresses(data.Exchange)...)
+		case *protocol.SRVRecord:
+			additional = append(additional, z.addresses(data.Target)...)
+		}
+	}
+	return additional
+}
+
+func (z *Zone) addresses(host string) []protocol.ResourceRecord {
+	host = normalizeName(host)
+	if !isSubdomain(host, z.Origin) {
+		return nil
+	}
+
+	var records []protocol.ResourceRecord
+	records = append(records, z.records[host][protocol.TypeA]...)
+	records = append(records, z.records[host][protocol.TypeAAAA]...)
+	return records
+}
+
+// withOwner copies records, renaming them to owner.
+func withOwner(records []protocol.ResourceRecord, owner string) []protocol.ResourceRecord {
+	copies := make([]protocol.ResourceRecord, len(records))
+	for i, rr := range records {
+		rr.Name = owner
+		copies[i] = rr
+	}
+	return copies
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func parentName(name string) string {
+	if idx := strings.Index(name, "."); idx != -1 {
+		return name[idx+1:]
+	}
+	return ""
+}
+
+func joinName(label, parent string) string {
+	if parent == "" {
+		return label
+	}
+	return label + "." + parent
+}
+
+func isSubdomain(name, origin string) bool {
+	if origin == "" || name == origin {
+		return true
+	}
+	return strings.HasSuffix(name, "."+origin)
+}
+
+func fqdnOf(name string) string {
+	return name + "."
+}
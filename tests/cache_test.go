@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCacheKeysRRsetsByType(t *testing.T) {
+	cache := resolver.NewDNSCache(models.DefaultCacheConfig())
+	defer cache.Close()
+
+	cache.SetRecords([]protocol.ResourceRecord{
+		mustRecord(t, "www.example.com", protocol.TypeCNAME, &protocol.CNAMERecord{Target: "web.example.com"}),
+		mustRecord(t, "web.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.1")}),
+		mustRecord(t, "web.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.2")}),
+	}, models.TrustAnswer)
+
+	if _, found := cache.Lookup("web.example.com", protocol.TypeMX, protocol.ClassIN); found {
+		t.Errorf("MX lookup answered from cached A records")
+	}
+
+	records, found := cache.Lookup("WWW.example.com.", protocol.TypeA, protocol.ClassIN)
+	if !found {
+		t.Fatalf("A lookup through cached CNAME missed")
+	}
+	if len(records) != 3 || records[0].Type != protocol.TypeCNAME {
+		t.Errorf("got %d records, want the CNAME followed by both addresses", len(records))
+	}
+	for _, rr := range records {
+		if rr.TTL == 0 || rr.TTL > 300 {
+			t.Errorf("%s TTL: got %d, want 1..300", rr.Name, rr.TTL)
+		}
+	}
+}
+
+func TestCacheGlueDoesNotOverrideAnswers(t *testing.T) {
+	cache := resolver.NewDNSCache(models.DefaultCacheConfig())
+	defer cache.Close()
+
+	answer := mustRecord(t, "ns1.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.53")})
+	glue := mustRecord(t, "ns1.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("198.51.100.1")})
+
+	cache.Set("ns1.example.com", protocol.TypeA, protocol.ClassIN, []protocol.ResourceRecord{answer}, models.TrustAnswer)
+	cache.Set("ns1.example.com", protocol.TypeA, protocol.ClassIN, []protocol.ResourceRecord{glue}, models.TrustGlue)
+
+	entry, found := cache.GetEntry("ns1.example.com", protocol.TypeA, protocol.ClassIN)
+	if !found {
+		t.Fatalf("entry not found")
+	}
+	if entry.Trust != models.TrustAnswer {
+		t.Errorf("trust: got %d, want answer", entry.Trust)
+	}
+	if ip, _ := entry.Records[0].GetStringData(); ip != "192.0.2.53" {
+		t.Errorf("address: got %s, want 192.0.2.53", ip)
+	}
+
+	// Glue alone is usable for resolution but never answers a client
+	cache.Set("ns2.example.com", protocol.TypeA, protocol.ClassIN, []protocol.ResourceRecord{glue}, models.TrustGlue)
+	if _, found := cache.Get("ns2.example.com", protocol.TypeA, protocol.ClassIN); !found {
+		t.Errorf("glue not cached")
+	}
+	if _, found := cache.Lookup("ns2.example.com", protocol.TypeA, protocol.ClassIN); found {
+		t.Errorf("glue returned as an answer")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	config := models.DefaultCacheConfig()
+	config.MaxNegativeTTL = time.Minute
+	cache := resolver.NewDNSCache(config)
+	defer cache.Close()
+
+	soa := mustRecord(t, "example.com", protocol.TypeSOA, &protocol.SOARecord{
+		MName: "ns1.example.com", RName: "hostmaster.example.com",
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 3600,
+	})
+	soa.TTL = 3600
+
+	if _, found := cache.GetNegative("missing.example.com", protocol.TypeA, protocol.ClassIN); found {
+		t.Fatalf("empty cache returned a negative entry")
+	}
+
+	cache.SetNegative("missing.example.com", protocol.TypeA, protocol.ClassIN, &resolver.NegativeResponse{NXDomain: true, SOA: &soa}, time.Hour)
+
+	negative, found := cache.GetNegative("missing.example.com", protocol.TypeA, protocol.ClassIN)
+	if !found {
+		t.Fatalf("negative entry not found")
+	}
+	if !errors.Is(negative, resolver.ErrNXDomain) {
+		t.Errorf("cached NXDOMAIN does not match ErrNXDomain")
+	}
+	// The hour-long TTL is capped at a minute and replayed in the SOA
+	if negative.SOA == nil || negative.SOA.TTL > 60 {
+		t.Errorf("replayed SOA TTL: got %v, want at most 60", negative.SOA)
+	}
+	if _, found := cache.GetNegative("missing.example.com", protocol.TypeAAAA, protocol.ClassIN); found {
+		t.Errorf("negative entry leaked to another type")
+	}
+
+	stats := cache.GetStats()
+	if stats.NegativeHits != 1 || stats.NegativeMisses != 2 || stats.NegativeEntries != 1 {
+		t.Errorf("stats: got %d hits, %d misses, %d entries, want 1, 2, 1",
+			stats.NegativeHits, stats.NegativeMisses, stats.NegativeEntries)
+	}
+	if stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("negative lookups counted as positive: %d hits, %d misses", stats.Hits, stats.Misses)
+	}
+}
+
+func TestCacheServesStaleWithinWindow(t *testing.T) {
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = time.Minute
+	config.StaleTTL = 30 * time.Second
+	cache := resolver.NewDNSCache(config)
+	defer cache.Close()
+
+	record := mustRecord(t, "api.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.80")})
+	record.TTL = 1
+	cache.SetRecords([]protocol.ResourceRecord{record}, models.TrustAnswer)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, found := cache.Lookup("api.example.com", protocol.TypeA, protocol.ClassIN); found {
+		t.Fatalf("expired entry returned as fresh")
+	}
+
+	records, found := cache.LookupStale("api.example.com", protocol.TypeA, protocol.ClassIN)
+	if !found {
+		t.Fatalf("expired entry not kept for the stale window")
+	}
+	if records[0].TTL != 30 {
+		t.Errorf("stale TTL: got %d, want 30", records[0].TTL)
+	}
+	if stats := cache.GetStats(); stats.StaleServed != 1 {
+		t.Errorf("stale answers served: got %d, want 1", stats.StaleServed)
+	}
+}
@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"DNS-server/data"
+	"DNS-server/internal/protocol"
+	"DNS-server/pkg/dnssec"
+	"crypto/ed25519"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signRRset signs a single-record RRset the way a zone signer would, so
+// tests need no fixtures from a real signed zone.
+func signRRset(t *testing.T, rr protocol.ResourceRecord, signer string, priv ed25519.PrivateKey, key *protocol.DNSKEYRecord, now time.Time) *protocol.RRSIGRecord {
+	t.Helper()
+
+	sig := &protocol.RRSIGRecord{
+		TypeCovered: rr.Type,
+		Algorithm:   dnssec.AlgorithmED25519,
+		Labels:      uint8(dnssec.CountLabels(rr.Name)),
+		OriginalTTL: rr.TTL,
+		Expiration:  uint32(now.Add(time.Hour).Unix()),
+		Inception:   uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:      dnssec.KeyTag(key),
+		SignerName:  signer,
+	}
+
+	signed, err := protocol.PackRecordData(sig)
+	if err != nil {
+		t.Fatalf("pack RRSIG: %v", err)
+	}
+	rdata, err := dnssec.CanonicalRData(rr)
+	if err != nil {
+		t.Fatalf("CanonicalRData: %v", err)
+	}
+	signed = append(signed, protocol.EncodeDomainName(protocol.CanonicalName(rr.Name))...)
+	signed = binary.BigEndian.AppendUint16(signed, rr.Type)
+	signed = binary.BigEndian.AppendUint16(signed, rr.Class)
+	signed = binary.BigEndian.AppendUint32(signed, rr.TTL)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+
+	sig.Signature = ed25519.Sign(priv, signed)
+	return sig
+}
+
+func TestDNSSECVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	key := &protocol.DNSKEYRecord{
+		Flags:     dnssec.FlagZoneKey,
+		Protocol:  3,
+		Algorithm: dnssec.AlgorithmED25519,
+		PublicKey: pub,
+	}
+	now := time.Now()
+
+	rr := mustRecord(t, "www.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.1")})
+	sig := signRRset(t, rr, "example.com", priv, key, now)
+
+	if err := dnssec.Verify([]protocol.ResourceRecord{rr}, sig, key, now); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	// Owner names are compared in canonical form, so 0x20 case survives
+	mixed := rr
+	mixed.Name = "WwW.ExAmPlE.cOm"
+	if err := dnssec.Verify([]protocol.ResourceRecord{mixed}, sig, key, now); err != nil {
+		t.Errorf("Verify with mixed case owner: %v", err)
+	}
+
+	tampered := mustRecord(t, "www.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.2")})
+	if err := dnssec.Verify([]protocol.ResourceRecord{tampered}, sig, key, now); !errors.Is(err, dnssec.ErrBadSignature) {
+		t.Errorf("Verify of tampered RRset: got %v, want ErrBadSignature", err)
+	}
+
+	if err := dnssec.Verify([]protocol.ResourceRecord{rr}, sig, key, now.Add(2*time.Hour)); !errors.Is(err, dnssec.ErrSignatureExpired) {
+		t.Errorf("Verify after expiry: got %v, want ErrSignatureExpired", err)
+	}
+	if err := dnssec.Verify([]protocol.ResourceRecord{rr}, sig, key, now.Add(-2*time.Hour)); !errors.Is(err, dnssec.ErrSignatureNotYetValid) {
+		t.Errorf("Verify before inception: got %v, want ErrSignatureNotYetValid", err)
+	}
+}
+
+func TestDNSSECMatchesDS(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	key := &protocol.DNSKEYRecord{
+		Flags:     dnssec.FlagZoneKey | dnssec.FlagSEP,
+		Protocol:  3,
+		Algorithm: dnssec.AlgorithmED25519,
+		PublicKey: pub,
+	}
+
+	digest, err := dnssec.Digest("example.com", key, dnssec.DigestSHA256)
+	if err != nil {
+		t.Fatalf("Digest: %v", err)
+	}
+	ds := &protocol.DSRecord{
+		KeyTag:     dnssec.KeyTag(key),
+		Algorithm:  dnssec.AlgorithmED25519,
+		DigestType: dnssec.DigestSHA256,
+		Digest:     digest,
+	}
+
+	if !dnssec.MatchesDS("Example.COM.", key, ds) {
+		t.Error("DS does not match its own key")
+	}
+	if dnssec.MatchesDS("example.net", key, ds) {
+		t.Error("DS matches the key at another owner")
+	}
+}
+
+func TestDNSSECParseRootAnchors(t *testing.T) {
+	for _, anchor := range data.RootTrustAnchors {
+		ds, err := dnssec.ParseDS(anchor)
+		if err != nil {
+			t.Fatalf("ParseDS(%q): %v", anchor, err)
+		}
+		if ds.Algorithm != dnssec.AlgorithmRSASHA256 || ds.DigestType != dnssec.DigestSHA256 || len(ds.Digest) != 32 {
+			t.Errorf("ParseDS(%q) = %+v", anchor, ds)
+		}
+	}
+
+	if _, err := dnssec.ParseDS("20326 8 2 not-hex"); err == nil {
+		t.Error("ParseDS accepted an invalid digest")
+	}
+}
+
+func TestDNSSECNSECDenial(t *testing.T) {
+	proof := []protocol.ResourceRecord{
+		mustRecord(t, "example.com", protocol.TypeNSEC, &protocol.NSECRecord{
+			NextDomain: "alpha.example.com",
+			Types:      []uint16{protocol.TypeNS, protocol.TypeSOA, protocol.TypeRRSIG, protocol.TypeNSEC, protocol.TypeDNSKEY},
+		}),
+		mustRecord(t, "alpha.example.com", protocol.TypeNSEC, &protocol.NSECRecord{
+			NextDomain: "delta.example.com",
+			Types:      []uint16{protocol.TypeA, protocol.TypeRRSIG, protocol.TypeNSEC},
+		}),
+	}
+
+	if err := dnssec.ProveNXDomain(proof, "beta.example.com"); err != nil {
+		t.Errorf("ProveNXDomain(beta): %v", err)
+	}
+	if err := dnssec.ProveNXDomain(proof, "alpha.example.com"); !errors.Is(err, dnssec.ErrNoProof) {
+		t.Errorf("ProveNXDomain(alpha): got %v, want ErrNoProof", err)
+	}
+
+	if err := dnssec.ProveNoData(proof, "alpha.example.com", protocol.TypeAAAA); err != nil {
+		t.Errorf("ProveNoData(alpha, AAAA): %v", err)
+	}
+	if err := dnssec.ProveNoData(proof, "alpha.example.com", protocol.TypeA); !errors.Is(err, dnssec.ErrTypeExists) {
+		t.Errorf("ProveNoData(alpha, A): got %v, want ErrTypeExists", err)
+	}
+}
+
+func TestDNSSECHashName(t *testing.T) {
+	// Test vectors from RFC 5155 appendix A
+	salt := []byte{0xaa, 0xbb, 0xcc, 0xdd}
+	tests := map[string]string{
+		"example":   "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example": "35mthgpgcu1qg68fab165klnsnk3dpvl",
+	}
+
+	for name, want := range tests {
+		got := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(dnssec.HashName(name, 12, salt)))
+		if got != want {
+			t.Errorf("HashName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
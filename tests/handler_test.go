@@ -0,0 +1,416 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/internal/server"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/resolver/resolvertest"
+	"DNS-server/pkg/zone"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// handlerZone is served authoritatively by the test handler. The TXT
+// RRsets at "medium" and "large" are about 750 and 2200 bytes on the
+// wire, one above the plain DNS limit and one above the EDNS default.
+func handlerZone() string {
+	var sb strings.Builder
+	sb.WriteString("$TTL 1h\n")
+	sb.WriteString("@ SOA ns1 admin 1 3600 600 86400 300\n")
+	sb.WriteString("@ NS ns1\n")
+	sb.WriteString("ns1 A 192.0.2.53\n")
+	sb.WriteString("www A 192.0.2.1\n")
+	filler := strings.Repeat("x", 60)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&sb, "medium TXT \"%02d%s\"\n", i, filler)
+	}
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&sb, "large TXT \"%02d%s\"\n", i, filler)
+	}
+	return sb.String()
+}
+
+// newTestHandler returns a handler that answers for handler.test from
+// handlerZone, with config adjusted by configure.
+func newTestHandler(t *testing.T, configure func(*server.Config)) *server.Handler {
+	t.Helper()
+
+	z, err := zone.Parse(handlerZone(), "handler.test")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	zones := zone.NewStore()
+	zones.Add(z)
+
+	config := server.DefaultConfig()
+	if configure != nil {
+		configure(config)
+	}
+	res := resolver.NewResolver(models.DefaultCacheConfig())
+	t.Cleanup(res.Close)
+	return server.NewHandler(config, zones, res)
+}
+
+// handlerQuery builds a query for name, with an OPT record advertising
+// udpSize unless it is zero.
+func handlerQuery(t *testing.T, name string, qtype uint16, udpSize uint16, configure func(*protocol.EDNS)) []byte {
+	t.Helper()
+
+	query := &protocol.Message{
+		Header:    protocol.Header{ID: 0xBEEF, Flags: protocol.FlagRD},
+		Questions: []protocol.Question{{Name: name, Type: qtype, Class: protocol.ClassIN}},
+	}
+	if udpSize > 0 {
+		e := protocol.NewEDNS(udpSize)
+		if configure != nil {
+			configure(e)
+		}
+		query.SetEDNS(e)
+	}
+	data, err := protocol.BuildMessage(query)
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	return data
+}
+
+func parseResponse(t *testing.T, data []byte) *protocol.Message {
+	t.Helper()
+
+	response, err := protocol.ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if response.Header.ID != 0xBEEF {
+		t.Errorf("response ID %#04x, want 0xBEEF", response.Header.ID)
+	}
+	return response
+}
+
+func TestHandlerEchoesEDNS(t *testing.T) {
+	handler := newTestHandler(t, nil)
+
+	data, err := handler.HandleUDPRequest(context.Background(), handlerQuery(t, "www.handler.test", protocol.TypeA, 4096, nil))
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	response := parseResponse(t, data)
+	e, err := response.EDNS()
+	if err != nil || e == nil {
+		t.Fatalf("EDNS query answered without an OPT record (%v)", err)
+	}
+	if e.Version != 0 {
+		t.Errorf("EDNS version %d, want 0", e.Version)
+	}
+	if e.UDPSize != protocol.DefaultEDNSPayloadSize {
+		t.Errorf("advertised payload size %d, want %d", e.UDPSize, protocol.DefaultEDNSPayloadSize)
+	}
+
+	if e.DO {
+		t.Error("DO set in the response to a query without it")
+	}
+
+	data, err = handler.HandleUDPRequest(context.Background(), handlerQuery(t, "www.handler.test", protocol.TypeA, 4096, func(e *protocol.EDNS) { e.DO = true }))
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	if e, _ := parseResponse(t, data).EDNS(); e == nil || !e.DO {
+		t.Error("DO not echoed in the response OPT record")
+	}
+
+	// Clients that do not speak EDNS must not get an OPT record back
+	data, err = handler.HandleUDPRequest(context.Background(), handlerQuery(t, "www.handler.test", protocol.TypeA, 0, nil))
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	if e, _ := parseResponse(t, data).EDNS(); e != nil {
+		t.Error("plain DNS query answered with an OPT record")
+	}
+}
+
+func TestHandlerAnswersBADVERS(t *testing.T) {
+	handler := newTestHandler(t, nil)
+	query := handlerQuery(t, "www.handler.test", protocol.TypeA, 4096, func(e *protocol.EDNS) { e.Version = 1 })
+
+	data, err := handler.HandleUDPRequest(context.Background(), query)
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	response := parseResponse(t, data)
+	if rcode := response.RCode(); rcode != protocol.RCodeBadVers {
+		t.Errorf("RCODE %s, want BADVERS", protocol.RCodeToString(rcode))
+	}
+	if len(response.Answers) != 0 {
+		t.Errorf("BADVERS response carries %d answers", len(response.Answers))
+	}
+	if e, _ := response.EDNS(); e == nil || e.Version != 0 {
+		t.Errorf("BADVERS response OPT %+v, want version 0", e)
+	}
+}
+
+func TestHandlerNegotiatesUDPPayloadSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		qname      string
+		clientSize uint16
+		serverMax  int
+		limit      int
+		truncated  bool
+	}{
+		{"plain DNS fits 512", "www.handler.test", 0, 1232, 512, false},
+		{"plain DNS over 512", "medium.handler.test", 0, 1232, 512, true},
+		{"EDNS under both limits", "medium.handler.test", 1232, 1232, 1232, false},
+		{"client limit is smaller", "medium.handler.test", 600, 1232, 600, true},
+		{"server limit is smaller", "large.handler.test", 4096, 1232, 1232, true},
+		{"both limits large enough", "large.handler.test", 4096, 4096, 4096, false},
+		{"client size below 512 counts as 512", "medium.handler.test", 100, 1232, 512, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newTestHandler(t, func(c *server.Config) { c.MaxUDPSize = tt.serverMax })
+
+			data, err := handler.HandleUDPRequest(context.Background(), handlerQuery(t, tt.qname, protocol.TypeTXT, tt.clientSize, nil))
+			if err != nil {
+				t.Fatalf("HandleUDPRequest: %v", err)
+			}
+			if len(data) > tt.limit {
+				t.Errorf("response is %d bytes, over the %d byte limit", len(data), tt.limit)
+			}
+			response := parseResponse(t, data)
+			if got := response.Header.Flags&protocol.FlagTC != 0; got != tt.truncated {
+				t.Errorf("TC %v, want %v (%d bytes)", got, tt.truncated, len(data))
+			}
+		})
+	}
+}
+
+func TestHandlerDoesNotTruncateStreams(t *testing.T) {
+	handler := newTestHandler(t, nil)
+
+	data, err := handler.HandleRequest(context.Background(), handlerQuery(t, "large.handler.test", protocol.TypeTXT, 0, nil))
+	if err != nil {
+		t.Fatalf("HandleRequest: %v", err)
+	}
+	response := parseResponse(t, data)
+	if response.Header.Flags&protocol.FlagTC != 0 {
+		t.Error("TC set on a stream response")
+	}
+	if len(response.Answers) != 30 {
+		t.Errorf("%d answers, want all 30", len(response.Answers))
+	}
+}
+
+// validatingQuery asks the handler for name with the given header flags
+// besides RD, and an OPT record with DO set when do is.
+func validatingQuery(t *testing.T, handler *server.Handler, name string, flags uint16, do bool) *protocol.Message {
+	t.Helper()
+
+	query := &protocol.Message{
+		Header:    protocol.Header{ID: 0xBEEF, Flags: protocol.FlagRD | flags},
+		Questions: []protocol.Question{{Name: name, Type: protocol.TypeA, Class: protocol.ClassIN}},
+	}
+	if do {
+		e := protocol.NewEDNS(protocol.DefaultEDNSPayloadSize)
+		e.DO = true
+		query.SetEDNS(e)
+	}
+	data, err := protocol.BuildMessage(query)
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	response, err := handler.HandleUDPRequest(context.Background(), data)
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	return parseResponse(t, response)
+}
+
+// newValidatingHandler answers recursively, validating against the signed
+// fake hierarchy of newValidatingResolver.
+func newValidatingHandler(t *testing.T) (*server.Handler, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	res, hierarchy := newValidatingResolver(t)
+	return server.NewHandler(server.DefaultConfig(), zone.NewStore(), res), hierarchy
+}
+
+func TestHandlerSetsADOnlyWhenAsked(t *testing.T) {
+	handler, _ := newValidatingHandler(t)
+
+	tests := []struct {
+		desc   string
+		name   string
+		flags  uint16
+		do     bool
+		wantAD bool
+	}{
+		{"secure, plain query", "www.example.com", 0, false, false},
+		{"secure, DO", "www.example.com", 0, true, true},
+		{"secure, AD", "www.example.com", protocol.FlagAD, false, true},
+		{"insecure, DO", "www.example.net", 0, true, false},
+	}
+	for _, tt := range tests {
+		response := validatingQuery(t, handler, tt.name, tt.flags, tt.do)
+		if rcode := response.RCode(); rcode != protocol.RCodeNoError {
+			t.Errorf("%s: rcode %d, want NOERROR", tt.desc, rcode)
+		}
+		if gotAD := response.Header.Flags&protocol.FlagAD != 0; gotAD != tt.wantAD {
+			t.Errorf("%s: AD %v, want %v", tt.desc, gotAD, tt.wantAD)
+		}
+	}
+}
+
+func TestHandlerServFailsBogusAnswers(t *testing.T) {
+	handler, hierarchy := newValidatingHandler(t)
+	hierarchy.SetBehaviour(exampleCom, resolvertest.Forge)
+
+	response := validatingQuery(t, handler, "www.example.com", 0, true)
+	if rcode := response.RCode(); rcode != protocol.RCodeServFail {
+		t.Errorf("rcode %d, want SERVFAIL", rcode)
+	}
+	if len(response.Answers) != 0 {
+		t.Errorf("bogus answer handed out: %v", response.Answers)
+	}
+
+	// CD asks for the data anyway, without vouching for it
+	response = validatingQuery(t, handler, "www.example.com", protocol.FlagCD, true)
+	if rcode := response.RCode(); rcode != protocol.RCodeNoError {
+		t.Fatalf("CD query: rcode %d, want NOERROR", rcode)
+	}
+	assertAddresses(t, response.Answers, "203.0.113.66")
+	if response.Header.Flags&protocol.FlagCD == 0 {
+		t.Errorf("CD not echoed")
+	}
+	if response.Header.Flags&protocol.FlagAD != 0 {
+		t.Errorf("AD set on a bogus answer")
+	}
+}
+
+func countType(records []protocol.ResourceRecord, rrType uint16) int {
+	count := 0
+	for _, rr := range records {
+		if rr.Type == rrType {
+			count++
+		}
+	}
+	return count
+}
+
+func TestHandlerReturnsSignaturesWithDO(t *testing.T) {
+	handler, _ := newValidatingHandler(t)
+
+	// Asked twice, so the second answer comes from the cache
+	for i := 0; i < 2; i++ {
+		response := validatingQuery(t, handler, "www.example.com", protocol.FlagCD, true)
+		assertAddresses(t, response.Answers, "192.0.2.1")
+		if countType(response.Answers, protocol.TypeRRSIG) == 0 {
+			t.Errorf("query %d: DO and CD set, but no RRSIG in %v", i+1, response.Answers)
+		}
+
+		response = validatingQuery(t, handler, "www.example.com", 0, false)
+		if n := countType(response.Answers, protocol.TypeRRSIG); n != 0 {
+			t.Errorf("query %d: %d RRSIGs handed to a client without DO", i+1, n)
+		}
+	}
+
+	// Denials come with their proof
+	response := validatingQuery(t, handler, "missing.example.com", 0, true)
+	if rcode := response.RCode(); rcode != protocol.RCodeNXDomain {
+		t.Fatalf("rcode %d, want NXDOMAIN", rcode)
+	}
+	if countType(response.Authorities, protocol.TypeNSEC) == 0 || countType(response.Authorities, protocol.TypeRRSIG) == 0 {
+		t.Errorf("NXDOMAIN for a DO client without its proof: %v", response.Authorities)
+	}
+
+	response = validatingQuery(t, handler, "missing.example.com", 0, false)
+	if n := countType(response.Authorities, protocol.TypeNSEC) + countType(response.Authorities, protocol.TypeRRSIG); n != 0 {
+		t.Errorf("%d proof records handed to a client without DO", n)
+	}
+}
+
+// askHandler sends handler an A query for name with exactly the header
+// flags given.
+func askHandler(t *testing.T, handler *server.Handler, name string, flags uint16) *protocol.Message {
+	t.Helper()
+
+	data, err := protocol.BuildMessage(&protocol.Message{
+		Header:    protocol.Header{ID: 0xBEEF, Flags: flags},
+		Questions: []protocol.Question{{Name: name, Type: protocol.TypeA, Class: protocol.ClassIN}},
+	})
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	response, err := handler.HandleUDPRequest(context.Background(), data)
+	if err != nil {
+		t.Fatalf("HandleUDPRequest: %v", err)
+	}
+	return parseResponse(t, response)
+}
+
+func TestHandlerAnswersNonRecursiveQueriesFromCache(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	handler := server.NewHandler(server.DefaultConfig(), zone.NewStore(), res)
+
+	// Nothing cached yet, and nothing is looked up
+	response := askHandler(t, handler, "www.example.com", 0)
+	if rcode := response.RCode(); rcode != protocol.RCodeNoError {
+		t.Fatalf("rcode %d, want NOERROR", rcode)
+	}
+	if len(response.Answers) != 0 || len(response.Authorities) != 0 {
+		t.Errorf("answered %v %v with nothing cached", response.Answers, response.Authorities)
+	}
+	if n := len(hierarchy.Queries(rootServer)); n != 0 {
+		t.Fatalf("query without RD sent %d queries upstream", n)
+	}
+	if response.Header.Flags&protocol.FlagRA == 0 {
+		t.Error("RA clear though recursion is available")
+	}
+
+	askHandler(t, handler, "www.example.com", protocol.FlagRD)
+
+	response = askHandler(t, handler, "www.example.com", 0)
+	assertAddresses(t, response.Answers, "192.0.2.1")
+	if response.Header.Flags&(protocol.FlagRD|protocol.FlagAA) != 0 {
+		t.Errorf("flags %#04x: RD or AA set on a cached answer to a query without RD", response.Header.Flags)
+	}
+
+	// A name not cached under a cached cut is referred to its servers
+	queries := len(hierarchy.Queries(exampleCom))
+	response = askHandler(t, handler, "api.example.com", 0)
+	if len(response.Answers) != 0 || countType(response.Authorities, protocol.TypeNS) == 0 {
+		t.Errorf("got answers %v and authorities %v, want a referral", response.Answers, response.Authorities)
+	}
+	for _, rr := range response.Authorities {
+		if !protocol.EqualNames(rr.Name, "example.com") {
+			t.Errorf("referral to %s, want example.com", rr.Name)
+		}
+	}
+	if got := len(hierarchy.Queries(exampleCom)); got != queries {
+		t.Errorf("query without RD sent %d queries upstream", got-queries)
+	}
+}
+
+func TestHandlerWithoutRecursionOnlyUsesCache(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	config := server.DefaultConfig()
+	config.EnableRecursion = false
+	handler := server.NewHandler(config, zone.NewStore(), res)
+
+	response := askHandler(t, handler, "www.example.com", protocol.FlagRD)
+	if rcode := response.RCode(); rcode != protocol.RCodeNoError {
+		t.Fatalf("rcode %d, want NOERROR", rcode)
+	}
+	if response.Header.Flags&protocol.FlagRA != 0 {
+		t.Error("RA set with recursion off")
+	}
+	if response.Header.Flags&protocol.FlagRD == 0 {
+		t.Error("RD not copied from the query")
+	}
+	if n := len(hierarchy.Queries(rootServer)); n != 0 {
+		t.Errorf("recursion off, but %d queries sent upstream", n)
+	}
+}
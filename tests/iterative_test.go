@@ -0,0 +1,503 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/resolver/resolvertest"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	rootServer   = "198.51.100.1"
+	comServer1   = "198.51.100.10"
+	comServer2   = "198.51.100.11"
+	netServer    = "198.51.100.20"
+	exampleCom   = "198.51.100.30"
+	exampleNet   = "198.51.100.40"
+	testZonesTTL = "$TTL 1h\n"
+)
+
+var testHierarchy = []struct {
+	servers []string
+	origin  string
+	text    string
+}{
+	{[]string{rootServer}, ".", `
+@                 SOA a.root-servers.test. admin.test. 1 3600 600 86400 300
+@                 NS  a.root-servers.test.
+com.              NS  ns1.nic.com.
+com.              NS  ns2.nic.com.
+ns1.nic.com.      A   198.51.100.10
+ns2.nic.com.      A   198.51.100.11
+net.              NS  ns.nic.net.
+ns.nic.net.       A   198.51.100.20
+`},
+	{[]string{comServer1, comServer2}, "com", `
+$ORIGIN com.
+@                 SOA ns1.nic admin.nic 1 3600 600 86400 300
+@                 NS  ns1.nic
+@                 NS  ns2.nic
+ns1.nic           A   198.51.100.10
+ns2.nic           A   198.51.100.11
+example           NS  ns1.example
+ns1.example       A   198.51.100.30
+glueless          NS  ns.example.net.
+`},
+	{[]string{netServer}, "net", `
+$ORIGIN net.
+@                 SOA ns.nic admin.nic 1 3600 600 86400 300
+@                 NS  ns.nic
+ns.nic            A   198.51.100.20
+example           NS  ns.example
+ns.example        A   198.51.100.40
+`},
+	{[]string{exampleCom}, "example.com", `
+$ORIGIN example.com.
+@                 SOA ns1 admin 1 3600 600 86400 300
+@                 NS  ns1
+ns1               A   198.51.100.30
+www               A   192.0.2.1
+alias             CNAME www.example.net.
+`},
+	{[]string{exampleNet}, "example.net", `
+$ORIGIN example.net.
+@                 SOA ns admin 1 3600 600 86400 300
+@                 NS  ns
+ns                A   198.51.100.40
+www               A   192.0.2.2
+`},
+	{[]string{exampleNet}, "glueless.com", `
+$ORIGIN glueless.com.
+@                 SOA ns.example.net. admin 1 3600 600 86400 300
+@                 NS  ns.example.net.
+www               A   192.0.2.3
+`},
+}
+
+// newTestHierarchy serves the zones above from their fake servers.
+func newTestHierarchy(t *testing.T) *resolvertest.Hierarchy {
+	t.Helper()
+
+	hierarchy := resolvertest.NewHierarchy()
+	for _, z := range testHierarchy {
+		for _, ip := range z.servers {
+			if err := hierarchy.AddZone(ip, z.origin, testZonesTTL+z.text); err != nil {
+				t.Fatalf("AddZone(%s): %v", z.origin, err)
+			}
+		}
+	}
+	return hierarchy
+}
+
+// newTestResolver returns a resolver that walks the fake hierarchy above
+// instead of the internet.
+func newTestResolver(t *testing.T) (*resolver.Resolver, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	hierarchy := newTestHierarchy(t)
+
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = 0
+	config.PrefetchPercent = 0
+
+	res := resolver.NewResolver(config)
+	res.SetExchanger(hierarchy)
+	res.SetRootServers([]string{rootServer})
+	t.Cleanup(res.Close)
+
+	return res, hierarchy
+}
+
+func assertAddresses(t *testing.T, records []protocol.ResourceRecord, want ...string) {
+	t.Helper()
+
+	var got []string
+	for _, rr := range records {
+		if rr.Type == protocol.TypeA {
+			ip, _ := rr.GetStringData()
+			got = append(got, ip)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got addresses %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got addresses %v, want %v", got, want)
+		}
+	}
+}
+
+func TestIterativeFollowsReferrals(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+
+	// QNAME minimisation keeps the full name away from the root
+	if askedFor(hierarchy.Queries(rootServer), "www.example.com") {
+		t.Error("root was asked for www.example.com")
+	}
+	if len(hierarchy.Queries(exampleCom)) == 0 {
+		t.Error("the example.com server was never asked")
+	}
+}
+
+func TestIterativeChasesCNAMEAcrossZones(t *testing.T) {
+	res, _ := newTestResolver(t)
+
+	records, err := res.Resolve(context.Background(), "alias.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(records) == 0 || records[0].Type != protocol.TypeCNAME {
+		t.Fatalf("answer does not start with the CNAME: %v", records)
+	}
+	assertAddresses(t, records, "192.0.2.2")
+}
+
+func TestIterativeResolvesGluelessNameservers(t *testing.T) {
+	res, _ := newTestResolver(t)
+
+	records, err := res.Resolve(context.Background(), "www.glueless.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.3")
+}
+
+func TestIterativeStartsAtCachedDelegation(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+
+	if _, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	rootQueries := len(hierarchy.Queries(rootServer))
+	comQueries := len(hierarchy.Queries(comServer1)) + len(hierarchy.Queries(comServer2))
+
+	// The example.com servers are known, so nothing above them is asked
+	_, err := res.Resolve(context.Background(), "missing.example.com", protocol.TypeA)
+	var negative *resolver.NegativeResponse
+	if !errors.As(err, &negative) || !negative.NXDomain {
+		t.Fatalf("Resolve: got %v, want NXDOMAIN", err)
+	}
+	if got := len(hierarchy.Queries(rootServer)); got != rootQueries {
+		t.Errorf("root asked %d more times for a name below a cached cut", got-rootQueries)
+	}
+	if got := len(hierarchy.Queries(comServer1)) + len(hierarchy.Queries(comServer2)); got != comQueries {
+		t.Errorf("com servers asked %d more times for a name below a cached cut", got-comQueries)
+	}
+
+	// Elsewhere in com resolution starts at the com servers, though the
+	// root is still asked about net for the glueless nameserver
+	records, err := res.Resolve(context.Background(), "www.glueless.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.3")
+	for _, q := range hierarchy.Queries(rootServer)[rootQueries:] {
+		if !protocol.EqualNames(q.Name, "net") {
+			t.Errorf("root was asked about %s with the com servers cached", q.Name)
+		}
+	}
+}
+
+func TestIterativeCutLookupsLeaveCacheStatsAlone(t *testing.T) {
+	res, _ := newTestResolver(t)
+
+	hit(t, res, "www.example.com", 2)
+	if _, err := res.Resolve(context.Background(), "ns1.example.com", protocol.TypeA); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	// Only the clients' lookups count; finding the closest cut for the
+	// second name does not
+	stats := res.GetStats()
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("got %d hits and %d misses, want 1 and 2", stats.Hits, stats.Misses)
+	}
+}
+
+func TestIterativeReturnsNXDomain(t *testing.T) {
+	res, _ := newTestResolver(t)
+
+	_, err := res.Resolve(context.Background(), "missing.example.com", protocol.TypeA)
+	var negative *resolver.NegativeResponse
+	if !errors.As(err, &negative) || !negative.NXDomain {
+		t.Fatalf("Resolve: got %v, want NXDOMAIN", err)
+	}
+	if negative.SOA == nil {
+		t.Error("NXDOMAIN without the zone's SOA")
+	}
+}
+
+// askedFor reports whether any of queries was for name.
+func askedFor(queries []protocol.Question, name string) bool {
+	for _, q := range queries {
+		if protocol.EqualNames(q.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestIterativeWithoutMinimisationSendsFullName(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	res.SetQNAMEMinimisation(resolver.MinimiseOff)
+
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+
+	for _, ip := range []string{rootServer, exampleCom} {
+		queries := hierarchy.Queries(ip)
+		if len(queries) == 0 {
+			t.Fatalf("%s was never asked", ip)
+		}
+		for _, q := range queries {
+			if !protocol.EqualNames(q.Name, "www.example.com") || q.Type != protocol.TypeA {
+				t.Errorf("%s was asked %s %s, want only the full question", ip, q.Name, protocol.TypeToString(q.Type))
+			}
+		}
+	}
+}
+
+// An NXDOMAIN for an ancestor of the query name ends resolution in strict
+// mode; relaxed mode distrusts it and asks for the full name.
+func TestIterativeMinimisationNXDomainForAncestor(t *testing.T) {
+	tests := []struct {
+		mode         string
+		asksFullName bool
+	}{
+		{resolver.MinimiseStrict, false},
+		{resolver.MinimiseRelaxed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			res, hierarchy := newTestResolver(t)
+			res.SetQNAMEMinimisation(tt.mode)
+
+			_, err := res.Resolve(context.Background(), "www.missing.example.com", protocol.TypeA)
+			var negative *resolver.NegativeResponse
+			if !errors.As(err, &negative) || !negative.NXDomain {
+				t.Fatalf("Resolve: got %v, want NXDOMAIN", err)
+			}
+
+			queries := hierarchy.Queries(exampleCom)
+			if !askedFor(queries, "missing.example.com") {
+				t.Error("the example.com server was not asked for the intermediate name")
+			}
+			if got := askedFor(queries, "www.missing.example.com"); got != tt.asksFullName {
+				t.Errorf("asked for the full name: %v, want %v", got, tt.asksFullName)
+			}
+		})
+	}
+}
+
+func TestIterativeFailsOverBadServers(t *testing.T) {
+	behaviours := map[string]resolvertest.Behaviour{
+		"timeout":        resolvertest.Timeout,
+		"refused":        resolvertest.Refuse,
+		"server failure": resolvertest.ServerFailure,
+		"wrong ID":       resolvertest.WrongID,
+		"wrong question": resolvertest.WrongQuestion,
+		"malformed":      resolvertest.Malformed,
+	}
+
+	for name, behaviour := range behaviours {
+		t.Run(name, func(t *testing.T) {
+			res, hierarchy := newTestResolver(t)
+			hierarchy.SetBehaviour(comServer1, behaviour)
+
+			records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			assertAddresses(t, records, "192.0.2.1")
+			if len(hierarchy.Queries(comServer2)) == 0 {
+				t.Error("the working com server was never asked")
+			}
+		})
+	}
+}
+
+func TestIterativeFailsWhenEveryServerTimesOut(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Timeout)
+	hierarchy.SetBehaviour(comServer2, resolvertest.Timeout)
+
+	if _, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA); !errors.Is(err, resolver.ErrResolutionFailed) {
+		t.Errorf("Resolve: got %v, want ErrResolutionFailed", err)
+	}
+}
+
+func TestIterativeFailsOnMalformedResponses(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Malformed)
+	hierarchy.SetBehaviour(comServer2, resolvertest.Malformed)
+
+	if _, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA); !errors.Is(err, resolver.ErrResolutionFailed) {
+		t.Errorf("Resolve: got %v, want ErrResolutionFailed", err)
+	}
+
+	// The broken answers were not cached: the name resolves once they are fixed
+	hierarchy.SetBehaviour(comServer1, resolvertest.Answer)
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve after recovery: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+}
+
+// resolveUncached resolves www.example.com n times, emptying the cache
+// first each time so every resolution walks down from the root again.
+func resolveUncached(t *testing.T, res *resolver.Resolver, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		res.ClearCache()
+		records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		assertAddresses(t, records, "192.0.2.1")
+	}
+}
+
+func TestIterativePrefersFasterServers(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetDelay(comServer1, 20*time.Millisecond)
+
+	resolveUncached(t, res, 200)
+
+	// Both servers are measured once; after that the slow one is only
+	// picked now and then to keep its estimate current
+	slow, fast := len(hierarchy.Queries(comServer1)), len(hierarchy.Queries(comServer2))
+	if slow+fast != 200 {
+		t.Fatalf("com servers asked %d times, want once per resolution", slow+fast)
+	}
+	if slow < 2 || slow > 40 {
+		t.Errorf("slow com server asked %d of 200 times, want only occasional exploration", slow)
+	}
+}
+
+func TestIterativeBacksOffTimedOutServer(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Timeout)
+
+	resolveUncached(t, res, 10)
+	if got := len(hierarchy.Queries(comServer1)); got != 1 {
+		t.Errorf("server in backoff asked %d times, want only the first timeout", got)
+	}
+}
+
+func TestIterativeSizesTimeoutsFromRTT(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+
+	resolve := func() time.Duration {
+		t.Helper()
+		res.ClearCache()
+		start := time.Now()
+		res.Resolve(context.Background(), "www.example.net", protocol.TypeA)
+		return time.Since(start)
+	}
+
+	// A quick answer brings the timeout down from the initial second to
+	// the 200ms floor
+	resolve()
+	hierarchy.SetBehaviour(netServer, resolvertest.Hang)
+	first := resolve()
+	if first < 150*time.Millisecond || first > 700*time.Millisecond {
+		t.Errorf("waited %v for a server measured as fast, want about 200ms", first)
+	}
+
+	// Every timeout in a row doubles it
+	second := resolve()
+	if second < first*3/2 {
+		t.Errorf("waited %v after a timeout, want about twice the %v before", second, first)
+	}
+}
+
+func TestIterativeToleratesCaseMangling(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(exampleCom, resolvertest.MangleCase)
+
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+}
+
+func TestIterativeFailsWhenEveryServerRefuses(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Refuse)
+	hierarchy.SetBehaviour(comServer2, resolvertest.Refuse)
+
+	_, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	var negative *resolver.NegativeResponse
+	if err == nil || errors.As(err, &negative) {
+		t.Errorf("Resolve: got %v, want a failure rather than an answer", err)
+	}
+}
+
+func TestIterativeStopsWhenCancelled(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Hang)
+	hierarchy.SetBehaviour(comServer2, resolvertest.Hang)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := res.Resolve(ctx, "www.example.com", protocol.TypeA)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Resolve: got %v, want context.Canceled", err)
+	}
+	// Each hanging server would otherwise hold the query for a second
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Resolve returned %v after cancellation", elapsed)
+	}
+}
+
+func TestIterativeEnforcesQueryBudget(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	res.SetTimeouts(200*time.Millisecond, 0)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Hang)
+	hierarchy.SetBehaviour(comServer2, resolvertest.Hang)
+
+	start := time.Now()
+	_, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if !errors.Is(err, resolver.ErrResolutionFailed) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Resolve: got %v, want a failure from the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Resolve took %v with a 200ms budget", elapsed)
+	}
+}
+
+func TestIterativeCapsEachHop(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	res.SetTimeouts(0, 50*time.Millisecond)
+	hierarchy.SetBehaviour(comServer1, resolvertest.Hang)
+
+	start := time.Now()
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Resolve took %v with a 50ms hop timeout", elapsed)
+	}
+}
@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/resolver/resolvertest"
+	"context"
+	"testing"
+	"time"
+)
+
+// shortLivedZone replaces example.com with one whose addresses live for
+// two seconds, so a hit after one second lands in a 50% prefetch window.
+const shortLivedZone = `
+$ORIGIN example.com.
+@                 SOA ns1 admin 1 3600 600 86400 300
+@                 NS  ns1
+ns1               A   198.51.100.30
+www          2    A   192.0.2.1
+api          2    A   192.0.2.5
+`
+
+const prefetchWindowOpens = 1100 * time.Millisecond
+
+// newShortTTLResolver returns a resolver walking the fake hierarchy with
+// shortLivedZone in it, and prefetch on for the last half of a TTL after
+// three hits unless configure says otherwise.
+func newShortTTLResolver(t *testing.T, configure func(*models.CacheConfig)) (*resolver.Resolver, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	hierarchy := newTestHierarchy(t)
+	if err := hierarchy.AddZone(exampleCom, "example.com", testZonesTTL+shortLivedZone); err != nil {
+		t.Fatalf("AddZone(example.com): %v", err)
+	}
+
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = 0
+	config.PrefetchPercent = 50
+	config.PrefetchMinHits = 3
+	if configure != nil {
+		configure(config)
+	}
+
+	res := resolver.NewResolver(config)
+	res.SetExchanger(hierarchy)
+	res.SetRootServers([]string{rootServer})
+	t.Cleanup(res.Close)
+
+	return res, hierarchy
+}
+
+// hit resolves name n times, expecting each answer to come from the cache
+// or the fake hierarchy without error.
+func hit(t *testing.T, res *resolver.Resolver, name string, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if _, err := res.Resolve(context.Background(), name, protocol.TypeA); err != nil {
+			t.Fatalf("Resolve(%s): %v", name, err)
+		}
+	}
+}
+
+func timesAsked(hierarchy *resolvertest.Hierarchy, ip, name string) int {
+	count := 0
+	for _, q := range hierarchy.Queries(ip) {
+		if protocol.EqualNames(q.Name, name) {
+			count++
+		}
+	}
+	return count
+}
+
+// assertTimesAsked waits for the server at ip to have been asked for name
+// want times, then checks it is asked no more often.
+func assertTimesAsked(t *testing.T, hierarchy *resolvertest.Hierarchy, ip, name string, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for timesAsked(hierarchy, ip, name) < want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := timesAsked(hierarchy, ip, name); got != want {
+		t.Errorf("%s asked for %s %d times, want %d", ip, name, got, want)
+	}
+}
+
+func TestPrefetchWaitsForMinHits(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, nil)
+
+	hit(t, res, "www.example.com", 1)
+	time.Sleep(prefetchWindowOpens)
+
+	hit(t, res, "www.example.com", 2)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 1)
+
+	hit(t, res, "www.example.com", 1)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 2)
+	if stats := res.GetStats(); stats.Prefetches != 1 {
+		t.Errorf("prefetches: got %d, want 1", stats.Prefetches)
+	}
+}
+
+func TestPrefetchOnlyNearExpiry(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, nil)
+
+	hit(t, res, "www.example.com", 10)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 1)
+
+	time.Sleep(prefetchWindowOpens)
+	hit(t, res, "www.example.com", 1)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 2)
+
+	// The refreshed entry starts a new TTL, out of the window again
+	hit(t, res, "www.example.com", 10)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 2)
+}
+
+func TestPrefetchStartsOncePerEntry(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, nil)
+
+	hit(t, res, "www.example.com", 3)
+	time.Sleep(prefetchWindowOpens)
+
+	hierarchy.SetDelay(exampleCom, 100*time.Millisecond)
+	hit(t, res, "www.example.com", 20)
+
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 2)
+	if stats := res.GetStats(); stats.Prefetches != 1 {
+		t.Errorf("prefetches: got %d, want 1", stats.Prefetches)
+	}
+}
+
+func TestPrefetchCapsConcurrency(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, func(config *models.CacheConfig) {
+		config.MaxConcurrentPrefetches = 1
+	})
+
+	hit(t, res, "www.example.com", 3)
+	hit(t, res, "api.example.com", 3)
+	time.Sleep(prefetchWindowOpens)
+
+	// The first refresh holds the only slot while api.example.com is due
+	hierarchy.SetDelay(exampleCom, 100*time.Millisecond)
+	hit(t, res, "www.example.com", 1)
+	hit(t, res, "api.example.com", 1)
+
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", 2)
+	assertTimesAsked(t, hierarchy, exampleCom, "api.example.com", 1)
+	stats := res.GetStats()
+	if stats.Prefetches != 1 || stats.PrefetchesDropped != 1 {
+		t.Errorf("got %d prefetches and %d dropped, want 1 and 1", stats.Prefetches, stats.PrefetchesDropped)
+	}
+
+	// A dropped prefetch is tried again on the next hit once a slot is free
+	hit(t, res, "api.example.com", 1)
+	assertTimesAsked(t, hierarchy, exampleCom, "api.example.com", 2)
+}
+
+func TestPrefetchRetriesAfterFailedRefresh(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, nil)
+
+	hit(t, res, "www.example.com", 3)
+	time.Sleep(prefetchWindowOpens)
+
+	hierarchy.SetBehaviour(exampleCom, resolvertest.ServerFailure)
+	hit(t, res, "www.example.com", 1)
+	deadline := time.Now().Add(time.Second)
+	for timesAsked(hierarchy, exampleCom, "www.example.com") < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	failed := timesAsked(hierarchy, exampleCom, "www.example.com")
+	if failed < 2 {
+		t.Fatalf("refresh never reached the server")
+	}
+
+	hierarchy.SetBehaviour(exampleCom, resolvertest.Answer)
+	hit(t, res, "www.example.com", 1)
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", failed+1)
+	if stats := res.GetStats(); stats.Prefetches != 2 {
+		t.Errorf("prefetches: got %d, want a second one after the failure", stats.Prefetches)
+	}
+}
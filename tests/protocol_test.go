@@ -0,0 +1,482 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustRecord(t testing.TB, name string, rrType uint16, data protocol.RecordData) protocol.ResourceRecord {
+	t.Helper()
+
+	rr, err := protocol.NewRecord(name, rrType, 300, data)
+	if err != nil {
+		t.Fatalf("NewRecord(%s, %s): %v", name, protocol.TypeToString(rrType), err)
+	}
+	return rr
+}
+
+func compressionTestMessage(t testing.TB) *protocol.Message {
+	return &protocol.Message{
+		Header:    protocol.Header{ID: 0x1234, Flags: protocol.FlagQR},
+		Questions: []protocol.Question{{Name: "www.example.com", Type: protocol.TypeA, Class: protocol.ClassIN}},
+		Answers: []protocol.ResourceRecord{
+			mustRecord(t, "www.example.com", protocol.TypeCNAME, &protocol.CNAMERecord{Target: "web.example.com"}),
+			mustRecord(t, "web.example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.1")}),
+		},
+		Authorities: []protocol.ResourceRecord{
+			mustRecord(t, "example.com", protocol.TypeNS, &protocol.NSRecord{Host: "ns1.example.com"}),
+			mustRecord(t, "example.com", protocol.TypeSOA, &protocol.SOARecord{
+				MName: "ns1.example.com", RName: "hostmaster.example.com",
+				Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 300,
+			}),
+		},
+		Additional: []protocol.ResourceRecord{
+			mustRecord(t, "example.com", protocol.TypeMX, &protocol.MXRecord{Preference: 10, Exchange: "mail.example.com"}),
+			mustRecord(t, "_sip._tcp.example.com", protocol.TypeSRV, &protocol.SRVRecord{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}),
+		},
+	}
+}
+
+func TestBuilderCompressionRoundTrip(t *testing.T) {
+	msg := compressionTestMessage(t)
+
+	compressed, err := protocol.BuildMessage(msg)
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+
+	builder := protocol.NewBuilder()
+	builder.SetCompression(false)
+	uncompressed, err := builder.BuildMessage(msg)
+	if err != nil {
+		t.Fatalf("BuildMessage without compression: %v", err)
+	}
+
+	if len(compressed) >= len(uncompressed) {
+		t.Errorf("compressed size %d, want less than %d", len(compressed), len(uncompressed))
+	}
+
+	for _, data := range [][]byte{compressed, uncompressed} {
+		parsed, err := protocol.ParseMessage(data)
+		if err != nil {
+			t.Fatalf("ParseMessage: %v", err)
+		}
+
+		if parsed.Questions[0].Name != "www.example.com" {
+			t.Errorf("question: got %q, want %q", parsed.Questions[0].Name, "www.example.com")
+		}
+
+		sections := [][2][]protocol.ResourceRecord{
+			{parsed.Answers, msg.Answers},
+			{parsed.Authorities, msg.Authorities},
+			{parsed.Additional, msg.Additional},
+		}
+		for _, section := range sections {
+			got, want := section[0], section[1]
+			if len(got) != len(want) {
+				t.Fatalf("section length: got %d, want %d", len(got), len(want))
+			}
+			for i := range want {
+				if got[i].Name != want[i].Name {
+					t.Errorf("owner name: got %q, want %q", got[i].Name, want[i].Name)
+				}
+				if got[i].Data.String() != want[i].Data.String() {
+					t.Errorf("%s rdata: got %q, want %q", got[i].Name, got[i].Data, want[i].Data)
+				}
+				if !bytes.Equal(got[i].RData, want[i].RData) {
+					t.Errorf("%s uncompressed rdata: got %x, want %x", got[i].Name, got[i].RData, want[i].RData)
+				}
+			}
+		}
+	}
+}
+
+func TestBuilderWithoutCompressionHasNoPointers(t *testing.T) {
+	msg := &protocol.Message{
+		Questions: []protocol.Question{{Name: "example.com", Type: protocol.TypeNS, Class: protocol.ClassIN}},
+		Answers: []protocol.ResourceRecord{
+			mustRecord(t, "example.com", protocol.TypeNS, &protocol.NSRecord{Host: "ns.example.com"}),
+		},
+	}
+
+	builder := protocol.NewBuilder()
+	builder.SetCompression(false)
+	data, err := builder.BuildMessage(msg)
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+
+	// Header, question, and an answer with owner, fixed fields and rdata
+	want := 12 + (13 + 4) + (13 + 10 + 16)
+	if len(data) != want {
+		t.Errorf("length: got %d, want %d", len(data), want)
+	}
+}
+
+func TestParsePointerChain(t *testing.T) {
+	data := []byte{
+		0x00, 0x01, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		// offset 12: question www.example.com A IN
+		3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0x00, 0x01, 0x00, 0x01,
+		// offset 33: answer owner mail -> example.com (offset 16)
+		4, 'm', 'a', 'i', 'l', 0xC0, 16,
+		0x00, 0x05, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2C, 0x00, 0x07,
+		// CNAME rdata: smtp -> mail.example.com (offset 33), itself a pointer
+		4, 's', 'm', 't', 'p', 0xC0, 33,
+	}
+
+	msg, err := protocol.ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+
+	if got := msg.Answers[0].Name; got != "mail.example.com" {
+		t.Errorf("owner name: got %q, want %q", got, "mail.example.com")
+	}
+
+	target, err := msg.Answers[0].GetStringData()
+	if err != nil {
+		t.Fatalf("GetStringData: %v", err)
+	}
+	if target != "smtp.mail.example.com" {
+		t.Errorf("CNAME target: got %q, want %q", target, "smtp.mail.example.com")
+	}
+}
+
+func TestParsePreservesNameCase(t *testing.T) {
+	query := &protocol.Message{
+		Header:    protocol.Header{ID: 1, Flags: 0x0100},
+		Questions: []protocol.Question{{Name: "wWw.ExAmPlE.cOm", Type: protocol.TypeA, Class: protocol.ClassIN}},
+	}
+	data, err := protocol.BuildMessage(query)
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+
+	msg, err := protocol.ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if got := msg.Questions[0].Name; got != "wWw.ExAmPlE.cOm" {
+		t.Errorf("question name: got %q, want the case as sent", got)
+	}
+
+	if !protocol.EqualNames(msg.Questions[0].Name, "www.example.com.") {
+		t.Errorf("EqualNames does not ignore case and the trailing dot")
+	}
+	if protocol.EqualNames("www.example.com", "www.example.co") {
+		t.Errorf("EqualNames matched different names")
+	}
+	if got := protocol.CanonicalName("WWW.Example.COM."); got != "www.example.com" {
+		t.Errorf("CanonicalName: got %q, want %q", got, "www.example.com")
+	}
+}
+
+func TestBuildTruncatedMessageSetsTC(t *testing.T) {
+	msg := &protocol.Message{
+		Header:    protocol.Header{ID: 1, Flags: protocol.FlagQR},
+		Questions: []protocol.Question{{Name: "big.example.com", Type: protocol.TypeTXT, Class: protocol.ClassIN}},
+	}
+	for i := 0; i < 10; i++ {
+		text := string(bytes.Repeat([]byte{'a' + byte(i)}, 200))
+		msg.Answers = append(msg.Answers, mustRecord(t, "big.example.com", protocol.TypeTXT, &protocol.TXTRecord{Strings: []string{text}}))
+	}
+	msg.SetEDNS(protocol.NewEDNS(1232))
+
+	data, err := protocol.BuildTruncatedMessage(msg, protocol.MinUDPPayloadSize)
+	if err != nil {
+		t.Fatalf("BuildTruncatedMessage: %v", err)
+	}
+	if len(data) > protocol.MinUDPPayloadSize {
+		t.Fatalf("length: got %d, want at most %d", len(data), protocol.MinUDPPayloadSize)
+	}
+
+	parsed, err := protocol.ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage: %v", err)
+	}
+	if parsed.Header.Flags&protocol.FlagTC == 0 {
+		t.Errorf("TC flag not set on truncated response")
+	}
+	if e, err := parsed.EDNS(); err != nil || e == nil {
+		t.Errorf("OPT record dropped from truncated response: %v", err)
+	}
+
+	full, err := protocol.BuildTruncatedMessage(msg, 65535)
+	if err != nil {
+		t.Fatalf("BuildTruncatedMessage: %v", err)
+	}
+	if parsed, _ := protocol.ParseMessage(full); parsed.Header.Flags&protocol.FlagTC != 0 || len(parsed.Answers) != 10 {
+		t.Errorf("response that fits was truncated")
+	}
+}
+
+var malformedMessages = []struct {
+	name string
+	data []byte
+	want error
+}{
+	{
+		name: "short header",
+		data: []byte{0x00, 0x01, 0x01, 0x00},
+		want: protocol.ErrTruncatedMessage,
+	},
+	{
+		name: "pointer to itself",
+		data: []byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xC0, 12, 0x00, 0x01, 0x00, 0x01,
+		},
+		want: protocol.ErrForwardPointer,
+	},
+	{
+		name: "pointer loop through a label",
+		data: []byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			1, 'a', 0xC0, 12, 0x00, 0x01, 0x00, 0x01,
+		},
+		want: protocol.ErrCompressionLoop,
+	},
+	{
+		name: "forward pointer",
+		data: []byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0xC0, 18, 0x00, 0x01, 0x00, 0x01, 1, 'a', 0,
+		},
+		want: protocol.ErrForwardPointer,
+	},
+	{
+		name: "label longer than 63 bytes",
+		data: append([]byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 64,
+		}, append(bytes.Repeat([]byte{'a'}, 64), 0, 0x00, 0x01, 0x00, 0x01)...),
+		want: protocol.ErrLabelTooLong,
+	},
+	{
+		name: "name longer than 255 bytes",
+		data: append([]byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}, append(bytes.Repeat(append([]byte{63}, bytes.Repeat([]byte{'a'}, 63)...), 5), 0, 0x00, 0x01, 0x00, 0x01)...),
+		want: protocol.ErrNameTooLong,
+	},
+	{
+		name: "trailing garbage",
+		data: []byte{
+			0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			1, 'a', 0, 0x00, 0x01, 0x00, 0x01, 0xDE, 0xAD,
+		},
+		want: protocol.ErrTrailingData,
+	},
+	{
+		name: "A record with five bytes of rdata",
+		data: []byte{
+			0x00, 0x01, 0x81, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+			0, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x05, 1, 2, 3, 4, 5,
+		},
+		want: protocol.ErrInvalidRData,
+	},
+}
+
+func TestParseMessageRejectsMalformed(t *testing.T) {
+	for _, tc := range malformedMessages {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := protocol.ParseMessage(tc.data)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+
+			var parseErr *protocol.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Errorf("error %v is not a *protocol.ParseError", err)
+			}
+		})
+	}
+}
+
+// The handler answers a malformed query FORMERR when it can read enough of
+// the header to address the answer, and drops it otherwise.
+func TestHandlerRejectsMalformedQueries(t *testing.T) {
+	handler := newTestHandler(t, nil)
+
+	for _, tc := range malformedMessages {
+		t.Run(tc.name, func(t *testing.T) {
+			data := append([]byte(nil), tc.data...)
+			if len(data) >= 2 {
+				data[0], data[1] = 0xBE, 0xEF
+			}
+			_, headerErr := protocol.ParseHeader(data)
+			isResponse := len(data) > 2 && data[2]&0x80 != 0
+
+			response, err := handler.HandleUDPRequest(context.Background(), data)
+			if headerErr != nil || isResponse {
+				if response != nil || err == nil {
+					t.Errorf("got a %d byte response and error %v, want the message dropped", len(response), err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("HandleUDPRequest: %v", err)
+			}
+			header, err := protocol.ParseHeader(response)
+			if err != nil {
+				t.Fatalf("ParseHeader: %v", err)
+			}
+			if header.ID != 0xBEEF {
+				t.Errorf("response ID %#04x, want 0xBEEF", header.ID)
+			}
+			if header.Flags&protocol.FlagQR == 0 {
+				t.Error("response without QR")
+			}
+			if rcode := header.Flags & 0x0F; rcode != protocol.RCodeFormErr {
+				t.Errorf("RCODE %s, want FORMERR", protocol.RCodeToString(rcode))
+			}
+		})
+	}
+}
+
+// rdataCases holds one value of every typed RDATA. complete is the
+// shortest prefix of the packed form that is itself valid RDATA; every
+// shorter prefix is truncated and must be rejected.
+var rdataCases = []struct {
+	rrType   uint16
+	data     protocol.RecordData
+	complete int
+}{
+	{protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.1")}, 4},
+	{protocol.TypeAAAA, &protocol.AAAARecord{IP: net.ParseIP("2001:db8::1")}, 16},
+	{protocol.TypeNS, &protocol.NSRecord{Host: "ns1.example.com"}, 17},
+	{protocol.TypeCNAME, &protocol.CNAMERecord{Target: "www.example.com"}, 17},
+	{protocol.TypePTR, &protocol.PTRRecord{Target: "host.example.com"}, 18},
+	{protocol.TypeMX, &protocol.MXRecord{Preference: 10, Exchange: "mail.example.com"}, 20},
+	{protocol.TypeTXT, &protocol.TXTRecord{Strings: []string{"hello", "world"}}, 6},
+	{protocol.TypeSOA, &protocol.SOARecord{
+		MName: "ns1.example.com", RName: "hostmaster.example.com",
+		Serial: 2024010101, Refresh: 3600, Retry: 600, Expire: 604800, Minimum: 300,
+	}, 61},
+	{protocol.TypeSRV, &protocol.SRVRecord{Priority: 1, Weight: 5, Port: 5060, Target: "sip.example.com"}, 23},
+	{protocol.TypeCAA, &protocol.CAARecord{Flags: 128, Tag: "issue", Value: "ca.example.net"}, 7},
+	{protocol.TypeNAPTR, &protocol.NAPTRRecord{
+		Order: 100, Preference: 10, Flags: "S", Services: "SIP+D2U", Regexp: "", Replacement: "_sip._udp.example.com",
+	}, 38},
+	{protocol.TypeDS, &protocol.DSRecord{KeyTag: 12345, Algorithm: 15, DigestType: 2, Digest: bytes.Repeat([]byte{0xAB}, 32)}, 4},
+	{protocol.TypeDNSKEY, &protocol.DNSKEYRecord{Flags: 257, Protocol: 3, Algorithm: 15, PublicKey: bytes.Repeat([]byte{0x01}, 32)}, 4},
+	{protocol.TypeRRSIG, &protocol.RRSIGRecord{
+		TypeCovered: protocol.TypeA, Algorithm: 15, Labels: 3, OriginalTTL: 3600,
+		Expiration: 1700003600, Inception: 1700000000, KeyTag: 12345, SignerName: "example.com",
+		Signature: bytes.Repeat([]byte{0x02}, 64),
+	}, 31},
+	{protocol.TypeNSEC, &protocol.NSECRecord{NextDomain: "b.example.com", Types: []uint16{protocol.TypeA, protocol.TypeRRSIG, protocol.TypeNSEC}}, 15},
+	{protocol.TypeNSEC3, &protocol.NSEC3Record{
+		HashAlgorithm: 1, Flags: 1, Iterations: 0, Salt: []byte{0xAA, 0xBB},
+		NextHashed: bytes.Repeat([]byte{0x03}, 20), Types: []uint16{protocol.TypeA, protocol.TypeRRSIG},
+	}, 28},
+	{protocol.TypeSVCB, &protocol.SVCBRecord{Priority: 1, Target: "svc.example.com", Params: []protocol.SVCParam{{Key: 1, Value: []byte{2, 'h', '2'}}}}, 19},
+	{protocol.TypeOPT, &protocol.OPTRecord{Options: []protocol.EDNSOption{{Code: 10, Data: bytes.Repeat([]byte{0x04}, 8)}}}, 12},
+}
+
+func TestRecordDataRoundTrip(t *testing.T) {
+	for _, tc := range rdataCases {
+		t.Run(protocol.TypeToString(tc.rrType), func(t *testing.T) {
+			packed, err := protocol.PackRecordData(tc.data)
+			if err != nil {
+				t.Fatalf("PackRecordData: %v", err)
+			}
+			unpacked, err := protocol.UnpackRecordData(tc.rrType, packed)
+			if err != nil {
+				t.Fatalf("UnpackRecordData: %v", err)
+			}
+			if got, want := unpacked.String(), tc.data.String(); got != want {
+				t.Errorf("round trip: got %q, want %q", got, want)
+			}
+
+			repacked, err := protocol.PackRecordData(unpacked)
+			if err != nil {
+				t.Fatalf("PackRecordData after round trip: %v", err)
+			}
+			if !bytes.Equal(repacked, packed) {
+				t.Errorf("repacked rdata %x, want %x", repacked, packed)
+			}
+		})
+	}
+}
+
+func TestRecordDataRejectsTruncation(t *testing.T) {
+	for _, tc := range rdataCases {
+		t.Run(protocol.TypeToString(tc.rrType), func(t *testing.T) {
+			packed, err := protocol.PackRecordData(tc.data)
+			if err != nil {
+				t.Fatalf("PackRecordData: %v", err)
+			}
+			if tc.complete > len(packed) {
+				t.Fatalf("complete length %d is past the %d packed bytes", tc.complete, len(packed))
+			}
+			for n := 1; n < tc.complete; n++ {
+				if _, err := protocol.UnpackRecordData(tc.rrType, packed[:n]); err == nil {
+					t.Errorf("accepted rdata cut to %d of %d bytes", n, len(packed))
+				}
+			}
+			if _, err := protocol.UnpackRecordData(tc.rrType, packed[:tc.complete]); err != nil {
+				t.Errorf("rejected the complete %d byte prefix: %v", tc.complete, err)
+			}
+		})
+	}
+}
+
+// A record whose RDLENGTH is too short for its type is rejected even when
+// the message carries more data after it for the parser to run into.
+func TestParseMessageRejectsShortRData(t *testing.T) {
+	for _, tc := range rdataCases {
+		// OPT only belongs in the additional section
+		if tc.rrType == protocol.TypeOPT {
+			continue
+		}
+		t.Run(protocol.TypeToString(tc.rrType), func(t *testing.T) {
+			packed, err := protocol.PackRecordData(tc.data)
+			if err != nil {
+				t.Fatalf("PackRecordData: %v", err)
+			}
+			cut := packed[:tc.complete-1]
+
+			// One answer owned by the root, followed by a TXT record
+			data := []byte{0x00, 0x01, 0x81, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01}
+			data = append(data, 0, byte(tc.rrType>>8), byte(tc.rrType), 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, byte(len(cut)>>8), byte(len(cut)))
+			data = append(data, cut...)
+			data = append(data, 0, 0x00, 0x10, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3C, 0x00, 0x06, 5, 'h', 'e', 'l', 'l', 'o')
+
+			if _, err := protocol.ParseMessage(data); err == nil {
+				t.Errorf("accepted a record with %d of %d rdata bytes", len(cut), len(packed))
+			}
+		})
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	valid, err := protocol.BuildMessage(compressionTestMessage(f))
+	if err != nil {
+		f.Fatalf("BuildMessage: %v", err)
+	}
+	f.Add(valid)
+	for _, tc := range malformedMessages {
+		f.Add(tc.data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := protocol.ParseMessage(data)
+		if err != nil {
+			var parseErr *protocol.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("error %v is not a *protocol.ParseError", err)
+			}
+			return
+		}
+
+		// Rebuilding whatever the parser accepts must not panic
+		protocol.BuildMessage(msg)
+	})
+}
@@ -0,0 +1,743 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/internal/transport"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/resolver/resolvertest"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingUpstream answers every query with one A record once released,
+// counting how many resolutions reach it.
+type blockingUpstream struct {
+	t       *testing.T
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (u *blockingUpstream) Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error) {
+	u.calls.Add(1)
+	<-u.release
+	return []protocol.ResourceRecord{
+		mustRecord(u.t, domain, protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.7")}),
+	}, nil
+}
+
+func TestResolverCoalescesInflightQueries(t *testing.T) {
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = 0
+	config.MaxCoalescedWaiters = 5
+
+	upstream := &blockingUpstream{t: t, release: make(chan struct{})}
+	res := resolver.NewResolverWithUpstream(config, upstream)
+	defer res.Close()
+
+	const clients = 8
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := res.Resolve(context.Background(), "burst.example.com", protocol.TypeA)
+			errs <- err
+		}()
+	}
+
+	// One leader, five waiters and two rejected clients
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := res.GetStats()
+		if stats.CoalescedQueries+stats.CoalesceRejected == clients-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clients never queued: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(upstream.release)
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Errorf("upstream resolutions: got %d, want 1", calls)
+	}
+	stats := res.GetStats()
+	if stats.CoalescedQueries != 5 || stats.CoalesceRejected != 2 || failed != 2 {
+		t.Errorf("got %d coalesced, %d rejected, %d failed, want 5, 2, 2",
+			stats.CoalescedQueries, stats.CoalesceRejected, failed)
+	}
+}
+
+// waitingUpstream answers once released, unless the resolution's context
+// ends first, which it records.
+type waitingUpstream struct {
+	t         *testing.T
+	started   chan struct{}
+	release   chan struct{}
+	cancelled chan struct{}
+}
+
+func (u *waitingUpstream) Resolve(ctx context.Context, domain string, recordType uint16) ([]protocol.ResourceRecord, error) {
+	u.started <- struct{}{}
+	select {
+	case <-u.release:
+		return []protocol.ResourceRecord{
+			mustRecord(u.t, domain, protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.8")}),
+		}, nil
+	case <-ctx.Done():
+		close(u.cancelled)
+		return nil, ctx.Err()
+	}
+}
+
+func newWaitingResolver(t *testing.T) (*resolver.Resolver, *waitingUpstream) {
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = 0
+
+	upstream := &waitingUpstream{
+		t:         t,
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+		cancelled: make(chan struct{}),
+	}
+	res := resolver.NewResolverWithUpstream(config, upstream)
+	t.Cleanup(res.Close)
+	return res, upstream
+}
+
+func TestResolverCancelsAbandonedResolution(t *testing.T) {
+	res, upstream := newWaitingResolver(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := res.Resolve(ctx, "gone.example.com", protocol.TypeA); !errors.Is(err, context.Canceled) {
+		t.Errorf("Resolve: got %v, want context.Canceled", err)
+	}
+	select {
+	case <-upstream.cancelled:
+	case <-time.After(time.Second):
+		t.Error("upstream resolution kept running after its only client left")
+	}
+}
+
+func TestResolverKeepsSharedResolutionForRemainingClients(t *testing.T) {
+	res, upstream := newWaitingResolver(t)
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := res.Resolve(first, "shared.example.com", protocol.TypeA)
+		firstErr <- err
+	}()
+	<-upstream.started
+
+	secondDone := make(chan error, 1)
+	var records []protocol.ResourceRecord
+	go func() {
+		var err error
+		records, err = res.Resolve(context.Background(), "shared.example.com", protocol.TypeA)
+		secondDone <- err
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for res.GetStats().CoalescedQueries == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second client never joined the resolution")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("first client: got %v, want context.Canceled", err)
+	}
+
+	close(upstream.release)
+	if err := <-secondDone; err != nil {
+		t.Fatalf("second client: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("second client got %d records, want 1", len(records))
+	}
+	select {
+	case <-upstream.cancelled:
+		t.Error("resolution was cancelled while a client still waited for it")
+	default:
+	}
+}
+
+// spoofingServer answers each query three times: first with the wrong ID,
+// then with the wrong question, and finally with the genuine answer.
+func spoofingServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, client, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			query, err := protocol.ParseMessage(buffer[:n])
+			if err != nil {
+				continue
+			}
+
+			genuine := protocol.CreateResponse(query, []protocol.ResourceRecord{
+				mustRecord(t, query.Questions[0].Name, protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.10")}),
+			})
+			genuine.Header.Flags |= protocol.FlagRA
+
+			wrongID := *genuine
+			wrongID.Header.ID++
+			wrongID.Answers = []protocol.ResourceRecord{
+				mustRecord(t, query.Questions[0].Name, protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("203.0.113.66")}),
+			}
+
+			wrongQuestion := wrongID
+			wrongQuestion.Header.ID = genuine.Header.ID
+			wrongQuestion.Questions = []protocol.Question{{Name: "attacker.example", Type: protocol.TypeA, Class: protocol.ClassIN}}
+
+			for _, msg := range []*protocol.Message{&wrongID, &wrongQuestion, genuine} {
+				data, err := protocol.BuildMessage(msg)
+				if err != nil {
+					continue
+				}
+				conn.WriteToUDP(data, client)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestForwarderIgnoresSpoofedResponses(t *testing.T) {
+	forwarder := resolver.NewForwarder([]string{spoofingServer(t)}, resolver.StrategyRoundRobin, time.Second, 0)
+	defer forwarder.Close()
+
+	records, err := forwarder.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if ip, _ := records[0].GetStringData(); ip != "192.0.2.10" {
+		t.Errorf("address: got %s, want the genuine 192.0.2.10", ip)
+	}
+}
+
+const (
+	upstream1 = "198.51.100.101"
+	upstream2 = "198.51.100.102"
+)
+
+// upstreamZone is what the fake recursive upstreams know: the root NS set
+// their health is probed with, and a few answers.
+const upstreamZone = `$TTL 1h
+@                   SOA ns.upstream.test. admin.upstream.test. 1 3600 600 86400 300
+@                   NS  ns.upstream.test.
+www.example.com.    A   192.0.2.1
+alias.example.com.  CNAME www.example.com.
+host.corp.example.  A   192.0.2.11
+other.corp.example. A   192.0.2.12
+a.corp.example.     A   192.0.2.13
+x.a.corp.example.   A   192.0.2.14
+`
+
+// newTestForwarder returns a forwarder over two fake upstreams that both
+// serve upstreamZone.
+func newTestForwarder(t *testing.T, strategy string, healthInterval time.Duration) (*resolver.Forwarder, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	hierarchy := resolvertest.NewHierarchy()
+	for _, ip := range []string{upstream1, upstream2} {
+		if err := hierarchy.AddZone(ip, ".", upstreamZone); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+	}
+
+	forwarder := resolver.NewForwarder([]string{upstream1, upstream2}, strategy, time.Second, healthInterval)
+	forwarder.SetExchanger(hierarchy)
+	t.Cleanup(forwarder.Close)
+	return forwarder, hierarchy
+}
+
+// forwardQueries resolves www.example.com n times, failing on any error.
+func forwardQueries(t *testing.T, forwarder *resolver.Forwarder, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		records, err := forwarder.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		assertAddresses(t, records, "192.0.2.1")
+	}
+}
+
+// addressQueries counts the A queries a fake upstream has had, leaving
+// out health probes.
+func addressQueries(hierarchy *resolvertest.Hierarchy, ip string) int {
+	count := 0
+	for _, q := range hierarchy.Queries(ip) {
+		if q.Type == protocol.TypeA {
+			count++
+		}
+	}
+	return count
+}
+
+func TestForwarderRoundRobin(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 0)
+
+	for i := 0; i < 4; i++ {
+		forwardQueries(t, forwarder, 1)
+		first, second := addressQueries(hierarchy, upstream1), addressQueries(hierarchy, upstream2)
+		if first+second != i+1 || first-second > 1 || second-first > 1 {
+			t.Fatalf("after %d queries: %d and %d to each upstream, want them alternating", i+1, first, second)
+		}
+	}
+}
+
+func TestForwarderRandom(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRandom, 0)
+	forwardQueries(t, forwarder, 100)
+
+	first, second := addressQueries(hierarchy, upstream1), addressQueries(hierarchy, upstream2)
+	if first+second != 100 {
+		t.Errorf("%d queries reached the upstreams, want 100", first+second)
+	}
+	if first == 0 || second == 0 {
+		t.Errorf("random selection used only one upstream: %d and %d", first, second)
+	}
+}
+
+func TestForwarderFastest(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyFastest, 0)
+	hierarchy.SetDelay(upstream1, 30*time.Millisecond)
+
+	// Each upstream is tried once before its speed is known
+	forwardQueries(t, forwarder, 2)
+	if addressQueries(hierarchy, upstream1) != 1 || addressQueries(hierarchy, upstream2) != 1 {
+		t.Fatalf("first two queries: %d and %d to each upstream, want one each",
+			addressQueries(hierarchy, upstream1), addressQueries(hierarchy, upstream2))
+	}
+
+	forwardQueries(t, forwarder, 5)
+	if got := addressQueries(hierarchy, upstream1); got != 1 {
+		t.Errorf("the slow upstream was asked %d more times", got-1)
+	}
+}
+
+func TestForwarderFailsOver(t *testing.T) {
+	behaviours := map[string]resolvertest.Behaviour{
+		"timeout":        resolvertest.Timeout,
+		"refused":        resolvertest.Refuse,
+		"server failure": resolvertest.ServerFailure,
+		"malformed":      resolvertest.Malformed,
+	}
+
+	for name, behaviour := range behaviours {
+		t.Run(name, func(t *testing.T) {
+			forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 0)
+			hierarchy.SetBehaviour(upstream1, behaviour)
+
+			forwardQueries(t, forwarder, 2)
+			if addressQueries(hierarchy, upstream1) == 0 {
+				t.Error("the failing upstream was never tried")
+			}
+			if got := addressQueries(hierarchy, upstream2); got != 2 {
+				t.Errorf("the working upstream answered %d queries, want 2", got)
+			}
+		})
+	}
+}
+
+func TestForwarderFailsWhenEveryUpstreamFails(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 0)
+	hierarchy.SetBehaviour(upstream1, resolvertest.Timeout)
+	hierarchy.SetBehaviour(upstream2, resolvertest.ServerFailure)
+
+	if _, err := forwarder.Resolve(context.Background(), "www.example.com", protocol.TypeA); err == nil {
+		t.Error("Resolve succeeded with every upstream failing")
+	}
+}
+
+func TestForwarderMarksFailingUpstreamDown(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 0)
+	hierarchy.SetBehaviour(upstream1, resolvertest.Timeout)
+
+	// Round robin keeps trying the failing upstream first every other
+	// query until it has failed three times in a row
+	forwardQueries(t, forwarder, 10)
+	if got := addressQueries(hierarchy, upstream1); got != 3 {
+		t.Errorf("failing upstream asked %d times, want 3 before it is taken out of rotation", got)
+	}
+}
+
+func TestForwarderHealthCheckRestoresUpstream(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 10*time.Millisecond)
+	hierarchy.SetBehaviour(upstream1, resolvertest.Timeout)
+
+	probes := func() int { return len(hierarchy.Queries(upstream1)) - addressQueries(hierarchy, upstream1) }
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// A failed probe takes the upstream out of rotation at once
+	waitFor("a failed probe", func() bool { return probes() > 0 })
+	forwardQueries(t, forwarder, 4)
+	if got := addressQueries(hierarchy, upstream1); got != 0 {
+		t.Errorf("upstream that failed its health check was asked %d times", got)
+	}
+
+	hierarchy.SetBehaviour(upstream1, resolvertest.Answer)
+	waitFor("the upstream to return to rotation", func() bool {
+		forwardQueries(t, forwarder, 1)
+		return addressQueries(hierarchy, upstream1) > 0
+	})
+}
+
+func TestForwarderPassesOnOnlyTheAnswer(t *testing.T) {
+	forwarder, hierarchy := newTestForwarder(t, resolver.StrategyRoundRobin, 0)
+	hierarchy.SetBehaviour(upstream1, resolvertest.Pollute)
+	hierarchy.SetBehaviour(upstream2, resolvertest.Pollute)
+
+	for _, name := range []string{"www.example.com", "alias.example.com"} {
+		records, err := forwarder.Resolve(context.Background(), name, protocol.TypeA)
+		if err != nil {
+			t.Fatalf("Resolve(%s): %v", name, err)
+		}
+		for _, rr := range records {
+			if protocol.EqualNames(rr.Name, resolvertest.PollutedName) {
+				t.Errorf("Resolve(%s) passed on the unrelated record %s", name, rr.Name)
+			}
+		}
+		assertAddresses(t, records, "192.0.2.1")
+	}
+}
+
+// newConditionalResolver returns a resolver over the fake hierarchy that
+// forwards corp.example to upstream1 and a.corp.example to upstream2.
+func newConditionalResolver(t *testing.T) (*resolver.Resolver, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	res, hierarchy := newTestResolver(t)
+	for _, ip := range []string{upstream1, upstream2} {
+		if err := hierarchy.AddZone(ip, ".", upstreamZone); err != nil {
+			t.Fatalf("AddZone: %v", err)
+		}
+	}
+
+	conditional := resolver.NewConditionalForwarder(time.Second)
+	conditional.SetExchanger(hierarchy)
+	conditional.AddRule("Corp.Example.", []string{upstream1}, resolver.StrategyRoundRobin, 0, 0)
+	conditional.AddRule("a.corp.example", []string{upstream2}, resolver.StrategyRoundRobin, 0, 0)
+	res.SetConditionalForwarder(conditional)
+	return res, hierarchy
+}
+
+func TestConditionalForwardingPicksLongestSuffix(t *testing.T) {
+	res, hierarchy := newConditionalResolver(t)
+
+	tests := []struct {
+		name     string
+		upstream string
+	}{
+		{"host.corp.example", upstream1},
+		{"corp.example", upstream1},
+		{"Other.CORP.example.", upstream1},
+		{"a.corp.example", upstream2},
+		{"X.A.Corp.Example.", upstream2},
+		// Suffixes match whole labels only
+		{"xcorp.example", ""},
+		{"corp.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res.Resolve(context.Background(), tt.name, protocol.TypeA)
+
+			for _, ip := range []string{upstream1, upstream2} {
+				if got, want := askedFor(hierarchy.Queries(ip), tt.name), ip == tt.upstream; got != want {
+					t.Errorf("%s asked: %v, want %v", ip, got, want)
+				}
+			}
+		})
+	}
+
+	hits := res.GetStats().ForwardRuleHits
+	if hits["corp.example."] != 3 || hits["a.corp.example."] != 2 || len(hits) != 2 {
+		t.Errorf("rule hits %v, want 3 for corp.example. and 2 for a.corp.example.", hits)
+	}
+
+	// Answers from the cache do not count as forwarded
+	res.Resolve(context.Background(), "host.corp.example", protocol.TypeA)
+	if got := res.GetStats().ForwardRuleHits["corp.example."]; got != 3 {
+		t.Errorf("cached answer counted as a rule hit: %d", got)
+	}
+}
+
+func TestConditionalForwardingTimeouts(t *testing.T) {
+	res, hierarchy := newTestResolver(t)
+	hierarchy.AddZone(upstream1, ".", upstreamZone)
+	hierarchy.AddZone(upstream2, ".", upstreamZone)
+	hierarchy.SetBehaviour(upstream1, resolvertest.Hang)
+	hierarchy.SetBehaviour(upstream2, resolvertest.Hang)
+
+	conditional := resolver.NewConditionalForwarder(50 * time.Millisecond)
+	conditional.SetExchanger(hierarchy)
+	conditional.AddRule("default.example", []string{upstream1}, resolver.StrategyRoundRobin, 0, 0)
+	conditional.AddRule("own.example", []string{upstream2}, resolver.StrategyRoundRobin, 300*time.Millisecond, 0)
+	res.SetConditionalForwarder(conditional)
+
+	tests := []struct {
+		name     string
+		min, max time.Duration
+	}{
+		{"www.default.example", 50 * time.Millisecond, 250 * time.Millisecond},
+		{"www.own.example", 300 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if _, err := res.Resolve(context.Background(), tt.name, protocol.TypeA); err == nil {
+				t.Fatal("Resolve succeeded against a hanging upstream")
+			}
+			if elapsed := time.Since(start); elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("gave up after %v, want between %v and %v", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		in         string
+		protocol   string
+		address    string
+		serverName string
+		pins       int
+	}{
+		{"192.0.2.53", resolver.ProtocolUDP, "192.0.2.53:53", "", 0},
+		{"192.0.2.53:5353", resolver.ProtocolUDP, "192.0.2.53:5353", "", 0},
+		{"tcp://192.0.2.53", resolver.ProtocolTCP, "192.0.2.53:53", "", 0},
+		{"tls://192.0.2.53", resolver.ProtocolTLS, "192.0.2.53:853", "192.0.2.53", 0},
+		{"tls://192.0.2.53:8853?sni=dns.example&pin=" + pin, resolver.ProtocolTLS, "192.0.2.53:8853", "dns.example", 1},
+		{"https://dns.example/dns-query?pin=" + pin, resolver.ProtocolHTTPS, "https://dns.example/dns-query", "dns.example", 1},
+	}
+
+	for _, tt := range tests {
+		endpoint, err := resolver.ParseEndpoint(tt.in)
+		if err != nil {
+			t.Errorf("ParseEndpoint(%q): %v", tt.in, err)
+			continue
+		}
+		if endpoint.Protocol != tt.protocol || endpoint.Address != tt.address ||
+			endpoint.ServerName != tt.serverName || len(endpoint.Pins) != tt.pins {
+			t.Errorf("ParseEndpoint(%q) = %+v", tt.in, endpoint)
+		}
+	}
+
+	for _, bad := range []string{"", "quic://192.0.2.53", "tls://192.0.2.53?pin=short", "https:///dns-query"} {
+		if _, err := resolver.ParseEndpoint(bad); !errors.Is(err, resolver.ErrInvalidEndpoint) {
+			t.Errorf("ParseEndpoint(%q): got %v, want ErrInvalidEndpoint", bad, err)
+		}
+	}
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// dotServer serves DNS over TLS with handler, counting the connections
+// clients open.
+func dotServer(t *testing.T, handler func(context.Context, []byte) ([]byte, error)) (string, *x509.Certificate, *atomic.Int32) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert := writeTestCertificate(t, certFile, keyFile, 1)
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					length := make([]byte, 2)
+					if _, err := io.ReadFull(conn, length); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					response, err := handler(context.Background(), query)
+					if err != nil {
+						return
+					}
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), cert, &accepted
+}
+
+func TestForwarderOverTLSReusesConnections(t *testing.T) {
+	addr, cert, accepted := dotServer(t, dohAnswer(t))
+
+	forwarder := resolver.NewForwarder([]string{"tls://" + addr + "?pin=" + url.QueryEscape(spkiPin(cert))},
+		resolver.StrategyRoundRobin, 2*time.Second, 0)
+	defer forwarder.Close()
+
+	for i := 0; i < 3; i++ {
+		records, err := forwarder.Resolve(context.Background(), "example.com", protocol.TypeA)
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if len(records) != 2 {
+			t.Errorf("got %d records, want 2", len(records))
+		}
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("opened %d connections for 3 queries, want 1", n)
+	}
+}
+
+func TestForwarderOverTLSChecksPins(t *testing.T) {
+	addr, _, _ := dotServer(t, dohAnswer(t))
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	forwarder := resolver.NewForwarder([]string{"tls://" + addr + "?pin=" + url.QueryEscape(wrongPin)},
+		resolver.StrategyRoundRobin, 2*time.Second, 0)
+	defer forwarder.Close()
+
+	if _, err := forwarder.Resolve(context.Background(), "example.com", protocol.TypeA); !errors.Is(err, resolver.ErrPinMismatch) {
+		t.Errorf("Resolve with the wrong pin: got %v, want ErrPinMismatch", err)
+	}
+}
+
+func TestForwarderOverHTTPS(t *testing.T) {
+	server := httptest.NewUnstartedServer(transport.NewHTTPSTransport("", "", "", time.Second, dohAnswer(t)))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	upstream := server.URL + "/dns-query?pin=" + url.QueryEscape(spkiPin(server.Certificate()))
+	forwarder := resolver.NewForwarder([]string{upstream}, resolver.StrategyRoundRobin, 2*time.Second, 0)
+	defer forwarder.Close()
+
+	records, err := forwarder.Resolve(context.Background(), "example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("got %d records, want 2", len(records))
+	}
+}
+
+func TestResolverRechecksFailedUpstreamsLater(t *testing.T) {
+	res, hierarchy := newShortTTLResolver(t, func(config *models.CacheConfig) {
+		config.PrefetchPercent = 0
+		config.StaleWindow = time.Minute
+		config.StaleRecheckInterval = 300 * time.Millisecond
+	})
+
+	hit(t, res, "www.example.com", 1)
+	time.Sleep(2100 * time.Millisecond)
+
+	hierarchy.SetBehaviour(exampleCom, resolvertest.ServerFailure)
+	records, err := res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve with a failing upstream: %v", err)
+	}
+	if records[0].TTL != 30 {
+		t.Errorf("TTL: got %d, want the stale TTL of 30", records[0].TTL)
+	}
+	failed := timesAsked(hierarchy, exampleCom, "www.example.com")
+
+	// Within the recheck interval the stale answer is served straight
+	// away, without asking the failing server again
+	hierarchy.SetBehaviour(exampleCom, resolvertest.Answer)
+	hit(t, res, "www.example.com", 5)
+	if got := timesAsked(hierarchy, exampleCom, "www.example.com"); got != failed {
+		t.Errorf("asked %d more times during the recheck interval", got-failed)
+	}
+
+	// Then the entry is refreshed with no client waiting for it
+	assertTimesAsked(t, hierarchy, exampleCom, "www.example.com", failed+1)
+	records, err = res.Resolve(context.Background(), "www.example.com", protocol.TypeA)
+	if err != nil {
+		t.Fatalf("Resolve after the recheck: %v", err)
+	}
+	if records[0].TTL > 2 {
+		t.Errorf("TTL: got %d, want the refreshed answer's", records[0].TTL)
+	}
+	if got := timesAsked(hierarchy, exampleCom, "www.example.com"); got != failed+1 {
+		t.Errorf("refreshed answer not served from the cache: asked %d times, want %d", got, failed+1)
+	}
+}
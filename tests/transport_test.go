@@ -0,0 +1,413 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/internal/transport"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 with
+// the given serial number and returns it parsed.
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func freeTCPAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func dialTLS(t *testing.T, addr string) *tls.Conn {
+	t.Helper()
+
+	config := &tls.Config{InsecureSkipVerify: true}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", addr, config)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSTransportAnswersOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	// Echo each query back, holding the first one until the second is done
+	secondDone := make(chan struct{})
+	handler := func(ctx context.Context, query []byte) ([]byte, error) {
+		if binary.BigEndian.Uint16(query) == 1 {
+			select {
+			case <-secondDone:
+			case <-time.After(2 * time.Second):
+			}
+		} else {
+			defer close(secondDone)
+		}
+		return query, nil
+	}
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go transport.NewTLSTransport(addr, certFile, keyFile, time.Second, handler).Start(ctx)
+
+	conn := dialTLS(t, addr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, id := range []uint16{1, 2} {
+		query := []byte{0, 12, byte(id >> 8), byte(id), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		if _, err := conn.Write(query); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	for _, want := range []uint16{2, 1} {
+		header := make([]byte, 14)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got := binary.BigEndian.Uint16(header[2:]); got != want {
+			t.Errorf("got response %d, want %d", got, want)
+		}
+	}
+}
+
+// blockingHandler never answers: it reports each query as it starts and
+// again once the query's context ends and it gives up.
+func blockingHandler() (func(context.Context, []byte) ([]byte, error), chan struct{}, chan struct{}) {
+	started, returned := make(chan struct{}, 1), make(chan struct{}, 1)
+	handler := func(ctx context.Context, query []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		returned <- struct{}{}
+		return nil, ctx.Err()
+	}
+	return handler, started, returned
+}
+
+// assertCloseCancelsQuery sends one query over conn, closes the
+// connection while the query is in flight and checks the handler is let
+// go promptly.
+func assertCloseCancelsQuery(t *testing.T, conn net.Conn, started, returned chan struct{}) {
+	t.Helper()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	query := []byte{0, 12, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("query never reached the handler")
+	}
+
+	conn.Close()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Error("query still running after the client closed the connection")
+	}
+}
+
+func TestTCPTransportCancelsQueriesOnClose(t *testing.T) {
+	handler, started, returned := blockingHandler()
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go transport.NewTCPTransport(addr, handler).Start(ctx)
+
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var err error
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertCloseCancelsQuery(t, conn, started, returned)
+}
+
+func TestTLSTransportCancelsQueriesOnClose(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+	handler, started, returned := blockingHandler()
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go transport.NewTLSTransport(addr, certFile, keyFile, time.Minute, handler).Start(ctx)
+
+	assertCloseCancelsQuery(t, dialTLS(t, addr), started, returned)
+}
+
+func TestTLSTransportIdleTimeoutSparesSlowQueries(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := func(ctx context.Context, query []byte) ([]byte, error) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			return query, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	go transport.NewTLSTransport(addr, certFile, keyFile, 100*time.Millisecond, slow).Start(ctx)
+
+	conn := dialTLS(t, addr)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	query := []byte{0, 12, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(query))); err != nil {
+		t.Fatalf("query outliving the idle timeout was dropped: %v", err)
+	}
+
+	// With nothing left in flight the idle timeout applies again
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err := io.ReadFull(conn, make([]byte, 1))
+	var netErr net.Error
+	if err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("idle connection left open: %v", err)
+	}
+}
+
+func TestTLSTransportReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echo := func(ctx context.Context, query []byte) ([]byte, error) { return query, nil }
+	go transport.NewTLSTransport(addr, certFile, keyFile, time.Second, echo).Start(ctx)
+
+	conn := dialTLS(t, addr)
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Errorf("initial certificate serial %d, want 1", serial)
+	}
+	conn.Close()
+
+	writeTestCertificate(t, certFile, keyFile, 2)
+	// Make the change visible even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	conn = dialTLS(t, addr)
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("certificate serial after renewal %d, want 2", serial)
+	}
+}
+
+// dohAnswer answers every query with two A records of different TTLs.
+func dohAnswer(t *testing.T) func(context.Context, []byte) ([]byte, error) {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		request, err := protocol.ParseMessage(query)
+		if err != nil {
+			return nil, err
+		}
+		short := mustRecord(t, "example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.1")})
+		short.TTL = 60
+		long := mustRecord(t, "example.com", protocol.TypeA, &protocol.ARecord{IP: net.ParseIP("192.0.2.2")})
+		return protocol.BuildMessage(protocol.CreateResponse(request, []protocol.ResourceRecord{long, short}))
+	}
+}
+
+func dohQuery(t *testing.T) []byte {
+	t.Helper()
+
+	query, err := protocol.BuildMessage(&protocol.Message{
+		Header:    protocol.Header{Flags: protocol.FlagRD},
+		Questions: []protocol.Question{{Name: "example.com", Type: protocol.TypeA, Class: protocol.ClassIN}},
+	})
+	if err != nil {
+		t.Fatalf("BuildMessage: %v", err)
+	}
+	return query
+}
+
+func TestHTTPSTransportServesDoH(t *testing.T) {
+	doh := transport.NewHTTPSTransport("", "", "", time.Second, dohAnswer(t))
+	query := dohQuery(t)
+
+	get := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	post := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, req := range []*http.Request{get, post} {
+		rec := httptest.NewRecorder()
+		doh.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", req.Method, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/dns-message" {
+			t.Errorf("%s: Content-Type %q", req.Method, got)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "max-age=60" {
+			t.Errorf("%s: Cache-Control %q, want max-age=60", req.Method, got)
+		}
+		response, err := protocol.ParseMessage(rec.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: ParseMessage: %v", req.Method, err)
+		}
+		if len(response.Answers) != 2 {
+			t.Errorf("%s: %d answers, want 2", req.Method, len(response.Answers))
+		}
+	}
+}
+
+func TestHTTPSTransportRejectsBadRequests(t *testing.T) {
+	doh := transport.NewHTTPSTransport("", "", "", time.Second, dohAnswer(t))
+	query := dohQuery(t)
+
+	wrongType := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(query))
+	wrongType.Header.Set("Content-Type", "text/plain")
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"missing parameter", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{"invalid base64", httptest.NewRequest(http.MethodGet, "/dns-query?dns=%25%25", nil), http.StatusBadRequest},
+		{"wrong content type", wrongType, http.StatusUnsupportedMediaType},
+		{"wrong method", httptest.NewRequest(http.MethodPut, "/dns-query", bytes.NewReader(query)), http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		doh.ServeHTTP(rec, tt.req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestHTTPSTransportSpeaksHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	addr := freeTCPAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go transport.NewHTTPSTransport(addr, certFile, keyFile, time.Second, dohAnswer(t)).Start(ctx)
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	url := "https://" + addr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(dohQuery(t))
+
+	var resp *http.Response
+	var err error
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if resp, err = client.Get(url); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol %s, want HTTP/2", resp.Proto)
+	}
+}
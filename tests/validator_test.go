@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/models"
+	"DNS-server/pkg/resolver"
+	"DNS-server/pkg/resolver/resolvertest"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newValidatingResolver walks the fake hierarchy with the root, com,
+// example.com and net signed, and validates against the root's key.
+// example.net and glueless.com are unsigned delegations.
+func newValidatingResolver(t *testing.T) (*resolver.Resolver, *resolvertest.Hierarchy) {
+	t.Helper()
+
+	hierarchy := newTestHierarchy(t)
+	var anchor *protocol.DSRecord
+	for _, origin := range []string{".", "com", "example.com", "net"} {
+		ds, err := hierarchy.Sign(origin)
+		if err != nil {
+			t.Fatalf("Sign(%s): %v", origin, err)
+		}
+		if origin == "." {
+			anchor = ds
+		}
+	}
+
+	config := models.DefaultCacheConfig()
+	config.StaleWindow = 0
+	config.PrefetchPercent = 0
+
+	res := resolver.NewResolver(config)
+	res.SetExchanger(hierarchy)
+	res.SetRootServers([]string{rootServer})
+	res.EnableDNSSEC([]*protocol.DSRecord{anchor})
+	t.Cleanup(res.Close)
+
+	return res, hierarchy
+}
+
+func TestValidatorSecureAnswer(t *testing.T) {
+	res, _ := newValidatingResolver(t)
+
+	records, security, err := res.ResolveSecure(context.Background(), "www.example.com", protocol.TypeA, false)
+	if err != nil {
+		t.Fatalf("ResolveSecure: %v", err)
+	}
+	if security != models.SecuritySecure {
+		t.Errorf("security: got %s, want secure", security)
+	}
+	assertAddresses(t, records, "192.0.2.1")
+	for _, rr := range records {
+		if rr.Type == protocol.TypeRRSIG {
+			t.Errorf("signatures fetched for validation handed back: %v", rr)
+		}
+	}
+
+	// The cached answer keeps its status
+	if _, security, _ := res.ResolveSecure(context.Background(), "www.example.com", protocol.TypeA, false); security != models.SecuritySecure {
+		t.Errorf("cached security: got %s, want secure", security)
+	}
+}
+
+func TestValidatorSecureDenials(t *testing.T) {
+	res, _ := newValidatingResolver(t)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		nxdomain bool
+	}{
+		{"missing.example.com", protocol.TypeA, true},
+		{"deep.missing.example.com", protocol.TypeA, true},
+		{"www.example.com", protocol.TypeAAAA, false},
+	}
+	for _, tt := range tests {
+		_, security, err := res.ResolveSecure(context.Background(), tt.name, tt.qtype, false)
+		var negative *resolver.NegativeResponse
+		if !errors.As(err, &negative) {
+			t.Errorf("%s %s: got %v, want a negative answer", tt.name, protocol.TypeToString(tt.qtype), err)
+			continue
+		}
+		if negative.NXDomain != tt.nxdomain {
+			t.Errorf("%s %s: NXDOMAIN %v, want %v", tt.name, protocol.TypeToString(tt.qtype), negative.NXDomain, tt.nxdomain)
+		}
+		if security != models.SecuritySecure {
+			t.Errorf("%s %s: security %s, want secure", tt.name, protocol.TypeToString(tt.qtype), security)
+		}
+	}
+}
+
+func TestValidatorInsecureDelegation(t *testing.T) {
+	res, _ := newValidatingResolver(t)
+
+	records, security, err := res.ResolveSecure(context.Background(), "www.example.net", protocol.TypeA, false)
+	if err != nil {
+		t.Fatalf("ResolveSecure: %v", err)
+	}
+	if security != models.SecurityInsecure {
+		t.Errorf("security: got %s, want insecure", security)
+	}
+	assertAddresses(t, records, "192.0.2.2")
+
+	// A CNAME from a signed zone into an unsigned one is no better than
+	// the unsigned end
+	_, security, err = res.ResolveSecure(context.Background(), "alias.example.com", protocol.TypeA, false)
+	if err != nil {
+		t.Fatalf("ResolveSecure(alias): %v", err)
+	}
+	if security != models.SecurityInsecure {
+		t.Errorf("alias security: got %s, want insecure", security)
+	}
+}
+
+func TestValidatorRejectsForgedAnswer(t *testing.T) {
+	res, hierarchy := newValidatingResolver(t)
+	hierarchy.SetBehaviour(exampleCom, resolvertest.Forge)
+
+	_, _, err := res.ResolveSecure(context.Background(), "www.example.com", protocol.TypeA, false)
+	if !errors.Is(err, resolver.ErrBogus) {
+		t.Fatalf("got %v, want ErrBogus", err)
+	}
+
+	// Checking disabled hands the answer over, marked bogus
+	records, security, err := res.ResolveSecure(context.Background(), "www.example.com", protocol.TypeA, true)
+	if err != nil {
+		t.Fatalf("ResolveSecure with CD: %v", err)
+	}
+	if security != models.SecurityBogus {
+		t.Errorf("security: got %s, want bogus", security)
+	}
+	assertAddresses(t, records, "203.0.113.66")
+}
+
+func TestValidatorSharesZoneKeysAcrossQueries(t *testing.T) {
+	res, hierarchy := newValidatingResolver(t)
+	hierarchy.SetDelay(exampleCom, 20*time.Millisecond)
+
+	names := []string{"www.example.com", "ns1.example.com", "missing.example.com", "other.example.com"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, security, _ := res.ResolveSecure(context.Background(), name, protocol.TypeA, false)
+			if security != models.SecuritySecure {
+				t.Errorf("%s: security %s, want secure", name, security)
+			}
+		}()
+	}
+	wg.Wait()
+
+	keyQueries := 0
+	for _, q := range hierarchy.Queries(exampleCom) {
+		if q.Type == protocol.TypeDNSKEY {
+			keyQueries++
+		}
+	}
+	if keyQueries != 1 {
+		t.Errorf("example.com DNSKEY fetched %d times, want once", keyQueries)
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"DNS-server/internal/protocol"
+	"DNS-server/pkg/zone"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN corp.internal.
+$TTL 1h
+@       IN  SOA ns1 hostmaster (
+            2024010101 ; serial
+            3600 600 1w 300 )
+        IN  NS  ns1
+ns1     IN  A   10.0.0.1
+www     IN  CNAME web
+web     IN  A   10.0.0.3
+txt     IN  TXT "hello world" "second"
+*.apps  IN  A   10.0.0.9
+a.b     IN  A   10.0.0.10
+sub     IN  NS  ns.sub
+ns.sub  IN  A   10.1.0.1
+$INCLUDE lab.zone lab
+`
+
+func loadTestZone(t *testing.T) *zone.Zone {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corp.zone")
+	if err := os.WriteFile(path, []byte(testZoneFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lab.zone"), []byte("host 60 IN A 10.2.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := zone.LoadFile(path, "corp.internal")
+	if err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	return z
+}
+
+func TestZoneLookup(t *testing.T) {
+	z := loadTestZone(t)
+
+	tests := []struct {
+		name        string
+		qtype       uint16
+		rcode       uint16
+		aa          bool
+		answers     []string
+		authorities []uint16
+	}{
+		{"www.corp.internal", protocol.TypeA, protocol.RCodeNoError, true, []string{"web.corp.internal.", "10.0.0.3"}, nil},
+		{"txt.corp.internal", protocol.TypeTXT, protocol.RCodeNoError, true, []string{`"hello world" "second"`}, nil},
+		{"x.apps.corp.internal", protocol.TypeA, protocol.RCodeNoError, true, []string{"10.0.0.9"}, nil},
+		{"host.lab.corp.internal", protocol.TypeA, protocol.RCodeNoError, true, []string{"10.2.0.1"}, nil},
+		{"web.corp.internal", protocol.TypeMX, protocol.RCodeNoError, true, nil, []uint16{protocol.TypeSOA}},
+		{"b.corp.internal", protocol.TypeA, protocol.RCodeNoError, true, nil, []uint16{protocol.TypeSOA}},
+		{"missing.corp.internal", protocol.TypeA, protocol.RCodeNXDomain, true, nil, []uint16{protocol.TypeSOA}},
+		{"deep.sub.corp.internal", protocol.TypeA, protocol.RCodeNoError, false, nil, []uint16{protocol.TypeNS}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name+"/"+protocol.TypeToString(tc.qtype), func(t *testing.T) {
+			result := z.Lookup(tc.name, tc.qtype)
+
+			if result.RCode != tc.rcode {
+				t.Errorf("rcode: got %s, want %s", protocol.RCodeToString(result.RCode), protocol.RCodeToString(tc.rcode))
+			}
+			if result.Authoritative != tc.aa {
+				t.Errorf("authoritative: got %v, want %v", result.Authoritative, tc.aa)
+			}
+
+			if len(result.Answers) != len(tc.answers) {
+				t.Fatalf("answers: got %d, want %d", len(result.Answers), len(tc.answers))
+			}
+			for i, want := range tc.answers {
+				if got := result.Answers[i].Data.String(); got != want {
+					t.Errorf("answer %d: got %q, want %q", i, got, want)
+				}
+			}
+
+			if len(result.Authorities) != len(tc.authorities) {
+				t.Fatalf("authorities: got %d, want %d", len(result.Authorities), len(tc.authorities))
+			}
+			for i, want := range tc.authorities {
+				if got := result.Authorities[i].Type; got != want {
+					t.Errorf("authority %d: got %s, want %s", i, protocol.TypeToString(got), protocol.TypeToString(want))
+				}
+			}
+		})
+	}
+}
+
+func TestZoneReferralIncludesGlue(t *testing.T) {
+	z := loadTestZone(t)
+
+	result := z.Lookup("www.sub.corp.internal", protocol.TypeA)
+	if len(result.Additional) != 1 || result.Additional[0].Data.String() != "10.1.0.1" {
+		t.Errorf("glue: got %v, want the A record of ns.sub.corp.internal", result.Additional)
+	}
+}
+
+func TestZoneNegativeTTLUsesSOAMinimum(t *testing.T) {
+	z := loadTestZone(t)
+
+	result := z.Lookup("missing.corp.internal", protocol.TypeA)
+	if ttl := result.Authorities[0].TTL; ttl != 300 {
+		t.Errorf("negative TTL: got %d, want 300", ttl)
+	}
+}
+
+func TestParseRejectsInclude(t *testing.T) {
+	text := "@ 3600 IN SOA ns1 hostmaster 1 3600 600 604800 300\n$INCLUDE lab.zone lab\n"
+	if _, err := zone.Parse(text, "corp.internal"); err == nil {
+		t.Error("Parse accepted $INCLUDE")
+	}
+}